@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/PirosB3/TelepathWallet"
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"gopkg.in/redis.v5"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -20,10 +30,20 @@ var (
 	Info  *log.Logger
 	Error *log.Logger
 
-	usm     *wallet.UnspentTransactionMonitor
-	reserve *wallet.ReserveService
-	txMgr   *wallet.TransactionManager
-	acctMgr *wallet.AccountManager
+	usm         *wallet.UnspentTransactionMonitor
+	reserve     *wallet.ReserveService
+	txMgr       *wallet.TransactionManager
+	acctMgr     *wallet.AccountManager
+	idempotency *wallet.IdempotencyService
+	batcher     *wallet.PayoutBatcher
+	ledger      *wallet.Ledger
+	journal     *wallet.Journal
+	watchList   *wallet.WatchList
+	events      *wallet.EventRecorder
+	webhooks    *wallet.WebhookService
+	history     *wallet.TransactionHistory
+	broadcasts  *wallet.BroadcastTracker
+	changes     *wallet.ChangeAddresses
 )
 
 func init() {
@@ -39,7 +59,6 @@ func init() {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	DB.AutoMigrate(&wallet.Reserve{})
 	Client = redis.NewClient(&redis.Options{
 		Addr:     "localhost:6379",
 		Password: "",
@@ -47,7 +66,207 @@ func init() {
 	})
 
 	DB.AutoMigrate(&wallet.Account{})
-	DB.AutoMigrate(&wallet.Reserve{})
+	DB.AutoMigrate(&wallet.IdempotencyRecord{})
+	DB.AutoMigrate(&wallet.PayoutRequest{})
+	DB.AutoMigrate(&wallet.LedgerTransfer{})
+	DB.AutoMigrate(&wallet.JournalEntry{})
+	DB.AutoMigrate(&wallet.InFlightSpend{})
+	DB.AutoMigrate(&wallet.InFlightOutpoint{})
+	DB.AutoMigrate(&wallet.CachedUTXO{})
+	DB.AutoMigrate(&wallet.SyncState{})
+	DB.AutoMigrate(&wallet.WatchedAddress{})
+	DB.AutoMigrate(&wallet.WalletEvent{})
+	DB.AutoMigrate(&wallet.Webhook{})
+	DB.AutoMigrate(&wallet.WebhookDelivery{})
+	DB.AutoMigrate(&wallet.TransactionRecord{})
+	DB.AutoMigrate(&wallet.BroadcastTransaction{})
+	DB.AutoMigrate(&wallet.FeeReplacement{})
+	DB.AutoMigrate(&wallet.ChangeAddress{})
+	DB.AutoMigrate(&wallet.Cancellation{})
+	if err := wallet.MigrateReserves(DB); err != nil {
+		panic(err)
+	}
+}
+
+func respondError(writer http.ResponseWriter, message string) {
+	response := struct {
+		Error string
+	}{message}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// ledgerBalance is the on-chain balance of an address adjusted by what it
+// sent and received through off-chain transfers.
+func ledgerBalance(address string) (onChain, offChain int64, err error) {
+	onChain, err = usm.GetUTXOBalanceForAddress(address)
+	if err != nil {
+		Error.Print(err)
+		onChain = 0
+	}
+	offChain, err = ledger.NetForAddress(address)
+	return onChain, offChain, err
+}
+
+// availableForAddress is the part of an address balance that is not held
+// by any reserve. Nothing is available while the ledger cannot be read.
+func availableForAddress(address string) int64 {
+	onChain, offChain, err := ledgerBalance(address)
+	if err != nil {
+		Error.Print(err)
+		return 0
+	}
+	return onChain + offChain - reserve.GetAmountReservedForAddress(address)
+}
+
+// rememberOwner records which user an address belongs to, so that its
+// keys can be found again from the address alone.
+func rememberOwner(username, address string) {
+	if err := Client.HSet("address_owners", address, username).Err(); err != nil {
+		Error.Print(err)
+	}
+}
+
+// keysForAddress resolves the private key of an address seen through
+// rememberOwner, or of a change address derived from one.
+func keysForAddress(address string) (*btcec.PrivateKey, error) {
+	username, err := Client.HGet("address_owners", address).Result()
+	if err == redis.Nil {
+		if pk, err := changes.Keys(address); err == nil {
+			return pk, nil
+		}
+		return nil, errors.New("Address " + address + " does not belong to any account")
+	}
+	if err != nil {
+		return nil, err
+	}
+	pk, _ := acctMgr.GetKeysForAddress(username)
+	return pk, nil
+}
+
+// responseRecorder keeps a copy of everything a handler writes so that it
+// can be stored against an idempotency key.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	rr.statusCode = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	rr.body.Write(data)
+	return rr.ResponseWriter.Write(data)
+}
+
+// Idempotent makes a handler honor the Idempotency-Key header: a retry with
+// the same key and body gets the original response back instead of running
+// the handler again, and reusing a key with a different body is rejected.
+func Idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(writer, request)
+			return
+		}
+
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			respondError(writer, err.Error())
+			return
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope := request.Method + " " + request.URL.Path
+		record, err := idempotency.Begin(scope, key, wallet.HashRequestBody(body))
+		switch err {
+		case nil:
+		case wallet.ErrIdempotencyKeyReused:
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			respondError(writer, err.Error())
+			return
+		case wallet.ErrIdempotencyInProgress:
+			writer.WriteHeader(http.StatusConflict)
+			respondError(writer, err.Error())
+			return
+		default:
+			writer.WriteHeader(http.StatusInternalServerError)
+			respondError(writer, err.Error())
+			return
+		}
+
+		if record != nil {
+			writer.Header().Set("Idempotent-Replayed", "true")
+			writer.WriteHeader(record.StatusCode)
+			writer.Write([]byte(record.Response))
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: writer, statusCode: http.StatusOK}
+		handler(recorder, request)
+		err = idempotency.Complete(scope, key, recorder.statusCode, recorder.body.Bytes())
+		if err != nil {
+			Error.Print(err)
+		}
+	}
+}
+
+// spendOutputs works out who a spend pays: either a list of outputs, or a
+// single destination given as another account, an address or a BIP21 URI.
+// A single destination may leave the amount at 0 to pay the whole reserve.
+func spendOutputs(
+	account, address, uri string,
+	amount int64,
+	outputs []wallet.SpendOutput,
+) ([]wallet.SpendOutput, error) {
+	destinations := 0
+	for _, destination := range []string{account, address, uri} {
+		if destination != "" {
+			destinations++
+		}
+	}
+
+	if len(outputs) > 0 {
+		if destinations > 0 || amount != 0 {
+			return nil, errors.New("Give either outputs or a single destination")
+		}
+		for _, output := range outputs {
+			if output.Amount <= 0 {
+				return nil, errors.New("Every output needs an amount")
+			}
+		}
+		return outputs, nil
+	}
+
+	if destinations != 1 {
+		return nil, errors.New("Give exactly one of account, address or uri")
+	}
+
+	switch {
+	case account != "":
+		_, toAddress := acctMgr.GetKeysForAddress(account)
+		address = toAddress.EncodeAddress()
+	case uri != "":
+		output, err := wallet.ParsePaymentURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		if output.Amount != 0 {
+			if amount != 0 && amount != output.Amount {
+				return nil, errors.New("Amount does not match the payment URI")
+			}
+			amount = output.Amount
+		}
+		address = output.Address
+	}
+
+	if _, err := wallet.DecodeDestination(address); err != nil {
+		return nil, err
+	}
+	return []wallet.SpendOutput{{Address: address, Amount: amount}}, nil
 }
 
 func SpendReserve(writer http.ResponseWriter, request *http.Request) {
@@ -56,27 +275,79 @@ func SpendReserve(writer http.ResponseWriter, request *http.Request) {
 	reserveId := vars["reserve"]
 
 	payload := &struct {
-		DestinationUser string `json:"account"`
+		DestinationUser string               `json:"account"`
+		Address         string               `json:"address"`
+		URI             string               `json:"uri"`
+		Outputs         []wallet.SpendOutput `json:"outputs"`
+		Amount          int64                `json:"amount"`
+		Batch           bool                 `json:"batch"`
+		FeePolicy       string               `json:"fee_policy"`
 	}{}
 	err := json.NewDecoder(request.Body).Decode(payload)
 	if err != nil {
-		Error.Fatal(err)
+		respondError(writer, err.Error())
+		return
 	}
 
-	frmPk, frmAddress := acctMgr.GetKeysForAddress(username)
-	_, toAddress := acctMgr.GetKeysForAddress(payload.DestinationUser)
-	tx, err := txMgr.SpendReserve(
-		frmAddress.EncodeAddress(), reserveId,
-		frmPk, toAddress.EncodeAddress(),
+	policy, err := wallet.ParseFeePolicy(payload.FeePolicy)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	outputs, err := spendOutputs(
+		payload.DestinationUser, payload.Address, payload.URI,
+		payload.Amount, payload.Outputs,
 	)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	frmPk, frmAddress := acctMgr.GetKeysForAddress(username)
+
+	if payload.Batch {
+		rememberOwner(username, frmAddress.EncodeAddress())
+		payoutIds, err := batcher.EnqueueOutputs(
+			frmAddress.EncodeAddress(), reserveId, outputs, policy,
+		)
+		if err != nil {
+			respondError(writer, err.Error())
+			return
+		}
+
+		response := &struct {
+			PayoutIds []uint
+			Status    string
+		}{payoutIds, wallet.PAYOUT_PENDING}
+
+		json.NewEncoder(writer).Encode(response)
+		return
+	}
+
+	var tx string
+	var fee int64
+	if len(outputs) == 1 {
+		tx, fee, err = txMgr.SpendReserve(
+			frmAddress.EncodeAddress(), reserveId,
+			frmPk, outputs[0].Address, outputs[0].Amount, policy,
+		)
+	} else {
+		tx, fee, err = txMgr.SpendReserveToOutputs(
+			frmAddress.EncodeAddress(), reserveId,
+			frmPk, outputs, policy,
+		)
+	}
 
 	if err != nil {
-		Error.Fatal(err)
+		respondError(writer, err.Error())
+		return
 	}
 
 	response := &struct {
 		Transaction string
-	}{tx}
+		Fee         int64
+	}{tx, fee}
 
 	json.NewEncoder(writer).Encode(response)
 }
@@ -94,30 +365,343 @@ func MakeReserveHandler(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	_, address := acctMgr.GetKeysForAddress(username)
-	utxoBalance, err := usm.GetUTXOBalanceForAddress(address.EncodeAddress())
+	idResponse, err := reserve.AddReserveAvailable(address.EncodeAddress(), payload.Amount, availableForAddress)
 	if err != nil {
-		Error.Fatal(err)
+		respondError(writer, err.Error())
+		return
 	}
 
-	totalReserve := reserve.GetAmountReservedForAddress(address.EncodeAddress())
+	response := struct {
+		ReserveId string
+	}{idResponse}
+
+	json.NewEncoder(writer).Encode(&response)
+}
 
-	available := utxoBalance - totalReserve
-	if payload.Amount > available {
-		response := struct {
-			Error string
-		}{"Amount is too high"}
-		json.NewEncoder(writer).Encode(&response)
+func GetReserveHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+	reserveId := vars["reserve"]
+
+	_, address := acctMgr.GetKeysForAddress(username)
+	res, err := reserve.GetReserve(address.EncodeAddress(), reserveId)
+	if err != nil {
+		respondError(writer, err.Error())
 		return
 	}
 
-	idResponse, err := reserve.AddReserveForAddress(address.EncodeAddress(), payload.Amount)
+	type event struct {
+		Kind   string    `json:"kind"`
+		Amount int64     `json:"amount"`
+		Fee    int64     `json:"fee,omitempty"`
+		Txid   string    `json:"txid,omitempty"`
+		At     time.Time `json:"at"`
+	}
+	events := make([]event, 0, len(res.Events))
+	for _, e := range res.Events {
+		events = append(events, event{e.Kind, e.Amount, e.Fee, e.Txid, e.CreatedAt})
+	}
+
+	type payout struct {
+		PayoutId    uint   `json:"payout_id"`
+		Destination string `json:"destination"`
+		Amount      int64  `json:"amount"`
+		Fee         int64  `json:"fee"`
+		Status      string `json:"status"`
+		BatchTxid   string `json:"batch_txid,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}
+	payoutRequests, err := batcher.PayoutsForReserve(address.EncodeAddress(), reserveId)
 	if err != nil {
-		Error.Fatal(err)
+		respondError(writer, err.Error())
+		return
+	}
+	payouts := make([]payout, 0, len(payoutRequests))
+	for _, p := range payoutRequests {
+		payouts = append(payouts, payout{p.ID, p.Destination, p.Amount, p.Fee, p.Status, p.BatchTxid, p.Error})
+	}
+
+	response := struct {
+		ReserveId string   `json:"reserve_id"`
+		Amount    uint64   `json:"amount"`
+		Remaining uint64   `json:"remaining"`
+		Held      uint64   `json:"held"`
+		Fee       int64    `json:"fee"`
+		Spent     bool     `json:"spent"`
+		Events    []event  `json:"events"`
+		Payouts   []payout `json:"payouts"`
+	}{
+		ReserveId: res.Uuid,
+		Amount:    res.Amount,
+		Remaining: res.Remaining,
+		Held:      res.Held,
+		Fee:       res.Fee,
+		Spent:     res.Spent,
+		Events:    events,
+		Payouts:   payouts,
+	}
+
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// BumpFeeHandler replaces a pending spend of a reserve with one paying
+// fee_rate satoshis per byte. Without a txid, the reserve's last spend is
+// bumped.
+func BumpFeeHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+	reserveId := vars["reserve"]
+
+	payload := &struct {
+		Txid    string `json:"txid"`
+		FeeRate int64  `json:"fee_rate"`
+	}{}
+	if err := json.NewDecoder(request.Body).Decode(payload); err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	_, address := acctMgr.GetKeysForAddress(username)
+	res, err := reserve.GetReserve(address.EncodeAddress(), reserveId)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	txid := ""
+	for _, event := range res.Events {
+		if event.Kind != wallet.RESERVE_EVENT_SPENT {
+			continue
+		}
+		if payload.Txid == "" || payload.Txid == event.Txid {
+			txid = event.Txid
+		}
+	}
+	if txid == "" {
+		writer.WriteHeader(http.StatusNotFound)
+		respondError(writer, "Reserve has no such spend")
+		return
+	}
+
+	rememberOwner(username, address.EncodeAddress())
+	newTxid, err := broadcasts.BumpFee(txid, payload.FeeRate, keysForAddress)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := struct {
+		Txid         string `json:"txid"`
+		ReplacedTxid string `json:"replaced_txid"`
+	}{newTxid, txid}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// CancelSpendHandler double-spends a pending spend of a reserve back to a
+// fresh change address of the account. The reserve gets the amount back
+// once the cancellation confirms. Without a txid, the reserve's last spend
+// is cancelled, and without a fee_rate the least a replacement must pay.
+func CancelSpendHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+	reserveId := vars["reserve"]
+
+	payload := &struct {
+		Txid    string `json:"txid"`
+		FeeRate int64  `json:"fee_rate"`
+	}{}
+	if err := json.NewDecoder(request.Body).Decode(payload); err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	_, address := acctMgr.GetKeysForAddress(username)
+	res, err := reserve.GetReserve(address.EncodeAddress(), reserveId)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	txid := ""
+	for _, event := range res.Events {
+		if event.Kind != wallet.RESERVE_EVENT_SPENT {
+			continue
+		}
+		if payload.Txid == "" || payload.Txid == event.Txid {
+			txid = event.Txid
+		}
+	}
+	if txid == "" {
+		writer.WriteHeader(http.StatusNotFound)
+		respondError(writer, "Reserve has no such spend")
+		return
+	}
+
+	rememberOwner(username, address.EncodeAddress())
+	change, err := changes.Fresh(address.EncodeAddress())
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	cancelTxid, err := broadcasts.CancelSpend(txid, change.Address, payload.FeeRate, keysForAddress)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := struct {
+		Txid          string `json:"txid"`
+		CancelledTxid string `json:"cancelled_txid"`
+		ChangeAddress string `json:"change_address"`
+	}{cancelTxid, txid, change.Address}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// AccelerateHandler speeds up a pending transaction paying the account,
+// one of its own spends or a deposit, with a child transaction bringing
+// both to fee_rate satoshis per byte.
+func AccelerateHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+
+	payload := &struct {
+		Txid    string `json:"txid"`
+		FeeRate int64  `json:"fee_rate"`
+	}{}
+	if err := json.NewDecoder(request.Body).Decode(payload); err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	_, address := acctMgr.GetKeysForAddress(username)
+	rememberOwner(username, address.EncodeAddress())
+	txid, err := broadcasts.ChildPaysForParent(
+		request.Context(), payload.Txid, address.EncodeAddress(), payload.FeeRate, keysForAddress,
+	)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := struct {
+		Txid       string `json:"txid"`
+		ParentTxid string `json:"parent_txid"`
+	}{txid, payload.Txid}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// SweepHandler sends everything the account can spend, less what its
+// reserves hold, to a single destination with no change, paying fee_rate
+// satoshis per virtual byte.
+func SweepHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+
+	payload := &struct {
+		DestinationUser string `json:"account"`
+		Address         string `json:"address"`
+		URI             string `json:"uri"`
+		FeeRate         int64  `json:"fee_rate"`
+	}{}
+	if err := json.NewDecoder(request.Body).Decode(payload); err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	outputs, err := spendOutputs(payload.DestinationUser, payload.Address, payload.URI, 0, nil)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	if outputs[0].Amount != 0 {
+		respondError(writer, "A sweep sends everything, the payment URI cannot ask for an amount")
+		return
+	}
+
+	pk, address := acctMgr.GetKeysForAddress(username)
+	rememberOwner(username, address.EncodeAddress())
+	txid, amount, fee, err := txMgr.Sweep(address.EncodeAddress(), pk, outputs[0].Address, payload.FeeRate)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := struct {
+		Txid        string `json:"txid"`
+		Destination string `json:"destination"`
+		Amount      int64  `json:"amount"`
+		Fee         int64  `json:"fee"`
+	}{txid, outputs[0].Address, amount, fee}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// AdjustReserveHandler tops up a reserve (positive Amount) or gives part of
+// it back to the account (negative Amount).
+func AdjustReserveHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+	reserveId := vars["reserve"]
+
+	payload := &struct {
+		Amount int64
+	}{}
+	err := json.NewDecoder(request.Body).Decode(payload)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	_, address := acctMgr.GetKeysForAddress(username)
+	err = reserve.AdjustReserve(address.EncodeAddress(), reserveId, payload.Amount, availableForAddress)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	remaining, err := reserve.GetAmountReservedForReserve(address.EncodeAddress(), reserveId)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
 	}
 
 	response := struct {
 		ReserveId string
-	}{idResponse}
+		Remaining int64
+	}{reserveId, remaining}
+
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// TransferHandler moves balance to another account off-chain, instantly
+// and without paying fees.
+func TransferHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+
+	payload := &struct {
+		DestinationUser string `json:"account"`
+		Amount          int64  `json:"amount"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(payload)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	_, frmAddress := acctMgr.GetKeysForAddress(username)
+	_, toAddress := acctMgr.GetKeysForAddress(payload.DestinationUser)
+
+	// The coins stay on our address until the other account withdraws them
+	rememberOwner(username, frmAddress.EncodeAddress())
+	transferId, err := ledger.TransferAvailable(
+		frmAddress.EncodeAddress(), toAddress.EncodeAddress(), payload.Amount, availableForAddress,
+	)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := struct {
+		TransferId string
+	}{transferId}
 
 	json.NewEncoder(writer).Encode(&response)
 }
@@ -127,39 +711,592 @@ func AddressHandler(writer http.ResponseWriter, request *http.Request) {
 	username := vars["user"]
 	_, address := acctMgr.GetKeysForAddress(username)
 	amountReserved := reserve.GetAmountReservedForAddress(address.EncodeAddress())
-	unspentTransactionBalance, err := usm.GetUTXOBalanceForAddress(address.EncodeAddress())
+	onChain, offChain, err := ledgerBalance(address.EncodeAddress())
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	details, err := usm.GetBalanceDetailsForAddress(address.EncodeAddress())
 	if err != nil {
 		Error.Print(err)
-		unspentTransactionBalance = 0
+		details.Stale = true
+		details.StaleReason = "Balance was not fetched yet"
 	}
+	status := usm.Status()
 
 	response := struct {
 		Address          string `json:"address"`
 		AvailableToSpend int64  `json:"available_to_spend"`
 		Reserved         int64  `json:"reserved"`
+		OnChain          int64  `json:"on_chain"`
+		OffChain         int64  `json:"off_chain"`
+		Confirmed        int64  `json:"confirmed"`
+		Pending          int64  `json:"pending"`
+		Immature         int64  `json:"immature"`
+		// Stale balances are the last known good ones
+		Stale       bool      `json:"stale"`
+		StaleReason string    `json:"stale_reason,omitempty"`
+		UpdatedAt   time.Time `json:"updated_at"`
 	}{
 		Address:          address.EncodeAddress(),
-		AvailableToSpend: unspentTransactionBalance,
+		AvailableToSpend: onChain + offChain,
 		Reserved:         amountReserved,
+		OnChain:          onChain,
+		OffChain:         offChain,
+		Confirmed:        details.Confirmed,
+		Pending:          details.Pending,
+		Immature:         details.Immature,
+		Stale:            details.Stale || status.Stale,
+		StaleReason:      details.StaleReason,
+		UpdatedAt:        details.UpdatedAt,
+	}
+	if response.StaleReason == "" {
+		response.StaleReason = status.Error
+	}
+
+	json.NewEncoder(writer).Encode(&response)
+}
+
+type watchResponse struct {
+	Address             string     `json:"address"`
+	Tier                string     `json:"tier"`
+	Priority            int        `json:"priority"`
+	PollIntervalSeconds int64      `json:"poll_interval_seconds"`
+	Permanent           bool       `json:"permanent"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+}
+
+func newWatchResponse(watch *wallet.WatchedAddress) watchResponse {
+	return watchResponse{
+		Address:             watch.Address,
+		Tier:                watch.Tier,
+		Priority:            watch.Priority,
+		PollIntervalSeconds: int64(watch.Interval() / time.Second),
+		Permanent:           watch.Permanent,
+		ExpiresAt:           watch.ExpiresAt,
+	}
+}
+
+func respondWatch(writer http.ResponseWriter, watch *wallet.WatchedAddress) {
+	response := newWatchResponse(watch)
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// reloadWatchList applies watch list changes to the monitor right away
+// instead of on its next reload.
+func reloadWatchList() {
+	if err := usm.ReloadWatchList(); err != nil {
+		Error.Println(err)
+	}
+}
+
+func WatchListHandler(writer http.ResponseWriter, request *http.Request) {
+	watches, err := watchList.Active(time.Now())
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := []watchResponse{}
+	for _, watch := range watches {
+		response = append(response, newWatchResponse(watch))
+	}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+// WatchAddressHandler starts watching an address, or changes how it is
+// watched. Temporary watches need ttl_seconds.
+func WatchAddressHandler(writer http.ResponseWriter, request *http.Request) {
+	payload := &struct {
+		Address             string `json:"address"`
+		Tier                string `json:"tier"`
+		Priority            int    `json:"priority"`
+		PollIntervalSeconds int64  `json:"poll_interval_seconds"`
+		Permanent           bool   `json:"permanent"`
+		TTLSeconds          int64  `json:"ttl_seconds"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(payload)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	watch, err := watchList.Watch(payload.Address, wallet.WatchOptions{
+		Tier:         payload.Tier,
+		Priority:     payload.Priority,
+		PollInterval: time.Duration(payload.PollIntervalSeconds) * time.Second,
+		Permanent:    payload.Permanent,
+		TTL:          time.Duration(payload.TTLSeconds) * time.Second,
+	})
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	reloadWatchList()
+	respondWatch(writer, watch)
+}
+
+func UnwatchAddressHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if err := watchList.Unwatch(vars["address"]); err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		respondError(writer, err.Error())
+		return
+	}
+	reloadWatchList()
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func WatchPriorityHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	payload := &struct {
+		Priority int `json:"priority"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(payload)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	watch, err := watchList.SetPriority(vars["address"], payload.Priority)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	reloadWatchList()
+	respondWatch(writer, watch)
+}
+
+func WatchIntervalHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	payload := &struct {
+		PollIntervalSeconds int64 `json:"poll_interval_seconds"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(payload)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	watch, err := watchList.SetPollInterval(
+		vars["address"], time.Duration(payload.PollIntervalSeconds)*time.Second,
+	)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+	reloadWatchList()
+	respondWatch(writer, watch)
+}
+
+type webhookResponse struct {
+	Id     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Only returned when the webhook is registered
+	Secret string `json:"secret,omitempty"`
+}
+
+func newWebhookResponse(webhook *wallet.Webhook) webhookResponse {
+	response := webhookResponse{
+		Id:     webhook.Uuid,
+		URL:    webhook.URL,
+		Events: []string{},
+	}
+	if webhook.Kinds != "" {
+		response.Events = strings.Split(webhook.Kinds, ",")
+	}
+	return response
+}
+
+// RegisterWebhookHandler adds a webhook. Deliveries are signed with the
+// returned secret, see wallet.SignPayload.
+func RegisterWebhookHandler(writer http.ResponseWriter, request *http.Request) {
+	payload := &struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(payload)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	webhook, err := webhooks.Register(payload.URL, payload.Secret, payload.Events)
+	if err != nil {
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := newWebhookResponse(webhook)
+	response.Secret = webhook.Secret
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(&response)
+}
+
+func ListWebhooksHandler(writer http.ResponseWriter, request *http.Request) {
+	registered, err := webhooks.List()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := []webhookResponse{}
+	for _, webhook := range registered {
+		response = append(response, newWebhookResponse(webhook))
+	}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+func RemoveWebhookHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if err := webhooks.Remove(vars["webhook"]); err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		respondError(writer, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+type broadcastResponse struct {
+	Txid            string     `json:"txid"`
+	Status          string     `json:"status"`
+	InMempool       bool       `json:"in_mempool"`
+	Confirmations   int        `json:"confirmations"`
+	Fee             int64      `json:"fee"`
+	Broadcasts      int        `json:"broadcasts"`
+	FirstBroadcast  time.Time  `json:"first_broadcast_at"`
+	LastBroadcastAt time.Time  `json:"last_broadcast_at"`
+	LastSeenAt      *time.Time `json:"last_seen_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	Hex             string     `json:"hex"`
+	// Every transaction that replaced this one with a higher fee
+	ReplacedBy []string `json:"replaced_by,omitempty"`
+}
+
+func newBroadcastResponse(broadcast *wallet.BroadcastTransaction) broadcastResponse {
+	return broadcastResponse{
+		Txid:            broadcast.Txid,
+		Status:          broadcast.Status,
+		InMempool:       broadcast.InMempool,
+		Confirmations:   broadcast.Confirmations,
+		Fee:             broadcast.Fee,
+		Broadcasts:      broadcast.Broadcasts,
+		FirstBroadcast:  broadcast.CreatedAt,
+		LastBroadcastAt: broadcast.LastBroadcastAt,
+		LastSeenAt:      broadcast.LastSeenAt,
+		LastError:       broadcast.LastError,
+		Hex:             broadcast.RawHex,
+	}
+}
+
+// ListBroadcastsHandler lists the transactions with the status given in
+// the query, or the ones still waiting for confirmations.
+func ListBroadcastsHandler(writer http.ResponseWriter, request *http.Request) {
+	tracked, err := broadcasts.List(request.URL.Query().Get("status"))
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := []broadcastResponse{}
+	for _, broadcast := range tracked {
+		response = append(response, newBroadcastResponse(broadcast))
+	}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+func GetBroadcastHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	broadcast, err := broadcasts.Get(vars["txid"])
+	if err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		respondError(writer, err.Error())
+		return
+	}
+	response := newBroadcastResponse(broadcast)
+	replacements, err := broadcasts.Replacements(broadcast.Txid)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, err.Error())
+		return
+	}
+	for _, replacement := range replacements {
+		response.ReplacedBy = append(response.ReplacedBy, replacement.Txid)
+	}
+	json.NewEncoder(writer).Encode(&response)
+}
+
+const (
+	// Streams end before the server's WriteTimeout; clients reconnect and
+	// resume from the Last-Event-ID they saw
+	STREAM_MAX_DURATION  = 12 * time.Second
+	STREAM_POLL_INTERVAL = time.Second
+	STREAM_BATCH_SIZE    = 100
+)
+
+// EventStreamHandler streams the events of an account as Server-Sent
+// Events: balance changes, deposits, reserve transitions and transaction
+// confirmations. Clients resume after the cursor passed as the
+// Last-Event-ID header or the cursor query parameter.
+func EventStreamHandler(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, "Streaming is not supported")
+		return
 	}
 
+	vars := mux.Vars(request)
+	username := vars["user"]
+
+	cursorStr := request.Header.Get("Last-Event-ID")
+	if cursorStr == "" {
+		cursorStr = request.URL.Query().Get("cursor")
+	}
+	var cursor uint64
+	if cursorStr != "" {
+		var err error
+		cursor, err = strconv.ParseUint(cursorStr, 10, 64)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			respondError(writer, "Cursor is invalid")
+			return
+		}
+	}
+
+	_, address := acctMgr.GetKeysForAddress(username)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(writer, "retry: %d\n\n", STREAM_POLL_INTERVAL/time.Millisecond)
+	flusher.Flush()
+
+	deadline := time.After(STREAM_MAX_DURATION)
+	poll := time.NewTicker(STREAM_POLL_INTERVAL)
+	defer poll.Stop()
+	for {
+		changed := events.Changed()
+		batch, err := events.Since(address.EncodeAddress(), uint(cursor), STREAM_BATCH_SIZE)
+		if err != nil {
+			Error.Println(err)
+			return
+		}
+		for _, event := range batch {
+			data, err := json.Marshal(event.Payload())
+			if err != nil {
+				Error.Println(err)
+				return
+			}
+			fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Kind, data)
+			cursor = uint64(event.ID)
+		}
+		if len(batch) > 0 {
+			flusher.Flush()
+		}
+		if len(batch) == STREAM_BATCH_SIZE {
+			continue
+		}
+
+		select {
+		case <-request.Context().Done():
+			return
+		case <-deadline:
+			return
+		case <-changed:
+		case <-poll.C:
+		}
+	}
+}
+
+// TransactionsHandler lists the deposits and payments of an account, newest
+// first. Pass the next_cursor of a page as cursor to get the following one.
+func TransactionsHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	username := vars["user"]
+	query := request.URL.Query()
+
+	filter := wallet.HistoryFilter{
+		Direction: query.Get("direction"),
+		Reserve:   query.Get("reserve"),
+	}
+	if filter.Direction != "" &&
+		filter.Direction != wallet.HISTORY_INCOMING && filter.Direction != wallet.HISTORY_OUTGOING {
+		writer.WriteHeader(http.StatusBadRequest)
+		respondError(writer, "Direction is invalid")
+		return
+	}
+	integers := map[string]*int{
+		"min_confirmations": &filter.MinConfirmations,
+		"limit":             &filter.Limit,
+	}
+	for name, value := range integers {
+		if query.Get(name) == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(query.Get(name))
+		if err != nil || parsed < 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			respondError(writer, name+" is invalid")
+			return
+		}
+		*value = parsed
+	}
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		cursor, err := strconv.ParseUint(cursorStr, 10, 64)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			respondError(writer, "Cursor is invalid")
+			return
+		}
+		filter.Cursor = uint(cursor)
+	}
+	times := map[string]*time.Time{
+		"since": &filter.Since,
+		"until": &filter.Until,
+	}
+	for name, value := range times {
+		if query.Get(name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, query.Get(name))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			respondError(writer, name+" must be an RFC 3339 time")
+			return
+		}
+		*value = parsed
+	}
+
+	_, address := acctMgr.GetKeysForAddress(username)
+	records, next, err := history.ForAddress(address.EncodeAddress(), filter)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, err.Error())
+		return
+	}
+
+	response := struct {
+		Transactions []wallet.TransactionPayload `json:"transactions"`
+		NextCursor   uint                        `json:"next_cursor,omitempty"`
+	}{
+		Transactions: []wallet.TransactionPayload{},
+		NextCursor:   next,
+	}
+	for _, record := range records {
+		response.Transactions = append(response.Transactions, record.Payload())
+	}
 	json.NewEncoder(writer).Encode(&response)
 }
 
+// TrialBalanceHandler reports whether the journal balances and matches
+// what the monitor sees on-chain.
+func TrialBalanceHandler(writer http.ResponseWriter, request *http.Request) {
+	trialBalance, err := journal.TrialBalance(usm)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		respondError(writer, err.Error())
+		return
+	}
+	json.NewEncoder(writer).Encode(trialBalance)
+}
+
 func main() {
 	acctMgr = wallet.NewAccountManager(DB, Client)
 	reserve = wallet.NewReserverService(DB)
+	idempotency = wallet.NewIdempotencyService(DB)
 	usm = wallet.NewUnspentTransactionMonitor(Client)
+	usm.SetCache(wallet.NewUTXOCache(DB))
+	watchList = wallet.NewWatchList(DB)
+	usm.SetWatchList(watchList)
+	if err := usm.LoadCache(); err != nil {
+		Error.Println(err)
+	}
 	txMgr = wallet.NewTransactionManager(
 		usm, reserve,
 	)
+	ledger = wallet.NewLedger(DB)
+	txMgr.SetLedger(ledger, keysForAddress)
+	changes = wallet.NewChangeAddresses(DB, keysForAddress)
+	changes.SetWatchList(watchList)
+	txMgr.SetChangeAddresses(changes)
 
-	go usm.Run()
+	journal = wallet.NewJournal(DB)
+	reserve.SetJournal(journal)
+	ledger.SetJournal(journal)
+	txMgr.SetJournal(journal)
+
+	bus := usm.EventBus()
+	bus.SubscribeAll(func(ctx context.Context, event wallet.Event) {
+		Info.Printf("%s: %+v\n", event.Name(), event)
+	})
+	journal.Subscribe(bus)
+	txMgr.SetEventBus(bus)
+	reserve.SetEventBus(bus)
+
+	events = wallet.NewEventRecorder(DB)
+	events.SetJournal(journal)
+	events.SetMonitor(usm)
+	reserve.SetEventRecorder(events)
+	events.Subscribe(bus)
+	history = wallet.NewTransactionHistory(DB)
+	history.Subscribe(bus)
+	broadcasts = wallet.NewBroadcastTracker(DB, txMgr, wallet.DefaultBroadcastPolicy())
+	broadcasts.Subscribe(bus)
+	webhooks = wallet.NewWebhookService(DB)
+
+	batcher = wallet.NewPayoutBatcher(
+		DB, txMgr, keysForAddress, wallet.DefaultBatchPolicy(),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := usm.Start(ctx); err != nil {
+		Error.Fatal(err)
+	}
+	batcherDone := make(chan struct{})
+	go func() {
+		defer close(batcherDone)
+		batcher.Run(ctx)
+	}()
+	webhooksDone := make(chan struct{})
+	go func() {
+		defer close(webhooksDone)
+		webhooks.Run(ctx)
+	}()
+	broadcastsDone := make(chan struct{})
+	go func() {
+		defer close(broadcastsDone)
+		broadcasts.Run(ctx)
+	}()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/accounts/{user}/address", AddressHandler)
-	r.HandleFunc("/accounts/{user}/reserve", MakeReserveHandler).Methods("POST")
-	r.HandleFunc("/accounts/{user}/reserve/{reserve}/spend", SpendReserve).Methods("POST")
+	r.HandleFunc("/accounts/{user}/events", EventStreamHandler).Methods("GET")
+	r.HandleFunc("/accounts/{user}/transactions", TransactionsHandler).Methods("GET")
+	r.HandleFunc("/accounts/{user}/accelerate", Idempotent(AccelerateHandler)).Methods("POST")
+	r.HandleFunc("/accounts/{user}/sweep", Idempotent(SweepHandler)).Methods("POST")
+	r.HandleFunc("/journal/trial-balance", TrialBalanceHandler).Methods("GET")
+	r.HandleFunc("/broadcasts", ListBroadcastsHandler).Methods("GET")
+	r.HandleFunc("/broadcasts/{txid}", GetBroadcastHandler).Methods("GET")
+	r.HandleFunc("/webhooks", ListWebhooksHandler).Methods("GET")
+	r.HandleFunc("/webhooks", RegisterWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/{webhook}", RemoveWebhookHandler).Methods("DELETE")
+	r.HandleFunc("/watchlist", WatchListHandler).Methods("GET")
+	r.HandleFunc("/watchlist", WatchAddressHandler).Methods("POST")
+	r.HandleFunc("/watchlist/{address}", UnwatchAddressHandler).Methods("DELETE")
+	r.HandleFunc("/watchlist/{address}/priority", WatchPriorityHandler).Methods("POST")
+	r.HandleFunc("/watchlist/{address}/interval", WatchIntervalHandler).Methods("POST")
+	r.HandleFunc("/accounts/{user}/reserve", Idempotent(MakeReserveHandler)).Methods("POST")
+	r.HandleFunc("/accounts/{user}/transfer", Idempotent(TransferHandler)).Methods("POST")
+	r.HandleFunc("/accounts/{user}/reserve/{reserve}", GetReserveHandler).Methods("GET")
+	r.HandleFunc("/accounts/{user}/reserve/{reserve}/adjust", AdjustReserveHandler).Methods("POST")
+	r.HandleFunc("/accounts/{user}/reserve/{reserve}/spend", Idempotent(SpendReserve)).Methods("POST")
+	r.HandleFunc("/accounts/{user}/reserve/{reserve}/bump", Idempotent(BumpFeeHandler)).Methods("POST")
+	r.HandleFunc("/accounts/{user}/reserve/{reserve}/cancel", Idempotent(CancelSpendHandler)).Methods("POST")
 
 	srv := &http.Server{
 		Handler: r,
@@ -169,5 +1306,31 @@ func main() {
 		ReadTimeout:  15 * time.Second,
 	}
 
-	Error.Fatal(srv.ListenAndServe())
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+		Info.Println("Shutting down")
+
+		shutdownCtx, done := context.WithTimeout(context.Background(), 15*time.Second)
+		defer done()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			Error.Println(err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		Error.Fatal(err)
+	}
+
+	// Wait for requests in flight before stopping the background work
+	<-drained
+	usm.Stop()
+	cancel()
+	<-batcherDone
+	<-webhooksDone
+	<-broadcastsDone
+	Info.Println("Stopped")
 }
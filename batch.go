@@ -0,0 +1,503 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jinzhu/gorm"
+	"sync"
+	"time"
+)
+
+const (
+	PAYOUT_PENDING   = "pending"
+	PAYOUT_BROADCAST = "broadcast"
+	PAYOUT_FAILED    = "failed"
+	// Broadcast, but its reserve still holds the amount paid. Every flush
+	// tries to charge the reserve again.
+	PAYOUT_UNRECONCILED = "unreconciled"
+
+	DEFAULT_BATCH_MAX_REQUESTS   = 50
+	DEFAULT_BATCH_FLUSH_INTERVAL = time.Minute * 10
+)
+
+// KeyLookup resolves the private key of one of the wallet's own addresses.
+type KeyLookup func(address string) (*btcec.PrivateKey, error)
+
+// PayoutRequest is a spend out of a reserve waiting to be paid as one
+// output of a batch transaction.
+type PayoutRequest struct {
+	gorm.Model
+	Address     string
+	ReserveUuid string
+	Destination string
+	Amount      int64
+	FeePolicy   FeePolicy
+	// Share of the batch fee the payout paid
+	Fee       int64
+	Status    string
+	BatchTxid string
+	Error     string
+}
+
+type BatchPolicy struct {
+	// Flush as soon as this many payouts are pending
+	MaxRequests int
+	// Flush whatever is pending at least this often
+	FlushInterval time.Duration
+	// Allow a single transaction to spend from several accounts
+	CrossAccount bool
+}
+
+func DefaultBatchPolicy() BatchPolicy {
+	return BatchPolicy{
+		MaxRequests:   DEFAULT_BATCH_MAX_REQUESTS,
+		FlushInterval: DEFAULT_BATCH_FLUSH_INTERVAL,
+		CrossAccount:  true,
+	}
+}
+
+type PayoutBatcher struct {
+	sync.Mutex
+	db          *gorm.DB
+	txMgr       *TransactionManager
+	keys        KeyLookup
+	policy      BatchPolicy
+	flushTicker *time.Ticker
+	wake        chan struct{}
+}
+
+func NewPayoutBatcher(
+	localDb *gorm.DB,
+	txMgr *TransactionManager,
+	keys KeyLookup,
+	policy BatchPolicy,
+) *PayoutBatcher {
+	return &PayoutBatcher{
+		db:          localDb,
+		txMgr:       txMgr,
+		keys:        keys,
+		policy:      policy,
+		flushTicker: time.NewTicker(policy.FlushInterval),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Enqueue holds amount of a reserve for a payout to destination and returns
+// the id of the payout. An amount of 0 pays whatever is left in the reserve.
+// With FEE_SENDER_PAYS, the share of the batch fee is paid on top of amount
+// when the batch is paid.
+func (pb *PayoutBatcher) Enqueue(address, reserve, destination string, amount int64, policy FeePolicy) (uint, error) {
+	ids, err := pb.EnqueueOutputs(address, reserve, []SpendOutput{
+		{Address: destination, Amount: amount},
+	}, policy)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// EnqueueOutputs is Enqueue for several payouts out of the same reserve,
+// which are either all queued or none is. Only a single output may have an
+// amount of 0.
+func (pb *PayoutBatcher) EnqueueOutputs(address, reserve string, outputs []SpendOutput, policy FeePolicy) ([]uint, error) {
+	if len(outputs) == 0 {
+		return nil, errors.New("Nothing to pay")
+	}
+	amounts := make([]int64, len(outputs))
+	var total int64
+	for idx, output := range outputs {
+		if _, err := DecodeDestination(output.Address); err != nil {
+			return nil, err
+		}
+		amounts[idx] = output.Amount
+		if len(outputs) > 1 && output.Amount <= 0 {
+			return nil, errors.New("Amount is invalid")
+		}
+		total += output.Amount
+	}
+	amountToSpend, err := pb.txMgr.amountToSpendFromReserve(address, reserve, total)
+	if err != nil {
+		return nil, err
+	}
+	if amountToSpend <= 0 {
+		return nil, errors.New("Amount is invalid")
+	}
+	if len(outputs) == 1 {
+		amounts[0] = amountToSpend
+	}
+
+	if err := pb.txMgr.reserveInstance.HoldReserve(address, reserve, amountToSpend); err != nil {
+		return nil, err
+	}
+
+	ids, err := pb.createPayouts(address, reserve, outputs, amounts, policy)
+	if err != nil {
+		pb.txMgr.reserveInstance.ReleaseHold(address, reserve, amountToSpend)
+		return nil, err
+	}
+
+	var pending int
+	pb.db.Model(&PayoutRequest{}).Where("status = ?", PAYOUT_PENDING).Count(&pending)
+	if pending >= pb.policy.MaxRequests {
+		select {
+		case pb.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ids, nil
+}
+
+// createPayouts stores a pending payout per output in one transaction.
+func (pb *PayoutBatcher) createPayouts(
+	address, reserve string,
+	outputs []SpendOutput,
+	amounts []int64,
+	policy FeePolicy,
+) ([]uint, error) {
+	tx := pb.db.Begin()
+	ids := make([]uint, 0, len(outputs))
+	for idx, output := range outputs {
+		payout := PayoutRequest{
+			Address:     address,
+			ReserveUuid: reserve,
+			Destination: output.Address,
+			Amount:      amounts[idx],
+			FeePolicy:   policy,
+			Status:      PAYOUT_PENDING,
+		}
+		if err := tx.Create(&payout).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		ids = append(ids, payout.ID)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// PayoutsForReserve lists every payout requested from a reserve.
+func (pb *PayoutBatcher) PayoutsForReserve(address, reserve string) ([]*PayoutRequest, error) {
+	var payouts []*PayoutRequest
+	err := pb.db.Where(
+		"address = ? AND reserve_uuid = ?", address, reserve,
+	).Order("id").Find(&payouts).Error
+	return payouts, err
+}
+
+// groupPayouts splits pending payouts into the transactions they will be
+// paid with, following the batch policy.
+func (pb *PayoutBatcher) groupPayouts(payouts []*PayoutRequest) [][]*PayoutRequest {
+	var groups [][]*PayoutRequest
+	byAddress := make(map[string]int)
+	for _, payout := range payouts {
+		key := payout.Address
+		if pb.policy.CrossAccount {
+			key = ""
+		}
+
+		idx, ok := byAddress[key]
+		if !ok || len(groups[idx]) >= pb.policy.MaxRequests {
+			groups = append(groups, nil)
+			idx = len(groups) - 1
+			byAddress[key] = idx
+		}
+		groups[idx] = append(groups[idx], payout)
+	}
+	return groups
+}
+
+// Flush pays every pending payout, one transaction per batch.
+func (pb *PayoutBatcher) Flush() error {
+	pb.Lock()
+	defer pb.Unlock()
+
+	var payouts []*PayoutRequest
+	err := pb.db.Where("status = ?", PAYOUT_PENDING).Order("id").Find(&payouts).Error
+	if err != nil {
+		return err
+	}
+
+	pb.reconcile()
+
+	// The monitor does not see what earlier batches spent yet
+	spent := make(map[string]bool)
+	for _, group := range pb.groupPayouts(payouts) {
+		pb.payGroup(group, spent)
+	}
+	return nil
+}
+
+// payGroup pays a group of payouts. Should the batch fail, the payouts of
+// each account are paid in a batch of their own, so that an account which
+// cannot pay does not fail the payouts of the others.
+func (pb *PayoutBatcher) payGroup(payouts []*PayoutRequest, spent map[string]bool) {
+	err := pb.payBatch(payouts, spent)
+	if err == nil {
+		return
+	}
+
+	var accounts []string
+	byAccount := make(map[string][]*PayoutRequest)
+	for _, payout := range payouts {
+		if _, ok := byAccount[payout.Address]; !ok {
+			accounts = append(accounts, payout.Address)
+		}
+		byAccount[payout.Address] = append(byAccount[payout.Address], payout)
+	}
+	if len(accounts) == 1 {
+		pb.failPayouts(payouts, err)
+		return
+	}
+	Error.Printf("Batch of %d payouts failed, paying each account on its own: %s\n", len(payouts), err)
+	for _, account := range accounts {
+		if err := pb.payBatch(byAccount[account], spent); err != nil {
+			pb.failPayouts(byAccount[account], err)
+		}
+	}
+}
+
+// payBatch pays payouts in one transaction, without spending the outpoints
+// in spent, and adds the outpoints it spends to it. It returns an error
+// when the transaction certainly did not reach the network, leaving the
+// payouts pending.
+func (pb *PayoutBatcher) payBatch(payouts []*PayoutRequest, spent map[string]bool) error {
+	pb.txMgr.Lock()
+	defer pb.txMgr.Unlock()
+
+	spend, err := pb.txMgr.buildBatchTransaction(payouts, pb.keys, spent)
+	if err != nil {
+		return err
+	}
+	tx := wire.NewMsgTx()
+	if err := tx.Deserialize(bytes.NewReader(spend.txBytes)); err != nil {
+		return err
+	}
+	txid, err := pb.txMgr.broadcastTransaction(spend.txBytes)
+	if _, rejected := err.(*BroadcastRejected); rejected {
+		return err
+	}
+	if err != nil {
+		// The batch may have reached the network anyway, so it is booked
+		// as broadcast, keeping its holds, and the broadcast tracker
+		// pushes it again if it did not
+		txid = tx.TxHash().String()
+		Error.Printf("Broadcasting batch %s failed, leaving it to be rebroadcast: %s\n", txid, err)
+	}
+	for _, txin := range tx.TxIn {
+		spent[txin.PreviousOutPoint.String()] = true
+	}
+
+	Info.Printf("Paid %d payouts in batch %s\n", len(payouts), txid)
+	var spentFrom []string
+	payments := make([]Payment, len(payouts))
+	fees := make([]int64, len(payouts))
+	shares := feeShares(len(payouts))
+	for idx, payout := range payouts {
+		spentFrom = append(spentFrom, payout.Address)
+		amount := payout.Amount
+		if payout.FeePolicy == FEE_SENDER_PAYS {
+			amount += shares[idx]
+		}
+		payments[idx] = Payment{
+			payout.Address, payout.ReserveUuid, payout.Destination, amount, shares[idx],
+		}
+		// Change of the address left to the fee goes with its first payout
+		fees[idx] = shares[idx] + spend.dust[payout.Address]
+		delete(spend.dust, payout.Address)
+	}
+	pb.txMgr.trackBroadcast(txid, spend.txBytes, spend.fee, payments, spentFrom...)
+	pb.txMgr.trackChange(txid, spend.txBytes, spend.fromFunds, spentFrom...)
+	for idx, payout := range payouts {
+		updates := map[string]interface{}{
+			"status":     PAYOUT_BROADCAST,
+			"batch_txid": txid,
+			"fee":        fees[idx],
+		}
+		err := pb.txMgr.reserveInstance.SpendHeldReserve(
+			payout.Address, payout.ReserveUuid, payout.Amount, fees[idx], txid,
+		)
+		if err != nil {
+			Error.Printf("Payout %d was paid in %s but its reserve was not charged: %s\n", payout.ID, txid, err)
+			updates["status"] = PAYOUT_UNRECONCILED
+			updates["error"] = err.Error()
+		}
+		if err := pb.db.Model(payout).Updates(updates).Error; err != nil {
+			Error.Println(err)
+		}
+	}
+	return nil
+}
+
+// reconcile charges the reserves of payouts that were paid without it.
+func (pb *PayoutBatcher) reconcile() {
+	var payouts []*PayoutRequest
+	err := pb.db.Where("status = ?", PAYOUT_UNRECONCILED).Order("id").Find(&payouts).Error
+	if err != nil {
+		Error.Println(err)
+		return
+	}
+	for _, payout := range payouts {
+		err := pb.txMgr.reserveInstance.SpendHeldReserve(
+			payout.Address, payout.ReserveUuid, payout.Amount, payout.Fee, payout.BatchTxid,
+		)
+		if err != nil {
+			Error.Printf("Payout %d is still not reconciled: %s\n", payout.ID, err)
+			continue
+		}
+		err = pb.db.Model(payout).Updates(map[string]interface{}{
+			"status": PAYOUT_BROADCAST,
+			"error":  "",
+		}).Error
+		if err != nil {
+			Error.Println(err)
+		}
+	}
+}
+
+func (pb *PayoutBatcher) failPayouts(payouts []*PayoutRequest, reason error) {
+	Error.Printf("Batch of %d payouts failed: %s\n", len(payouts), reason)
+	for _, payout := range payouts {
+		err := pb.txMgr.reserveInstance.ReleaseHold(
+			payout.Address, payout.ReserveUuid, payout.Amount,
+		)
+		if err != nil {
+			Error.Println(err)
+		}
+		pb.db.Model(payout).Updates(map[string]interface{}{
+			"status": PAYOUT_FAILED,
+			"error":  reason.Error(),
+		})
+	}
+}
+
+// Run flushes the queue on every tick or wake up until ctx is done.
+func (pb *PayoutBatcher) Run(ctx context.Context) {
+	defer pb.flushTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pb.flushTicker.C:
+		case <-pb.wake:
+		}
+		if err := pb.Flush(); err != nil {
+			Error.Println(err)
+		}
+	}
+}
+
+// MakeBatchTransaction builds and signs a single transaction paying every
+// payout. Each paying address funds its own payouts and gets its own change
+// back; the fee is shared equally between the payouts.
+func (tm *TransactionManager) MakeBatchTransaction(
+	payouts []*PayoutRequest,
+	keys KeyLookup,
+) ([]byte, error) {
+	spend, err := tm.buildBatchTransaction(payouts, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	return spend.txBytes, nil
+}
+
+// buildBatchTransaction is MakeBatchTransaction, also returning what the
+// batch costs besides its payments. Payouts whose sender pays the fee get
+// their share selected on top of their amount, out of the part of the
+// balance no reserve holds. The outpoints in exclude are not spent.
+func (tm *TransactionManager) buildBatchTransaction(
+	payouts []*PayoutRequest,
+	keys KeyLookup,
+	exclude map[string]bool,
+) (*builtSpend, error) {
+	if len(payouts) == 0 {
+		return nil, errors.New("Nothing to pay")
+	}
+
+	var addresses []string
+	totals := make(map[string]int64)
+	fromFunds := make(map[string]int64)
+	shares := feeShares(len(payouts))
+	deducted := make([]int64, len(payouts))
+	for idx, payout := range payouts {
+		if _, ok := totals[payout.Address]; !ok {
+			addresses = append(addresses, payout.Address)
+		}
+		totals[payout.Address] += payout.Amount
+		if payout.FeePolicy == FEE_SENDER_PAYS {
+			totals[payout.Address] += shares[idx]
+			fromFunds[payout.Address] += shares[idx]
+		} else {
+			deducted[idx] = shares[idx]
+		}
+	}
+	for address, fee := range fromFunds {
+		if tm.freeFunds(address) < fee {
+			return nil, errors.New(fmt.Sprintf("Insufficient funds in %s to pay the fee", address))
+		}
+	}
+
+	tx := wire.NewMsgTx()
+	dust := make(map[string]int64)
+	var scripts [][]byte
+	var inputKeys []*btcec.PrivateKey
+	for _, address := range addresses {
+		pk, err := keys(address)
+		if err != nil {
+			return nil, err
+		}
+
+		txIns, addressScripts, totalSpent := tm.unspentTransactionMonitorInstance.getTXinsExcluding(
+			address, totals[address], exclude,
+		)
+		if totalSpent < totals[address] {
+			return nil, errors.New(fmt.Sprintf("Insufficient funds in %s", address))
+		}
+		for idx, txin := range txIns {
+			tx.AddTxIn(txin)
+			scripts = append(scripts, addressScripts[idx])
+			inputKeys = append(inputKeys, pk)
+		}
+
+		remainder := totalSpent - totals[address]
+		if remainder > 0 {
+			returnScript, err := tm.changeScriptFor(address, remainder, dust)
+			if err != nil {
+				return nil, err
+			}
+			if returnScript != nil {
+				tx.AddTxOut(wire.NewTxOut(remainder, returnScript))
+			}
+		}
+	}
+
+	outputs := make([]SpendOutput, len(payouts))
+	for idx, payout := range payouts {
+		outputs[idx] = SpendOutput{Address: payout.Destination, Amount: payout.Amount}
+	}
+	if err := tm.addPaymentOutputs(tx, outputs, deducted); err != nil {
+		return nil, err
+	}
+
+	if err := tm.signTransaction(tx, scripts, inputKeys); err != nil {
+		return nil, err
+	}
+	txBytes, err := serializeTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	for address, amount := range dust {
+		fromFunds[address] += amount
+	}
+	return &builtSpend{
+		txBytes:   txBytes,
+		fee:       BTC_FEE_IN_SATOSHIS + totalDust(dust),
+		fromFunds: fromFunds,
+		dust:      dust,
+	}, nil
+}
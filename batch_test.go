@@ -0,0 +1,193 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGroupPayouts(t *testing.T) {
+	pb := NewPayoutBatcher(testDB, nil, nil, BatchPolicy{
+		MaxRequests:   2,
+		FlushInterval: DEFAULT_BATCH_FLUSH_INTERVAL,
+		CrossAccount:  false,
+	})
+	payouts := []*PayoutRequest{
+		{Address: "a"}, {Address: "b"}, {Address: "a"}, {Address: "a"},
+	}
+
+	groups := pb.groupPayouts(payouts)
+	if len(groups) != 3 || len(groups[0]) != 2 || len(groups[1]) != 1 || len(groups[2]) != 1 {
+		t.Log(groups)
+		t.Fail()
+	}
+
+	pb.policy.CrossAccount = true
+	groups = pb.groupPayouts(payouts)
+	if len(groups) != 2 || len(groups[0]) != 2 || len(groups[1]) != 2 {
+		t.Log(groups)
+		t.Fail()
+	}
+}
+
+func TestBatchPayouts(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+
+	frmPK, _ := btcec.NewPrivateKey(btcec.S256())
+	frmAddress, _ := btcutil.NewAddressPubKey(frmPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	toPK, _ := btcec.NewPrivateKey(btcec.S256())
+	toAddress, _ := btcutil.NewAddressPubKey(toPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+
+	p2pkhFrmAddress, _ := txmgr.makePayToPubkeyHashScript(frmAddress.EncodeAddress())
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		frmAddress.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(p2pkhFrmAddress),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		return frmPK, nil
+	}
+	pb := NewPayoutBatcher(testDB, txmgr, keys, DefaultBatchPolicy())
+
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(frmAddress.EncodeAddress(), 50000000)
+	if _, err := pb.Enqueue(frmAddress.EncodeAddress(), reserve, toAddress.EncodeAddress(), 30000000, FEE_RECIPIENT_PAYS); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pb.Enqueue(frmAddress.EncodeAddress(), reserve, toAddress.EncodeAddress(), 30000000, FEE_RECIPIENT_PAYS); err == nil {
+		t.Fail()
+	}
+	if _, err := pb.Enqueue(frmAddress.EncodeAddress(), reserve, toAddress.EncodeAddress(), 0, FEE_RECIPIENT_PAYS); err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err := pb.PayoutsForReserve(frmAddress.EncodeAddress(), reserve)
+	if err != nil || len(payouts) != 2 || payouts[1].Amount != 20000000 {
+		t.Fail()
+	}
+	if left, _ := txmgr.reserveInstance.GetAmountReservedForReserve(frmAddress.EncodeAddress(), reserve); left != 0 {
+		t.Fail()
+	}
+
+	txBytes, err := txmgr.MakeBatchTransaction(payouts, keys)
+	if err != nil || len(txBytes) == 0 {
+		t.Fail()
+	}
+
+	// Coins an earlier batch of the same flush spent are not picked again
+	spent := map[string]bool{"aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9:0": true}
+	if _, err := txmgr.buildBatchTransaction(payouts, keys, spent); err == nil {
+		t.Fail()
+	}
+}
+
+func TestEnqueueOutputsIsAllOrNothing(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	pb := NewPayoutBatcher(testDB, txmgr, nil, DefaultBatchPolicy())
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress("enqueueAddress", 50000000)
+
+	// The invalid second output keeps the first one from being queued
+	_, err := pb.EnqueueOutputs("enqueueAddress", reserve, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 10000000},
+		{Address: "notAnAddress", Amount: 10000000},
+	}, FEE_RECIPIENT_PAYS)
+	if err == nil {
+		t.Fail()
+	}
+	payouts, _ := pb.PayoutsForReserve("enqueueAddress", reserve)
+	left, _ := txmgr.reserveInstance.GetAmountReservedForReserve("enqueueAddress", reserve)
+	if len(payouts) != 0 || left != 50000000 {
+		t.Fail()
+	}
+
+	ids, err := pb.EnqueueOutputs("enqueueAddress", reserve, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 10000000},
+		{Address: "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy", Amount: 20000000},
+	}, FEE_RECIPIENT_PAYS)
+	if err != nil || len(ids) != 2 {
+		t.FailNow()
+	}
+	left, _ = txmgr.reserveInstance.GetAmountReservedForReserve("enqueueAddress", reserve)
+	if left != 20000000 {
+		t.Fail()
+	}
+}
+
+func TestFailingAccountDoesNotFailTheBatch(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	txmgr.netClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"status": "success", "data": "isolatedBatch"}`)),
+		}, nil
+	})
+
+	paidPK, _ := btcec.NewPrivateKey(btcec.S256())
+	paidAddress, _ := btcutil.NewAddressPubKey(paidPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	brokePK, _ := btcec.NewPrivateKey(btcec.S256())
+	brokeAddress, _ := btcutil.NewAddressPubKey(brokePK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	p2pkhPaidAddress, _ := txmgr.makePayToPubkeyHashScript(paidAddress.EncodeAddress())
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		paidAddress.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "ab631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(p2pkhPaidAddress),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		if address == brokeAddress.EncodeAddress() {
+			return brokePK, nil
+		}
+		return paidPK, nil
+	}
+	pb := NewPayoutBatcher(testDB, txmgr, keys, DefaultBatchPolicy())
+
+	// The reserve of the broke account is not backed by any coins
+	paidReserve, _ := txmgr.reserveInstance.AddReserveForAddress(paidAddress.EncodeAddress(), 50000000)
+	brokeReserve, _ := txmgr.reserveInstance.AddReserveForAddress(brokeAddress.EncodeAddress(), 50000000)
+	paidId, _ := pb.Enqueue(paidAddress.EncodeAddress(), paidReserve, "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 30000000, FEE_RECIPIENT_PAYS)
+	brokeId, _ := pb.Enqueue(brokeAddress.EncodeAddress(), brokeReserve, "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 30000000, FEE_RECIPIENT_PAYS)
+	if err := pb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var paid, broke PayoutRequest
+	testDB.First(&paid, paidId)
+	testDB.First(&broke, brokeId)
+	if paid.Status != PAYOUT_BROADCAST || paid.BatchTxid != "isolatedBatch" {
+		t.Fail()
+	}
+	if broke.Status != PAYOUT_FAILED {
+		t.Fail()
+	}
+}
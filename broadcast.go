@@ -0,0 +1,255 @@
+package wallet
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	// Broadcast, waiting for enough confirmations
+	BROADCAST_PENDING = "pending"
+	// Unconfirmed for longer than the policy allows
+	BROADCAST_STUCK     = "stuck"
+	BROADCAST_CONFIRMED = "confirmed"
+	// Dropped by a reorg and rolled back, never to be broadcast again
+	BROADCAST_DROPPED = "dropped"
+
+	DEFAULT_BROADCAST_CHECK_INTERVAL = time.Minute
+	DEFAULT_REBROADCAST_INTERVAL     = time.Minute * 10
+	DEFAULT_STUCK_AFTER              = time.Hour * 6
+	DEFAULT_BROADCAST_CONFIRMATIONS  = 6
+)
+
+// BroadcastTransaction is a transaction we broadcast, watched until it is
+// confirmed.
+type BroadcastTransaction struct {
+	gorm.Model
+	Txid          string `gorm:"unique_index"`
+	RawHex        string `gorm:"type:text"`
+	Fee           int64
+	Status        string `gorm:"index"`
+	InMempool     bool
+	Confirmations int
+	// How many times it was pushed to the network, the first one included
+	Broadcasts      int
+	LastBroadcastAt time.Time
+	LastSeenAt      *time.Time
+	LastError       string
+}
+
+func (bt *BroadcastTransaction) Raw() ([]byte, error) {
+	return hex.DecodeString(bt.RawHex)
+}
+
+type BroadcastPolicy struct {
+	// How often the backend is asked about pending transactions
+	CheckInterval time.Duration
+	// Push a transaction the backend does not know about at most this often
+	RebroadcastInterval time.Duration
+	// Flag transactions still unconfirmed this long after the first broadcast
+	StuckAfter time.Duration
+	// Stop watching a transaction once it has this many confirmations
+	Confirmations int
+}
+
+func DefaultBroadcastPolicy() BroadcastPolicy {
+	return BroadcastPolicy{
+		CheckInterval:       DEFAULT_BROADCAST_CHECK_INTERVAL,
+		RebroadcastInterval: DEFAULT_REBROADCAST_INTERVAL,
+		StuckAfter:          DEFAULT_STUCK_AFTER,
+		Confirmations:       DEFAULT_BROADCAST_CONFIRMATIONS,
+	}
+}
+
+// BroadcastTracker stores the transactions we broadcast, rebroadcasts the
+// ones that drop out of the mempools and flags the ones that get stuck.
+type BroadcastTracker struct {
+	db     *gorm.DB
+	txMgr  *TransactionManager
+	policy BroadcastPolicy
+	get    httpGetter
+	push   func(txBytes []byte) (string, error)
+	bus    *EventBus
+}
+
+func NewBroadcastTracker(localDb *gorm.DB, txMgr *TransactionManager, policy BroadcastPolicy) *BroadcastTracker {
+	return &BroadcastTracker{
+		db:     localDb,
+		txMgr:  txMgr,
+		policy: policy,
+		get:    txMgr.get,
+		push:   txMgr.broadcastTransaction,
+	}
+}
+
+// Subscribe makes the tracker store the transactions broadcast on bus,
+// complete cancellations as they confirm, and publish TxStuck,
+// SpendCancelling and SpendCancelled events on it.
+func (bt *BroadcastTracker) Subscribe(bus *EventBus) {
+	bt.bus = bus
+	bus.Subscribe(TxBroadcast{}, func(ctx context.Context, event Event) {
+		broadcast := event.(TxBroadcast)
+		if err := bt.Track(broadcast.Txid, broadcast.Raw, broadcast.Fee, time.Now()); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(TxDropped{}, func(ctx context.Context, event Event) {
+		err := bt.db.Model(&BroadcastTransaction{}).Where(
+			"txid = ?", event.(TxDropped).Txid,
+		).Update("status", BROADCAST_DROPPED).Error
+		if err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(TxConfirmed{}, func(ctx context.Context, event Event) {
+		if err := bt.confirmCancellation(ctx, event.(TxConfirmed).Txid); err != nil {
+			Error.Println(err)
+		}
+	})
+}
+
+// Track starts watching a transaction broadcast at now.
+func (bt *BroadcastTracker) Track(txid string, txBytes []byte, fee int64, now time.Time) error {
+	var count int
+	bt.db.Model(&BroadcastTransaction{}).Where("txid = ?", txid).Count(&count)
+	if count > 0 {
+		return nil
+	}
+	return bt.db.Create(&BroadcastTransaction{
+		Txid:            txid,
+		RawHex:          hex.EncodeToString(txBytes),
+		Fee:             fee,
+		Status:          BROADCAST_PENDING,
+		Broadcasts:      1,
+		LastBroadcastAt: now,
+	}).Error
+}
+
+func (bt *BroadcastTracker) Get(txid string) (*BroadcastTransaction, error) {
+	var broadcast BroadcastTransaction
+	err := bt.db.Where("txid = ?", txid).First(&broadcast).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errors.New("Transaction was not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &broadcast, nil
+}
+
+// List returns the transactions with status, or the ones still watched
+// when status is empty, oldest first.
+func (bt *BroadcastTracker) List(status string) ([]*BroadcastTransaction, error) {
+	query := bt.db.Where("status IN (?)", []string{BROADCAST_PENDING, BROADCAST_STUCK})
+	if status != "" {
+		query = bt.db.Where("status = ?", status)
+	}
+	var broadcasts []*BroadcastTransaction
+	err := query.Order("id").Find(&broadcasts).Error
+	return broadcasts, err
+}
+
+// Check books the cancellations left unbooked, then asks the backend about
+// every watched transaction.
+func (bt *BroadcastTracker) Check(ctx context.Context, now time.Time) error {
+	if err := bt.bookCancellations(ctx, now); err != nil {
+		Error.Println(err)
+	}
+	broadcasts, err := bt.List("")
+	if err != nil {
+		return err
+	}
+	for _, broadcast := range broadcasts {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := bt.check(ctx, broadcast, now); err != nil {
+			Error.Printf("Checking %s failed: %s\n", broadcast.Txid, err)
+		}
+	}
+	return nil
+}
+
+func (bt *BroadcastTracker) check(ctx context.Context, broadcast *BroadcastTransaction, now time.Time) error {
+	info, err := fetchTxInfo(ctx, bt.get, broadcast.Txid)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]interface{})
+	if info == nil {
+		// Neither in a block nor in the backend's mempool
+		updates["in_mempool"] = false
+		if now.Sub(broadcast.LastBroadcastAt) >= bt.policy.RebroadcastInterval {
+			bt.rebroadcast(broadcast, now, updates)
+		}
+	} else {
+		updates["in_mempool"] = info.Confirmations == 0
+		updates["confirmations"] = info.Confirmations
+		updates["last_seen_at"] = now
+	}
+
+	// Updates writes the new status back into broadcast
+	previous := broadcast.Status
+	status := previous
+	switch {
+	case info != nil && info.Confirmations >= bt.policy.Confirmations:
+		status = BROADCAST_CONFIRMED
+	case info != nil && info.Confirmations > 0:
+		status = BROADCAST_PENDING
+	case now.Sub(broadcast.CreatedAt) >= bt.policy.StuckAfter:
+		status = BROADCAST_STUCK
+	}
+	updates["status"] = status
+	if err := bt.db.Model(broadcast).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	if status == BROADCAST_STUCK && previous != BROADCAST_STUCK {
+		Error.Printf("Transaction %s is stuck, unconfirmed since %s\n", broadcast.Txid, broadcast.CreatedAt)
+		if bt.bus != nil {
+			bt.bus.Publish(ctx, TxStuck{broadcast.Txid, broadcast.CreatedAt})
+		}
+	}
+	if info != nil && info.Confirmations > 0 {
+		return bt.confirmCancellation(ctx, broadcast.Txid)
+	}
+	return nil
+}
+
+// rebroadcast pushes the transaction again, adding what changed to
+// updates. A failure is kept for the next check to retry.
+func (bt *BroadcastTracker) rebroadcast(broadcast *BroadcastTransaction, now time.Time, updates map[string]interface{}) {
+	updates["last_broadcast_at"] = now
+	updates["broadcasts"] = broadcast.Broadcasts + 1
+
+	txBytes, err := broadcast.Raw()
+	if err == nil {
+		_, err = bt.push(txBytes)
+	}
+	if err != nil {
+		updates["last_error"] = err.Error()
+		return
+	}
+	updates["last_error"] = ""
+	Info.Printf("Rebroadcast %s\n", broadcast.Txid)
+}
+
+// Run checks the watched transactions on every tick until ctx is done.
+func (bt *BroadcastTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(bt.policy.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := bt.Check(ctx, time.Now()); err != nil && err != ctx.Err() {
+				Error.Println(err)
+			}
+		}
+	}
+}
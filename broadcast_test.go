@@ -0,0 +1,89 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroadcastTracker(t *testing.T) {
+	txMgr := NewTransactionManager(NewUnspentTransactionMonitor(Client), NewReserverService(testDB))
+	tracker := NewBroadcastTracker(testDB, txMgr, BroadcastPolicy{
+		RebroadcastInterval: time.Minute,
+		StuckAfter:          time.Hour,
+		Confirmations:       3,
+	})
+	bus := NewEventBus()
+	tracker.Subscribe(bus)
+
+	confirmations := -1
+	tracker.get = func(ctx context.Context, url string) (*http.Response, error) {
+		status := 404
+		body := `{"status": "fail", "data": "trackedTx", "code": 404, "message": "No results found"}`
+		if confirmations >= 0 {
+			status = 200
+			body = fmt.Sprintf(`{"status": "success", "data": {"confirmations": %d}}`, confirmations)
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+	var pushed []string
+	tracker.push = func(txBytes []byte) (string, error) {
+		pushed = append(pushed, string(txBytes))
+		return "trackedTx", nil
+	}
+	var stuck []string
+	bus.Subscribe(TxStuck{}, func(ctx context.Context, event Event) {
+		stuck = append(stuck, event.(TxStuck).Txid)
+	})
+
+	bus.Publish(context.Background(), TxBroadcast{Txid: "trackedTx", Fee: 1000, Raw: []byte("raw")})
+	tracked, err := tracker.Get("trackedTx")
+	if err != nil || tracked.Status != BROADCAST_PENDING || tracked.Broadcasts != 1 {
+		t.FailNow()
+	}
+	start := tracked.LastBroadcastAt
+
+	// Unknown to the backend, but broadcast too recently to push again
+	tracker.Check(context.Background(), start.Add(time.Second))
+	if len(pushed) != 0 {
+		t.Fail()
+	}
+	tracker.Check(context.Background(), start.Add(2*time.Minute))
+	tracked, _ = tracker.Get("trackedTx")
+	if len(pushed) != 1 || pushed[0] != "raw" || tracked.Broadcasts != 2 || tracked.InMempool {
+		t.Fail()
+	}
+
+	// Back in the mempool but unconfirmed for too long
+	confirmations = 0
+	tracker.Check(context.Background(), start.Add(2*time.Hour))
+	tracker.Check(context.Background(), start.Add(3*time.Hour))
+	tracked, _ = tracker.Get("trackedTx")
+	if tracked.Status != BROADCAST_STUCK || !tracked.InMempool || len(pushed) != 1 {
+		t.Fail()
+	}
+	if len(stuck) != 1 || stuck[0] != "trackedTx" {
+		t.Fail()
+	}
+
+	confirmations = 1
+	tracker.Check(context.Background(), start.Add(4*time.Hour))
+	if tracked, _ = tracker.Get("trackedTx"); tracked.Status != BROADCAST_PENDING {
+		t.Fail()
+	}
+	confirmations = 3
+	tracker.Check(context.Background(), start.Add(5*time.Hour))
+	if tracked, _ = tracker.Get("trackedTx"); tracked.Status != BROADCAST_CONFIRMED {
+		t.Fail()
+	}
+	if watched, _ := tracker.List(""); len(watched) != 0 {
+		t.Fail()
+	}
+}
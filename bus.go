@@ -0,0 +1,257 @@
+package wallet
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event is something a component publishes on an EventBus. Name tells
+// events apart; every event type has its own.
+type Event interface {
+	Name() string
+}
+
+// UTXOAdded is published when the monitor sees a new unspent output.
+type UTXOAdded struct {
+	Address   string
+	Item      BlockrUnspentItem
+	Spendable bool
+}
+
+// UTXOUpdated is published when the confirmations of an output changed.
+type UTXOUpdated struct {
+	Address   string
+	Item      BlockrUnspentItem
+	Spendable bool
+}
+
+// UTXOSpent is published when an output is no longer unspent, because it
+// was spent or reorganized away.
+type UTXOSpent struct {
+	Address string
+	Item    BlockrUnspentItem
+}
+
+type BlockConnected struct {
+	Block BlockrBlockInfo
+}
+
+type ChainReorganized struct {
+	Reorg ReorgEvent
+}
+
+type ReserveCreated struct {
+	Address string
+	Reserve string
+	Amount  int64
+}
+
+type ReserveSpent struct {
+	Address string
+	Reserve string
+	Amount  int64
+	Txid    string
+}
+
+// TxBroadcast is published when one of our transactions was broadcast,
+// spending from Addresses to pay Payments.
+type TxBroadcast struct {
+	Txid      string
+	Addresses []string
+	Fee       int64
+	Payments  []Payment
+	Raw       []byte
+}
+
+// TxConfirmed is published when an output of one of our transactions
+// gains a confirmation.
+type TxConfirmed struct {
+	Txid          string
+	Address       string
+	Confirmations int
+}
+
+// TxStuck is published when one of our transactions stayed unconfirmed
+// for too long.
+type TxStuck struct {
+	Txid  string
+	Since time.Time
+}
+
+// TxReplaced is published when ReplacedTxid was replaced by Txid, paying
+// ExtraFee more out of the funds of Payer.
+type TxReplaced struct {
+	ReplacedTxid string
+	Txid         string
+	Payer        string
+	Fee          int64
+	ExtraFee     int64
+	Raw          []byte
+}
+
+// TxDropped is published when a reorg dropped one of our transactions and
+// its spend was rolled back.
+type TxDropped struct {
+	Txid string
+}
+
+// SpendCancelling is published when CancelTxid was broadcast to double-spend
+// Txid back to ChangeAddress of Address, and the spends of Txid were moved
+// over to it.
+type SpendCancelling struct {
+	Txid          string
+	CancelTxid    string
+	Address       string
+	ChangeAddress string
+	Amount        int64
+	Fee           int64
+}
+
+// SpendCancelled is published when CancelTxid, which double-spent Txid
+// back to ChangeAddress of Address, is confirmed and the reserves Txid
+// spent are available again.
+type SpendCancelled struct {
+	Txid          string
+	CancelTxid    string
+	Address       string
+	ChangeAddress string
+	Amount        int64
+	Fee           int64
+}
+
+func (UTXOAdded) Name() string        { return "UTXOAdded" }
+func (UTXOUpdated) Name() string      { return "UTXOUpdated" }
+func (UTXOSpent) Name() string        { return "UTXOSpent" }
+func (BlockConnected) Name() string   { return "BlockConnected" }
+func (ChainReorganized) Name() string { return "ChainReorganized" }
+func (ReserveCreated) Name() string   { return "ReserveCreated" }
+func (ReserveSpent) Name() string     { return "ReserveSpent" }
+func (TxBroadcast) Name() string      { return "TxBroadcast" }
+func (TxConfirmed) Name() string      { return "TxConfirmed" }
+func (TxStuck) Name() string          { return "TxStuck" }
+func (TxReplaced) Name() string       { return "TxReplaced" }
+func (TxDropped) Name() string        { return "TxDropped" }
+func (SpendCancelling) Name() string  { return "SpendCancelling" }
+func (SpendCancelled) Name() string   { return "SpendCancelled" }
+
+// newUTXOEvent turns a change seen by the monitor into the event for it.
+func newUTXOEvent(change UTXOChange) Event {
+	switch change.Kind {
+	case UTXO_ADDED:
+		return UTXOAdded{change.Address, change.Item, change.Spendable}
+	case UTXO_UPDATED:
+		return UTXOUpdated{change.Address, change.Item, change.Spendable}
+	}
+	return UTXOSpent{change.Address, change.Item}
+}
+
+// utxoChangeFor is the opposite of newUTXOEvent.
+func utxoChangeFor(event Event) (UTXOChange, bool) {
+	switch e := event.(type) {
+	case UTXOAdded:
+		return UTXOChange{UTXO_ADDED, e.Address, e.Item, e.Spendable}, true
+	case UTXOUpdated:
+		return UTXOChange{UTXO_UPDATED, e.Address, e.Item, e.Spendable}, true
+	case UTXOSpent:
+		return UTXOChange{UTXO_REMOVED, e.Address, e.Item, false}, true
+	}
+	return UTXOChange{}, false
+}
+
+type EventHandler func(ctx context.Context, event Event)
+
+type subscription struct {
+	id      int
+	handler EventHandler
+}
+
+// EventBus delivers published events to their subscribers, in the order
+// they subscribed, before Publish returns. A panicking subscriber is
+// logged and does not stop the others.
+type EventBus struct {
+	sync.RWMutex
+	subscriptions map[string][]subscription
+	nextID        int
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: make(map[string][]subscription),
+	}
+}
+
+// Subscribe calls handler with every event named like event. It returns a
+// function that cancels the subscription.
+func (bus *EventBus) Subscribe(event Event, handler EventHandler) func() {
+	return bus.subscribe(event.Name(), handler)
+}
+
+// SubscribeAll calls handler with every event, for logging and metrics.
+func (bus *EventBus) SubscribeAll(handler EventHandler) func() {
+	return bus.subscribe("", handler)
+}
+
+// SubscribeUTXOChanges calls handler with every change the monitor sees.
+func (bus *EventBus) SubscribeUTXOChanges(handler func(UTXOChange)) func() {
+	adapter := func(ctx context.Context, event Event) {
+		if change, ok := utxoChangeFor(event); ok {
+			handler(change)
+		}
+	}
+	cancels := []func(){
+		bus.Subscribe(UTXOAdded{}, adapter),
+		bus.Subscribe(UTXOUpdated{}, adapter),
+		bus.Subscribe(UTXOSpent{}, adapter),
+	}
+	return func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+func (bus *EventBus) subscribe(name string, handler EventHandler) func() {
+	bus.Lock()
+	defer bus.Unlock()
+	bus.nextID++
+	id := bus.nextID
+	bus.subscriptions[name] = append(bus.subscriptions[name], subscription{id, handler})
+
+	return func() {
+		bus.Lock()
+		defer bus.Unlock()
+		subscriptions := bus.subscriptions[name]
+		for idx, sub := range subscriptions {
+			if sub.id == id {
+				bus.subscriptions[name] = append(subscriptions[:idx:idx], subscriptions[idx+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (bus *EventBus) Publish(ctx context.Context, event Event) {
+	bus.RLock()
+	var handlers []EventHandler
+	for _, sub := range bus.subscriptions[event.Name()] {
+		handlers = append(handlers, sub.handler)
+	}
+	for _, sub := range bus.subscriptions[""] {
+		handlers = append(handlers, sub.handler)
+	}
+	bus.RUnlock()
+
+	for _, handler := range handlers {
+		bus.deliver(ctx, event, handler)
+	}
+}
+
+func (bus *EventBus) deliver(ctx context.Context, event Event, handler EventHandler) {
+	defer func() {
+		if r := recover(); r != nil {
+			Error.Printf("Subscriber of %s panicked: %v\n", event.Name(), r)
+		}
+	}()
+	handler(ctx, event)
+}
@@ -0,0 +1,67 @@
+package wallet
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	var received []string
+	bus.Subscribe(TxBroadcast{}, func(ctx context.Context, event Event) {
+		panic("subscriber failed")
+	})
+	cancel := bus.Subscribe(TxBroadcast{}, func(ctx context.Context, event Event) {
+		received = append(received, "broadcast:"+event.(TxBroadcast).Txid)
+	})
+	bus.SubscribeAll(func(ctx context.Context, event Event) {
+		received = append(received, "all:"+event.Name())
+	})
+
+	// A panicking subscriber does not keep the others from the event
+	bus.Publish(context.Background(), TxBroadcast{Txid: "a"})
+	bus.Publish(context.Background(), ReserveCreated{Address: "busAddress"})
+	if len(received) != 3 || received[0] != "broadcast:a" ||
+		received[1] != "all:TxBroadcast" || received[2] != "all:ReserveCreated" {
+		t.Fail()
+	}
+
+	cancel()
+	bus.Publish(context.Background(), TxBroadcast{Txid: "b"})
+	if len(received) != 4 || received[3] != "all:TxBroadcast" {
+		t.Fail()
+	}
+}
+
+func TestUTXOChangesRoundTrip(t *testing.T) {
+	bus := NewEventBus()
+	var changes []UTXOChange
+	cancel := bus.SubscribeUTXOChanges(func(change UTXOChange) {
+		changes = append(changes, change)
+	})
+
+	item := BlockrUnspentItem{Tx: "a", Amount: "1.0", Confirmations: 1}
+	sent := []UTXOChange{
+		UTXOChange{UTXO_ADDED, "busAddress", item, false},
+		UTXOChange{UTXO_UPDATED, "busAddress", item, true},
+		UTXOChange{UTXO_REMOVED, "busAddress", item, false},
+	}
+	for _, change := range sent {
+		bus.Publish(context.Background(), newUTXOEvent(change))
+	}
+	bus.Publish(context.Background(), BlockConnected{})
+	if len(changes) != len(sent) {
+		t.FailNow()
+	}
+	for idx := range sent {
+		if changes[idx] != sent[idx] {
+			t.Fail()
+		}
+	}
+
+	cancel()
+	bus.Publish(context.Background(), newUTXOEvent(sent[0]))
+	if len(changes) != len(sent) {
+		t.Fail()
+	}
+}
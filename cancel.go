@@ -0,0 +1,407 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	// Broadcast, waiting for the cancelling transaction to confirm
+	CANCELLATION_PENDING   = "pending"
+	CANCELLATION_CONFIRMED = "confirmed"
+)
+
+// Cancellation records that Txid was double-spent by CancelTxid, sending
+// Amount back to ChangeAddress of Address after paying Fee.
+type Cancellation struct {
+	gorm.Model
+	Txid          string `gorm:"unique_index"`
+	CancelTxid    string `gorm:"index"`
+	Address       string
+	ChangeAddress string
+	Amount        int64
+	Fee           int64
+	Status        string
+	// What Txid sent back to Address or its change addresses, which the
+	// cancellation spends as well
+	Returned int64
+	// Set once reserves, ledger, journal and history follow CancelTxid.
+	// Cancellations left unbooked are booked again on every Check.
+	Booked bool
+}
+
+// makeCancellation builds a transaction spending the inputs of original,
+// which paid oldFee, to changeAddress alone. It pays feeRate satoshis per
+// byte, or the least a replacement must pay when feeRate is 0. It returns
+// the address spent from and what original sent back to it or its change
+// addresses.
+func (tm *TransactionManager) makeCancellation(
+	original *wire.MsgTx,
+	oldFee, feeRate int64,
+	changeAddress string,
+	keys KeyLookup,
+) (*wire.MsgTx, string, int64, int64, error) {
+	if len(original.TxIn) == 0 {
+		return nil, "", 0, 0, errors.New("Transaction has no inputs")
+	}
+	payer, err := inputAddress(original.TxIn[0])
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	for _, txin := range original.TxIn[1:] {
+		address, err := inputAddress(txin)
+		if err != nil {
+			return nil, "", 0, 0, err
+		}
+		if address.EncodeAddress() != payer.EncodeAddress() {
+			return nil, "", 0, 0, errors.New("Only transactions spending from a single address can be cancelled")
+		}
+	}
+	payerScript, err := txscript.PayToAddrScript(payer)
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	changeScript, err := tm.makePayToPubkeyHashScript(changeAddress)
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+
+	own, err := tm.ownScripts(payer.EncodeAddress())
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	total := oldFee
+	var returned int64
+	for _, txout := range original.TxOut {
+		total += txout.Value
+		if _, ok := own[hex.EncodeToString(txout.PkScript)]; ok {
+			returned += txout.Value
+		}
+	}
+
+	size := int64(TX_OVERHEAD_SIZE + len(original.TxIn)*P2PKH_INPUT_SIZE + P2PKH_OUTPUT_SIZE)
+	fee := oldFee + MIN_RELAY_FEE_RATE*size
+	if feeRate > 0 {
+		if feeRate*size < fee {
+			return nil, "", 0, 0, errors.New("Fee rate is too low to replace the transaction")
+		}
+		fee = feeRate * size
+	}
+	if total <= fee {
+		return nil, "", 0, 0, errors.New("Inputs are too small to pay for the cancellation")
+	}
+
+	pk, err := keys(payer.EncodeAddress())
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	tx := wire.NewMsgTx()
+	scripts := make([][]byte, 0, len(original.TxIn))
+	inputKeys := make([]*btcec.PrivateKey, 0, len(original.TxIn))
+	for _, txin := range original.TxIn {
+		cancelIn := wire.NewTxIn(&txin.PreviousOutPoint, []byte{})
+		cancelIn.Sequence = RBF_SEQUENCE
+		tx.AddTxIn(cancelIn)
+		scripts = append(scripts, payerScript)
+		inputKeys = append(inputKeys, pk)
+	}
+	tx.AddTxOut(wire.NewTxOut(total-fee, changeScript))
+
+	if err := tm.signTransaction(tx, scripts, inputKeys); err != nil {
+		return nil, "", 0, 0, err
+	}
+	return tx, payer.EncodeAddress(), returned, fee, nil
+}
+
+// CancelSpend replaces a pending reserve spend with a transaction sending
+// the same inputs back to changeAddress, and returns its txid. The
+// reserves the spend took from are available again once it confirms.
+// Cancelling needs the manager to have a ledger, which hands what arrives
+// on changeAddress over to the address that spent.
+func (bt *BroadcastTracker) CancelSpend(txid, changeAddress string, feeRate int64, keys KeyLookup) (string, error) {
+	if feeRate < 0 {
+		return "", errors.New("Fee rate is invalid")
+	}
+	if bt.txMgr.ledger == nil {
+		return "", errors.New("Cancelling a spend needs a ledger")
+	}
+
+	cancellation, txBytes, oldFee, err := bt.cancel(txid, changeAddress, feeRate, keys)
+	if err != nil {
+		return "", err
+	}
+	err = bt.db.Create(&FeeReplacement{
+		ReplacedTxid: txid,
+		Txid:         cancellation.CancelTxid,
+		OldFee:       oldFee,
+		Fee:          cancellation.Fee,
+		FeeRate:      cancellation.Fee / int64(len(txBytes)),
+	}).Error
+	if err != nil {
+		Error.Println(err)
+	}
+
+	// A cancellation that cannot be booked now is booked by the next Check
+	if err := bt.bookCancellation(context.Background(), cancellation, txBytes, time.Now()); err != nil {
+		Error.Printf("Booking the cancellation of %s failed, leaving it to be retried: %s\n", txid, err)
+	}
+	bt.txMgr.unspentTransactionMonitorInstance.MarkDirty(cancellation.Address, changeAddress)
+	return cancellation.CancelTxid, nil
+}
+
+// cancel checks that txid can still be cancelled, then builds and
+// broadcasts its cancellation and records it, all under the lock of the
+// transaction manager. It returns the cancellation with the cancelling
+// transaction and the fee txid paid.
+func (bt *BroadcastTracker) cancel(
+	txid, changeAddress string,
+	feeRate int64,
+	keys KeyLookup,
+) (*Cancellation, []byte, int64, error) {
+	tm := bt.txMgr
+	tm.Lock()
+	defer tm.Unlock()
+
+	broadcast, err := bt.Get(txid)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if broadcast.Status != BROADCAST_PENDING && broadcast.Status != BROADCAST_STUCK {
+		return nil, nil, 0, errors.New("Only unconfirmed transactions can be cancelled")
+	}
+	if broadcast.Confirmations > 0 {
+		return nil, nil, 0, errors.New("Transaction is already confirmed")
+	}
+	if bt.isCancellation(txid) {
+		return nil, nil, 0, errors.New("Transaction already cancels a spend")
+	}
+	raw, err := broadcast.Raw()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	original := wire.NewMsgTx()
+	if err := original.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, nil, 0, err
+	}
+	if !signalsReplaceability(original) {
+		return nil, nil, 0, errors.New("Transaction does not signal replaceability")
+	}
+
+	cancel, payer, returned, fee, err := tm.makeCancellation(original, broadcast.Fee, feeRate, changeAddress, keys)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	txBytes, err := serializeTransaction(cancel)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	cancelTxid, err := bt.push(txBytes)
+	if _, rejected := err.(*BroadcastRejected); rejected {
+		return nil, nil, 0, err
+	}
+	if err != nil {
+		// The cancellation may have reached the network anyway, so it is
+		// recorded like one that did, and tracked so that it is pushed again
+		cancelTxid = cancel.TxHash().String()
+		Error.Printf("Broadcasting cancellation %s failed, leaving it to be rebroadcast: %s\n", cancelTxid, err)
+	}
+	Info.Printf("Cancelled %s with %s back to %s, paying %d\n", txid, cancelTxid, changeAddress, fee)
+
+	if err := bt.Track(cancelTxid, txBytes, fee, time.Now()); err != nil {
+		Error.Printf("Cancellation %s of %s was broadcast but could not be tracked\n", cancelTxid, txid)
+		return nil, nil, 0, err
+	}
+	cancellation := &Cancellation{
+		Txid:          txid,
+		CancelTxid:    cancelTxid,
+		Address:       payer,
+		ChangeAddress: changeAddress,
+		Amount:        cancel.TxOut[0].Value,
+		Fee:           fee,
+		Status:        CANCELLATION_PENDING,
+		Returned:      returned,
+	}
+	if err := bt.db.Create(cancellation).Error; err != nil {
+		Error.Printf("Cancellation %s of %s was broadcast but could not be recorded\n", cancelTxid, txid)
+		return nil, nil, 0, err
+	}
+	return cancellation, txBytes, broadcast.Fee, nil
+}
+
+// bookCancellation makes the tracker, reserves, ledger and journal follow
+// a cancellation that was broadcast, then publishes SpendCancelling. Every
+// step can run again, so a failed booking is simply retried.
+func (bt *BroadcastTracker) bookCancellation(ctx context.Context, cancellation *Cancellation, txBytes []byte, now time.Time) error {
+	tm := bt.txMgr
+	err := bt.handleReplaced(cancellation.Txid, cancellation.CancelTxid, txBytes, cancellation.Fee, now)
+	if err != nil {
+		return err
+	}
+	// The spends stay booked against the cancelling transaction until it
+	// confirms, which keeps reorg checks looking at the right txid
+	if err := tm.reserveInstance.ReplaceSpendTxid(cancellation.Txid, cancellation.CancelTxid, 0); err != nil {
+		return err
+	}
+	if err := tm.ledger.ForgetChange(cancellation.Txid); err != nil {
+		return err
+	}
+	if tm.journal != nil && tm.journal.isOwnTransaction(cancellation.Txid) {
+		// The change the original sent back is spent as well
+		err := tm.journal.ReplaceTransaction(cancellation.Txid, cancellation.CancelTxid, txBytes,
+			cancellation.Address, cancellation.Fee, cancellation.Returned)
+		if err != nil {
+			return err
+		}
+	}
+	if err := bt.db.Model(cancellation).Update("booked", true).Error; err != nil {
+		return err
+	}
+
+	if bt.bus != nil {
+		bt.bus.Publish(ctx, SpendCancelling{
+			Txid:          cancellation.Txid,
+			CancelTxid:    cancellation.CancelTxid,
+			Address:       cancellation.Address,
+			ChangeAddress: cancellation.ChangeAddress,
+			Amount:        cancellation.Amount,
+			Fee:           cancellation.Fee,
+		})
+	}
+	return nil
+}
+
+// bookCancellations books again the cancellations whose booking failed.
+func (bt *BroadcastTracker) bookCancellations(ctx context.Context, now time.Time) error {
+	var cancellations []*Cancellation
+	err := bt.db.Where(
+		"booked = ? AND status = ?", false, CANCELLATION_PENDING,
+	).Order("id").Find(&cancellations).Error
+	if err != nil {
+		return err
+	}
+	for _, cancellation := range cancellations {
+		broadcast, err := bt.Get(cancellation.CancelTxid)
+		if err != nil {
+			return err
+		}
+		txBytes, err := broadcast.Raw()
+		if err != nil {
+			return err
+		}
+		if err := bt.bookCancellation(ctx, cancellation, txBytes, now); err != nil {
+			Error.Printf("Booking the cancellation of %s failed: %s\n", cancellation.Txid, err)
+		}
+	}
+	return nil
+}
+
+// isCancellation tells whether txid cancels one of our spends.
+func (bt *BroadcastTracker) isCancellation(txid string) bool {
+	var count int
+	bt.db.Model(&Cancellation{}).Where("cancel_txid = ?", txid).Count(&count)
+	return count > 0
+}
+
+// Cancellation returns the cancellation of txid.
+func (bt *BroadcastTracker) Cancellation(txid string) (*Cancellation, error) {
+	var cancellation Cancellation
+	err := bt.db.Where("txid = ?", txid).First(&cancellation).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errors.New("Transaction was not cancelled")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cancellation, nil
+}
+
+// confirmCancellation completes the cancellation made by cancelTxid, if
+// any: what came back is deposited on the change address and handed over
+// to the address that spent, and the reserves get their amounts back.
+func (bt *BroadcastTracker) confirmCancellation(ctx context.Context, cancelTxid string) error {
+	var cancellation Cancellation
+	// Until booked, the spends are not yet under cancelTxid
+	err := bt.db.Where(
+		"cancel_txid = ? AND status = ? AND booked = ?", cancelTxid, CANCELLATION_PENDING, true,
+	).First(&cancellation).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	update := bt.db.Model(&Cancellation{}).Where(
+		"id = ? AND status = ?", cancellation.ID, CANCELLATION_PENDING,
+	).Update("status", CANCELLATION_CONFIRMED)
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected != 1 {
+		// Confirmed concurrently
+		return nil
+	}
+
+	tm := bt.txMgr
+	if tm.journal != nil {
+		returned := BlockrUnspentItem{Tx: cancelTxid, Idx: 0}
+		err := tm.journal.depositReturned(cancellation.ChangeAddress, returned.Outpoint(), cancellation.Amount)
+		if err != nil {
+			Error.Println(err)
+		}
+	}
+	if _, err := tm.ledger.Transfer(cancellation.ChangeAddress, cancellation.Address, cancellation.Amount); err != nil {
+		Error.Println(err)
+	}
+	if _, err := tm.reserveInstance.CancelSpend(cancelTxid); err != nil {
+		Error.Println(err)
+	}
+	Info.Printf("Cancellation of %s confirmed\n", cancellation.Txid)
+
+	if bt.bus != nil {
+		bt.bus.Publish(ctx, SpendCancelled{
+			Txid:          cancellation.Txid,
+			CancelTxid:    cancelTxid,
+			Address:       cancellation.Address,
+			ChangeAddress: cancellation.ChangeAddress,
+			Amount:        cancellation.Amount,
+			Fee:           cancellation.Fee,
+		})
+	}
+	return nil
+}
+
+// depositReturned posts what a cancellation sent back to address. Being
+// one of our own transactions, the monitor's deposit handling skips it.
+func (j *Journal) depositReturned(address, outpoint string, amount int64) error {
+	if j.depositPosted(outpoint) {
+		return nil
+	}
+	return j.postAtomically(JOURNAL_MEMO_DEPOSIT, outpoint,
+		Leg{FundsAccount(address), amount},
+		Leg{JOURNAL_CHAIN, -amount},
+	)
+}
+
+// HandleSpendCancelling moves the payments of the cancelled transaction
+// over to the cancelling one, which keeps what the latter sends back from
+// being taken for a deposit.
+func (th *TransactionHistory) HandleSpendCancelling(event SpendCancelling) error {
+	return th.db.Model(&TransactionRecord{}).Where(
+		"txid = ? AND direction = ?", event.Txid, HISTORY_OUTGOING,
+	).Update("txid", event.CancelTxid).Error
+}
+
+// HandleSpendCancelled removes the payments of a cancelled transaction,
+// which never happened.
+func (th *TransactionHistory) HandleSpendCancelled(event SpendCancelled) error {
+	return th.db.Where(
+		"txid IN (?) AND direction = ?", []string{event.Txid, event.CancelTxid}, HISTORY_OUTGOING,
+	).Delete(&TransactionRecord{}).Error
+}
@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"testing"
+	"time"
+)
+
+func TestCancelSpend(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	tracker := NewBroadcastTracker(testDB, txmgr, DefaultBroadcastPolicy())
+	tracker.push = func(txBytes []byte) (string, error) {
+		return "cancelReplacement", nil
+	}
+
+	frmPK, _ := btcec.NewPrivateKey(btcec.S256())
+	frmAddress, _ := btcutil.NewAddressPubKey(frmPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	p2pkhFrmAddress, _ := txmgr.makePayToPubkeyHashScript(frmAddress.EncodeAddress())
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		frmAddress.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "ca631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(p2pkhFrmAddress),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		return frmPK, nil
+	}
+	changes := NewChangeAddresses(testDB, keys)
+	change, _ := changes.Fresh(frmAddress.EncodeAddress())
+
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(frmAddress.EncodeAddress(), 60000000)
+	txBytes, err := txmgr.MakeTransactionForOutputs(frmAddress.EncodeAddress(), reserve, frmPK, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 30000000},
+	}, FEE_RECIPIENT_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := wire.NewMsgTx()
+	original.Deserialize(bytes.NewReader(txBytes))
+	txmgr.reserveInstance.SpendReserve(frmAddress.EncodeAddress(), reserve, 30000000, BTC_FEE_IN_SATOSHIS, "cancelOriginal")
+	tracker.Track("cancelOriginal", txBytes, BTC_FEE_IN_SATOSHIS, time.Now())
+
+	// Without a ledger, nothing would hand the coins back to the account
+	if _, err := tracker.CancelSpend("cancelOriginal", change.Address, 0, keys); err == nil {
+		t.Fail()
+	}
+	ledger := NewLedger(testDB)
+	txmgr.SetLedger(ledger, keys)
+
+	txid, err := tracker.CancelSpend("cancelOriginal", change.Address, 0, keys)
+	if err != nil || txid != "cancelReplacement" {
+		t.Fatal(err)
+	}
+	cancelled, _ := tracker.Get("cancelReplacement")
+	raw, _ := cancelled.Raw()
+	cancel := wire.NewMsgTx()
+	cancel.Deserialize(bytes.NewReader(raw))
+	if len(cancel.TxIn) != 1 || len(cancel.TxOut) != 1 {
+		t.FailNow()
+	}
+	if cancelled.Fee <= BTC_FEE_IN_SATOSHIS || cancel.TxOut[0].Value != 100000000-cancelled.Fee {
+		t.Fail()
+	}
+	if replaced, _ := tracker.Get("cancelOriginal"); replaced.Status != BROADCAST_REPLACED {
+		t.Fail()
+	}
+	if _, err := tracker.CancelSpend("cancelReplacement", change.Address, 0, keys); err == nil {
+		t.Fail()
+	}
+
+	cancellation, _ := tracker.Cancellation("cancelOriginal")
+	if !cancellation.Booked || cancellation.Returned != original.TxOut[1].Value {
+		t.Fail()
+	}
+
+	// Booking again, as Check does after a failure, changes nothing
+	testDB.Model(cancellation).Update("booked", false)
+	if err := tracker.bookCancellations(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if cancellation, _ = tracker.Cancellation("cancelOriginal"); !cancellation.Booked {
+		t.Fail()
+	}
+
+	// The reserve stays spent until the cancellation confirms
+	if remaining, _ := txmgr.reserveInstance.GetAmountReservedForReserve(frmAddress.EncodeAddress(), reserve); remaining != 30000000 {
+		t.Fail()
+	}
+	if err := tracker.confirmCancellation(context.Background(), "cancelReplacement"); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := txmgr.reserveInstance.GetAmountReservedForReserve(frmAddress.EncodeAddress(), reserve); remaining != 60000000 {
+		t.Fail()
+	}
+	if netFor(t, ledger, frmAddress.EncodeAddress()) != cancel.TxOut[0].Value {
+		t.Fail()
+	}
+	cancellation, _ = tracker.Cancellation("cancelOriginal")
+	if cancellation.Status != CANCELLATION_CONFIRMED || cancellation.ChangeAddress != change.Address {
+		t.Fail()
+	}
+
+	// Confirming twice changes nothing
+	tracker.confirmCancellation(context.Background(), "cancelReplacement")
+	if netFor(t, ledger, frmAddress.EncodeAddress()) != cancel.TxOut[0].Value {
+		t.Fail()
+	}
+}
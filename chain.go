@@ -0,0 +1,318 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	BLOCKR_BLOCK_INFO_ADDRESS = "http://btc.blockr.io/api/v1/block/info/"
+	BLOCKR_TX_INFO_ADDRESS    = "http://btc.blockr.io/api/v1/tx/info/"
+
+	// How many recent blocks are remembered to find where a reorg forked
+	BLOCK_HISTORY_SIZE = 100
+
+	// How far back spends are rechecked after a reorg
+	REORG_RECHECK_WINDOW = 24 * time.Hour
+)
+
+type BlockrBlockInfo struct {
+	Hash         string `json:"hash"`
+	Height       int64  `json:"nb"`
+	PreviousHash string `json:"prev_block_hash"`
+}
+
+type BlockrBlockResponse struct {
+	Status string          `json:"status"`
+	Data   BlockrBlockInfo `json:"data"`
+}
+
+type BlockrTxInfo struct {
+	Tx            string `json:"tx"`
+	Confirmations int    `json:"confirmations"`
+	Block         int64  `json:"block"`
+	// In bitcoins
+	Fee  string `json:"fee"`
+	Size int64  `json:"size"`
+}
+
+// BlockrTxResponse holds a BlockrTxInfo in Data on success, and a
+// message on failure.
+type BlockrTxResponse struct {
+	Status  string          `json:"status"`
+	Data    json.RawMessage `json:"data"`
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+}
+
+// ReorgEvent is emitted when the chain tip moved to a different branch.
+type ReorgEvent struct {
+	OldTip BlockrBlockInfo
+	NewTip BlockrBlockInfo
+	// Last height both branches agree on
+	ForkHeight int64
+	// How many of the blocks we knew about were disconnected
+	Depth int64
+}
+
+// httpGetter sends a GET request, like http.Client.Get.
+type httpGetter func(ctx context.Context, url string) (*http.Response, error)
+
+// getWithContext is http.Client.Get, cancelled when ctx is done.
+func getWithContext(ctx context.Context, netClient *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return netClient.Do(req.WithContext(ctx))
+}
+
+func fetchBlockInfo(ctx context.Context, get httpGetter, ref string) (*BlockrBlockInfo, error) {
+	res, err := get(ctx, BLOCKR_BLOCK_INFO_ADDRESS+ref)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var decodedResponse BlockrBlockResponse
+	if err := json.NewDecoder(res.Body).Decode(&decodedResponse); err != nil {
+		return nil, err
+	}
+	if decodedResponse.Status != "success" {
+		return nil, errors.New("Decoded response status: " + decodedResponse.Status)
+	}
+	return &decodedResponse.Data, nil
+}
+
+// fetchTxInfo returns nil when the backend says it does not know about
+// txid, in a block or in its mempool. Any other failure, such as a rate
+// limit or a server error, is returned as an error: the transaction may
+// well still exist.
+func fetchTxInfo(ctx context.Context, get httpGetter, txid string) (*BlockrTxInfo, error) {
+	res, err := get(ctx, BLOCKR_TX_INFO_ADDRESS+txid)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var decodedResponse BlockrTxResponse
+	if err := json.NewDecoder(res.Body).Decode(&decodedResponse); err != nil {
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New("Backend responded " + res.Status)
+		}
+		return nil, err
+	}
+	if decodedResponse.Status != "success" {
+		if res.StatusCode == http.StatusNotFound || decodedResponse.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, errors.New("Decoded response status: " + decodedResponse.Status + " " + decodedResponse.Message)
+	}
+
+	var info BlockrTxInfo
+	if err := json.Unmarshal(decodedResponse.Data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// BlockTracker remembers the hashes of recent blocks to notice when the
+// chain reorganizes.
+type BlockTracker struct {
+	sync.Mutex
+	tip     *BlockrBlockInfo
+	history map[int64]string
+}
+
+func NewBlockTracker() *BlockTracker {
+	return &BlockTracker{
+		history: make(map[int64]string),
+	}
+}
+
+func (bt *BlockTracker) Tip() *BlockrBlockInfo {
+	bt.Lock()
+	defer bt.Unlock()
+	return bt.tip
+}
+
+// restore starts tracking from a tip saved by an earlier run.
+func (bt *BlockTracker) restore(tip *BlockrBlockInfo) {
+	bt.Lock()
+	defer bt.Unlock()
+	if bt.tip == nil {
+		bt.tip = tip
+		bt.remember(tip)
+	}
+}
+
+func (bt *BlockTracker) remember(block *BlockrBlockInfo) {
+	bt.history[block.Height] = block.Hash
+	delete(bt.history, block.Height-BLOCK_HISTORY_SIZE)
+}
+
+// Update moves the tracker to a new tip, using fetch to look up blocks by
+// height on the new tip's branch. It returns a ReorgEvent when blocks we
+// knew about were disconnected.
+func (bt *BlockTracker) Update(
+	newTip *BlockrBlockInfo,
+	fetch func(height int64) (*BlockrBlockInfo, error),
+) (*ReorgEvent, error) {
+	bt.Lock()
+	defer bt.Unlock()
+
+	oldTip := bt.tip
+	if oldTip == nil {
+		bt.tip = newTip
+		bt.remember(newTip)
+		return nil, nil
+	}
+	if oldTip.Hash == newTip.Hash {
+		return nil, nil
+	}
+
+	// Common case: the new tip builds on ours
+	if newTip.Height == oldTip.Height+1 && newTip.PreviousHash == oldTip.Hash {
+		bt.tip = newTip
+		bt.remember(newTip)
+		return nil, nil
+	}
+
+	// Walk down the new branch until it meets a block we know
+	branch := map[int64]*BlockrBlockInfo{newTip.Height: newTip}
+	height := newTip.Height
+	if oldTip.Height < height {
+		height = oldTip.Height
+	}
+	for ; height > oldTip.Height-BLOCK_HISTORY_SIZE; height-- {
+		known, ok := bt.history[height]
+		if !ok {
+			break
+		}
+		block, ok := branch[height]
+		if !ok {
+			var err error
+			block, err = fetch(height)
+			if err != nil {
+				return nil, err
+			}
+			branch[height] = block
+		}
+		if block.Hash == known {
+			break
+		}
+	}
+
+	// Fill in the new branch above the fork
+	for h := height + 1; h < newTip.Height; h++ {
+		if _, ok := branch[h]; !ok {
+			block, err := fetch(h)
+			if err != nil {
+				return nil, err
+			}
+			branch[h] = block
+		}
+	}
+	for h := oldTip.Height; h > newTip.Height; h-- {
+		delete(bt.history, h)
+	}
+	for _, block := range branch {
+		bt.remember(block)
+	}
+	bt.tip = newTip
+
+	depth := oldTip.Height - height
+	if depth <= 0 {
+		return nil, nil
+	}
+	return &ReorgEvent{
+		OldTip:     *oldTip,
+		NewTip:     *newTip,
+		ForkHeight: height,
+		Depth:      depth,
+	}, nil
+}
+
+// checkTip fetches the chain tip and publishes new blocks and reorgs. It
+// tells whether the tip may have changed since the last check.
+func (utm *UnspentTransactionMonitor) checkTip(ctx context.Context) bool {
+	tip, err := fetchBlockInfo(ctx, utm.get, "last")
+	if err != nil {
+		Error.Println(err)
+		utm.recordFailure(err.Error())
+		return true
+	}
+
+	previous := utm.blocks.Tip()
+	reorg, err := utm.blocks.Update(tip, func(height int64) (*BlockrBlockInfo, error) {
+		return fetchBlockInfo(ctx, utm.get, strconv.FormatInt(height, 10))
+	})
+	if err != nil {
+		Error.Println(err)
+		return true
+	}
+	changed := previous == nil || previous.Hash != tip.Hash
+	bus := utm.EventBus()
+	if reorg != nil {
+		Error.Printf("Chain reorganized: %d blocks disconnected above height %d\n", reorg.Depth, reorg.ForkHeight)
+		bus.Publish(ctx, ChainReorganized{*reorg})
+	}
+	if changed {
+		bus.Publish(ctx, BlockConnected{*tip})
+	}
+	return changed
+}
+
+// HandleReorg rechecks the transactions we broadcast recently and rolls
+// back the reserves and journal postings of those the new chain dropped.
+// SetEventBus subscribes it to ChainReorganized events. Balances are
+// recomputed on the same refresh, so UTXO subscribers see what the reorg
+// changed.
+func (tm *TransactionManager) HandleReorg(ctx context.Context, event ReorgEvent) {
+	txids, err := tm.reserveInstance.RecentSpendTxids(time.Now().Add(-REORG_RECHECK_WINDOW))
+	if err != nil {
+		Error.Println(err)
+		return
+	}
+
+	for _, txid := range txids {
+		if ctx.Err() != nil {
+			return
+		}
+		// A failed lookup says nothing: the transaction is usually back
+		// in the mempool, and is only rolled back once the backend says it
+		// is neither there nor in a block
+		info, err := fetchTxInfo(ctx, tm.get, txid)
+		if err != nil {
+			Error.Println(err)
+			continue
+		}
+		if info != nil {
+			continue
+		}
+
+		Error.Println("Transaction dropped by reorg: " + txid)
+		if err := tm.reserveInstance.RevertSpend(txid); err != nil {
+			Error.Println(err)
+			continue
+		}
+		if tm.journal != nil {
+			if err := tm.journal.ReverseTransaction(txid); err != nil {
+				Error.Println(err)
+			}
+		}
+		if tm.ledger != nil {
+			if err := tm.ledger.ForgetChange(txid); err != nil {
+				Error.Println(err)
+			}
+		}
+		if tm.bus != nil {
+			tm.bus.Publish(ctx, TxDropped{txid})
+		}
+	}
+}
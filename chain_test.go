@@ -0,0 +1,111 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func blockAt(height int64, branch string) *BlockrBlockInfo {
+	return &BlockrBlockInfo{
+		Hash:         branch + string(rune('a'+height)),
+		Height:       height,
+		PreviousHash: branch + string(rune('a'+height-1)),
+	}
+}
+
+func TestBlockTrackerExtension(t *testing.T) {
+	bt := NewBlockTracker()
+	noFetch := func(height int64) (*BlockrBlockInfo, error) {
+		return nil, errors.New("Unexpected fetch")
+	}
+
+	for height := int64(1); height <= 5; height++ {
+		reorg, err := bt.Update(blockAt(height, "main"), noFetch)
+		if err != nil || reorg != nil {
+			t.Fail()
+		}
+	}
+	if bt.Tip().Height != 5 {
+		t.Fail()
+	}
+}
+
+func TestBlockTrackerReorg(t *testing.T) {
+	bt := NewBlockTracker()
+	for height := int64(1); height <= 5; height++ {
+		bt.Update(blockAt(height, "main"), nil)
+	}
+
+	// A competing branch forks after height 4 and overtakes ours
+	fetch := func(height int64) (*BlockrBlockInfo, error) {
+		if height <= 4 {
+			return blockAt(height, "main"), nil
+		}
+		return blockAt(height, "fork"), nil
+	}
+	newTip := blockAt(6, "fork")
+	reorg, err := bt.Update(newTip, fetch)
+	if err != nil || reorg == nil {
+		t.FailNow()
+	}
+	if reorg.ForkHeight != 4 || reorg.Depth != 1 {
+		t.Fail()
+	}
+	if bt.Tip().Hash != newTip.Hash {
+		t.Fail()
+	}
+
+	// Building on the new branch is not another reorg
+	reorg, err = bt.Update(blockAt(7, "fork"), fetch)
+	if err != nil || reorg != nil {
+		t.Fail()
+	}
+}
+
+func TestBlockTrackerGap(t *testing.T) {
+	bt := NewBlockTracker()
+	for height := int64(1); height <= 3; height++ {
+		bt.Update(blockAt(height, "main"), nil)
+	}
+
+	// Several blocks arrived between two checks
+	fetch := func(height int64) (*BlockrBlockInfo, error) {
+		return blockAt(height, "main"), nil
+	}
+	reorg, err := bt.Update(blockAt(6, "main"), fetch)
+	if err != nil || reorg != nil {
+		t.Fail()
+	}
+}
+
+func TestFetchTxInfo(t *testing.T) {
+	respond := func(status int, body string) httpGetter {
+		return func(ctx context.Context, url string) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: status,
+				Status:     http.StatusText(status),
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}, nil
+		}
+	}
+
+	info, err := fetchTxInfo(context.Background(), respond(200, `{"status": "success", "data": {"confirmations": 2}}`), "tx")
+	if err != nil || info == nil || info.Confirmations != 2 {
+		t.Fail()
+	}
+	// Only a definitive not found means the transaction is gone
+	info, err = fetchTxInfo(context.Background(), respond(404, `{"status": "fail", "data": "tx", "code": 404}`), "tx")
+	if err != nil || info != nil {
+		t.Fail()
+	}
+	if _, err := fetchTxInfo(context.Background(), respond(429, `{"status": "fail", "code": 429}`), "tx"); err == nil {
+		t.Fail()
+	}
+	if _, err := fetchTxInfo(context.Background(), respond(502, `<html>Bad Gateway</html>`), "tx"); err == nil {
+		t.Fail()
+	}
+}
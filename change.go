@@ -0,0 +1,293 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/jinzhu/gorm"
+)
+
+// Outputs worth less than these, per script type, cost more to spend than
+// they hold and make a transaction non-standard
+const (
+	DUST_P2PKH  = 546
+	DUST_P2SH   = 540
+	DUST_P2WPKH = 294
+	DUST_P2WSH  = 330
+)
+
+// Times Fresh tries again when another call took the index it picked
+const CHANGE_INDEX_ATTEMPTS = 3
+
+// DustThreshold is the smallest standard value of an output paying to
+// script.
+func DustThreshold(script []byte) int64 {
+	switch txscript.GetScriptClass(script) {
+	case txscript.ScriptHashTy:
+		return DUST_P2SH
+	case txscript.WitnessV0PubKeyHashTy:
+		return DUST_P2WPKH
+	case txscript.WitnessV0ScriptHashTy:
+		return DUST_P2WSH
+	}
+	return DUST_P2PKH
+}
+
+// ChangeAddress is an internal address of an account. Its key is derived
+// from the key of the account address, so only the index is stored.
+type ChangeAddress struct {
+	gorm.Model
+	Account string `gorm:"unique_index:idx_change_account_index"`
+	Index   uint32 `gorm:"unique_index:idx_change_account_index"`
+	Address string `gorm:"unique_index"`
+}
+
+// ChangeAddresses hands out fresh internal addresses to accounts and finds
+// their keys again.
+type ChangeAddresses struct {
+	db        *gorm.DB
+	keys      KeyLookup
+	watchList *WatchList
+}
+
+func NewChangeAddresses(localDb *gorm.DB, keys KeyLookup) *ChangeAddresses {
+	return &ChangeAddresses{
+		db:   localDb,
+		keys: keys,
+	}
+}
+
+// SetWatchList makes every fresh address permanently watched, so that the
+// monitor picks up what is sent to it.
+func (ca *ChangeAddresses) SetWatchList(watchList *WatchList) {
+	ca.watchList = watchList
+}
+
+// deriveChangeKey derives the key of the index-th change address of the
+// account whose key is pk: the SHA-256 of "change", the 32 bytes of pk and
+// index as 4 big-endian bytes. The scheme is this wallet's own, not BIP32,
+// as account keys come without a chain code. Change addresses already
+// handed out hold funds under it, so it must never change.
+func deriveChangeKey(pk *btcec.PrivateKey, index uint32) *btcec.PrivateKey {
+	seed := append([]byte("change"), pk.Serialize()...)
+	seed = append(seed, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(seed[len(seed)-4:], index)
+	digest := sha256.Sum256(seed)
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), digest[:])
+	return key
+}
+
+func changeAddressFor(key *btcec.PrivateKey) (string, error) {
+	address, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(key.PubKey().SerializeCompressed()), NetParams,
+	)
+	if err != nil {
+		return "", err
+	}
+	return address.EncodeAddress(), nil
+}
+
+// Fresh derives the next unused change address of account. Indexes are
+// unique per account, so when another call takes the same index first,
+// this one tries again with the next.
+func (ca *ChangeAddresses) Fresh(account string) (*ChangeAddress, error) {
+	pk, err := ca.keys(account)
+	if err != nil {
+		return nil, err
+	}
+
+	var change *ChangeAddress
+	for attempt := 1; ; attempt++ {
+		change, err = ca.create(account, pk)
+		if err == nil {
+			break
+		}
+		if attempt >= CHANGE_INDEX_ATTEMPTS {
+			return nil, err
+		}
+	}
+
+	if ca.watchList != nil {
+		if _, err := ca.watchList.Watch(change.Address, WatchOptions{Permanent: true}); err != nil {
+			Error.Println(err)
+		}
+	}
+	return change, nil
+}
+
+// create stores the change address of account at the next index.
+func (ca *ChangeAddresses) create(account string, pk *btcec.PrivateKey) (*ChangeAddress, error) {
+	var count int
+	if err := ca.db.Model(&ChangeAddress{}).Where("account = ?", account).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	index := uint32(count)
+	address, err := changeAddressFor(deriveChangeKey(pk, index))
+	if err != nil {
+		return nil, err
+	}
+	change := ChangeAddress{
+		Account: account,
+		Index:   index,
+		Address: address,
+	}
+	if err := ca.db.Create(&change).Error; err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (ca *ChangeAddresses) Get(address string) (*ChangeAddress, error) {
+	var change ChangeAddress
+	err := ca.db.Where("address = ?", address).First(&change).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errors.New("Address is not a change address")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// ForAccount lists the change addresses of account, oldest first.
+func (ca *ChangeAddresses) ForAccount(account string) ([]*ChangeAddress, error) {
+	var changes []*ChangeAddress
+	err := ca.db.Where("account = ?", account).Order("id").Find(&changes).Error
+	return changes, err
+}
+
+// Keys is a KeyLookup for change addresses.
+func (ca *ChangeAddresses) Keys(address string) (*btcec.PrivateKey, error) {
+	change, err := ca.Get(address)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ca.keys(change.Account)
+	if err != nil {
+		return nil, err
+	}
+	return deriveChangeKey(pk, change.Index), nil
+}
+
+// changeScriptFor returns the script of the output getting the change of
+// a spend from address: a fresh change address when the manager rotates
+// change, address itself otherwise. Change below the dust threshold gets
+// no output and is added to dust instead, to be left to the fee.
+func (tm *TransactionManager) changeScriptFor(address string, amount int64, dust map[string]int64) ([]byte, error) {
+	script, err := tm.makePayToPubkeyHashScript(address)
+	if err != nil {
+		return nil, err
+	}
+	if amount < DustThreshold(script) {
+		dust[address] += amount
+		return nil, nil
+	}
+	if tm.changes == nil || tm.ledger == nil {
+		return script, nil
+	}
+	change, err := tm.changes.Fresh(address)
+	if err != nil {
+		return nil, err
+	}
+	return tm.makePayToPubkeyHashScript(change.Address)
+}
+
+// ownScripts maps the output scripts of address and of its change
+// addresses to the address they pay.
+func (tm *TransactionManager) ownScripts(address string) (map[string]string, error) {
+	addresses := []string{address}
+	if tm.changes != nil {
+		changes, err := tm.changes.ForAccount(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			addresses = append(addresses, change.Address)
+		}
+	}
+
+	scripts := make(map[string]string)
+	for _, owned := range addresses {
+		script, err := tm.makePayToPubkeyHashScript(owned)
+		if err != nil {
+			return nil, err
+		}
+		scripts[hex.EncodeToString(script)] = owned
+	}
+	return scripts, nil
+}
+
+// recordChange hands the change that transaction txid sent to change
+// addresses of accounts over to them in the ledger. Change going back to
+// an address the transaction spent from is left alone: that address keeps
+// what it owed before.
+func (tm *TransactionManager) recordChange(txid string, txBytes []byte, accounts ...string) error {
+	if tm.changes == nil || tm.ledger == nil {
+		return nil
+	}
+	tx := wire.NewMsgTx()
+	if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return err
+	}
+
+	spentFrom := make(map[string]bool)
+	for _, txin := range tx.TxIn {
+		if address, err := inputAddress(txin); err == nil {
+			spentFrom[address.EncodeAddress()] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, account := range accounts {
+		if seen[account] {
+			continue
+		}
+		seen[account] = true
+		scripts, err := tm.ownScripts(account)
+		if err != nil {
+			return err
+		}
+		for _, txout := range tx.TxOut {
+			owner, ok := scripts[hex.EncodeToString(txout.PkScript)]
+			if !ok || spentFrom[owner] {
+				continue
+			}
+			if err := tm.ledger.RecordChange(owner, account, txout.Value, txid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trackChange records where the change of a transaction we broadcast went,
+// and takes what it paid out of funds rather than reserves from the funds
+// of each address.
+func (tm *TransactionManager) trackChange(txid string, txBytes []byte, fromFunds map[string]int64, accounts ...string) {
+	if err := tm.recordChange(txid, txBytes, accounts...); err != nil {
+		Error.Println(err)
+	}
+	if tm.journal == nil {
+		return
+	}
+	for address, amount := range fromFunds {
+		err := tm.journal.postAtomically(JOURNAL_MEMO_SPEND, txid,
+			Leg{FundsAccount(address), -amount}, Leg{InFlightAccount(address), amount})
+		if err != nil {
+			Error.Println(err)
+		}
+	}
+}
+
+func totalDust(dust map[string]int64) int64 {
+	var total int64
+	for _, amount := range dust {
+		total += amount
+	}
+	return total
+}
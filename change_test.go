@@ -0,0 +1,148 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"testing"
+)
+
+func TestFreshChangeAddress(t *testing.T) {
+	pk, _ := btcec.NewPrivateKey(btcec.S256())
+	account, _ := btcutil.NewAddressPubKey(pk.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	changes := NewChangeAddresses(testDB, func(address string) (*btcec.PrivateKey, error) {
+		return pk, nil
+	})
+
+	first, err := changes.Fresh(account.EncodeAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := changes.Fresh(account.EncodeAddress())
+	if first.Index != 0 || second.Index != 1 || first.Address == second.Address {
+		t.Fail()
+	}
+	if first.Address == account.EncodeAddress() {
+		t.Fail()
+	}
+
+	// The key is derived again from the account key
+	key, err := changes.Keys(second.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address, _ := changeAddressFor(key); address != second.Address {
+		t.Fail()
+	}
+	if _, err := changes.Keys(account.EncodeAddress()); err == nil {
+		t.Fail()
+	}
+	listed, _ := changes.ForAccount(account.EncodeAddress())
+	if len(listed) != 2 {
+		t.Fail()
+	}
+}
+
+func TestDeriveChangeKeyIsStable(t *testing.T) {
+	pk, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{1}, 32))
+	expected := map[uint32]string{
+		0: "62251c093a9cbf9b5f8caa118545ba1c936645787c1ba092779f90c5144ab9a8",
+		1: "47ef0ffafccdab9b7de631912e1c3e2c819a53c59bdea6abfd82fa14d21aa8e6",
+		7: "aa093b20eb6829d38275565f439901c50ff2fba6ad0790f58d16dd9b4a947236",
+	}
+	for index, key := range expected {
+		if hex.EncodeToString(deriveChangeKey(pk, index).Serialize()) != key {
+			t.Fail()
+		}
+	}
+}
+
+func TestChangeRotationAndDust(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	pk, _ := btcec.NewPrivateKey(btcec.S256())
+	address, _ := btcutil.NewAddressPubKey(pk.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		return pk, nil
+	}
+	ledger := NewLedger(testDB)
+	changes := NewChangeAddresses(testDB, keys)
+	txmgr.SetLedger(ledger, keys)
+	txmgr.SetChangeAddresses(changes)
+
+	script, _ := txmgr.makePayToPubkeyHashScript(address.EncodeAddress())
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		address.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "dd631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Script:        hex.EncodeToString(script),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(address.EncodeAddress(), 100000000)
+
+	// The change goes to a fresh change address, still counted for the account
+	spend, err := txmgr.buildTransactionForOutputs(address.EncodeAddress(), reserve, pk, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 30000000},
+	}, FEE_RECIPIENT_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(spend.txBytes))
+	listed, _ := changes.ForAccount(address.EncodeAddress())
+	if len(tx.TxOut) != 2 || len(listed) != 1 || len(spend.dust) != 0 {
+		t.FailNow()
+	}
+	changeScript, _ := txmgr.makePayToPubkeyHashScript(listed[0].Address)
+	if !bytes.Equal(tx.TxOut[1].PkScript, changeScript) || tx.TxOut[1].Value != 70000000 {
+		t.Fail()
+	}
+	txmgr.recordChange("rotatedSpend", spend.txBytes, address.EncodeAddress())
+	if netFor(t, ledger, address.EncodeAddress()) != 70000000 {
+		t.Fail()
+	}
+	ledger.ForgetChange("rotatedSpend")
+	if netFor(t, ledger, address.EncodeAddress()) != 0 {
+		t.Fail()
+	}
+
+	// Change below the dust threshold is left to the fee
+	spend, err = txmgr.buildTransactionForOutputs(address.EncodeAddress(), reserve, pk, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 99999800},
+	}, FEE_RECIPIENT_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(spend.txBytes))
+	if len(tx.TxOut) != 1 || spend.dust[address.EncodeAddress()] != 200 {
+		t.Fail()
+	}
+
+	// A payment below it is refused
+	_, err = txmgr.buildTransactionForOutputs(address.EncodeAddress(), reserve, pk, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: BTC_FEE_IN_SATOSHIS + 100},
+	}, FEE_RECIPIENT_PAYS)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	p2pkh, _ := makeOutputScript("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+	p2sh, _ := makeOutputScript("3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy")
+	if DustThreshold(p2pkh) != DUST_P2PKH || DustThreshold(p2sh) != DUST_P2SH {
+		t.Fail()
+	}
+}
@@ -0,0 +1,244 @@
+package wallet
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version, locktime and input and output counts of a small transaction
+const TX_OVERHEAD_SIZE = 10
+
+// unspentOutputsOf returns the outputs of txid paying address that the
+// monitor sees as unspent, confirmed or not.
+func (utm *UnspentTransactionMonitor) unspentOutputsOf(address, txid string) []BlockrUnspentItem {
+	utm.RLock()
+	defer utm.RUnlock()
+	var items []BlockrUnspentItem
+	if balance, ok := utm.balances[address]; ok {
+		for _, item := range balance.UnspentTransactions {
+			if item.Tx == txid {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// childFee is what a child of size childSize pays so that it and a parent
+// paying parentFee for parentSize bytes pay targetRate per byte together.
+func childFee(parentFee, parentSize, childSize, targetRate int64) (int64, error) {
+	if parentFee >= targetRate*parentSize {
+		return 0, errors.New("Parent already pays the target fee rate")
+	}
+	return targetRate*(parentSize+childSize) - parentFee, nil
+}
+
+// makeChildTransaction spends items of address back to address, paying
+// enough fee to bring the package with a parent to targetRate.
+func (tm *TransactionManager) makeChildTransaction(
+	address string,
+	items []BlockrUnspentItem,
+	parentFee, parentSize, targetRate int64,
+	keys KeyLookup,
+) ([]byte, int64, error) {
+	if len(items) == 0 {
+		return nil, 0, errors.New("Parent pays nothing to the address")
+	}
+	pk, err := keys(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	returnScript, err := tm.makePayToPubkeyHashScript(address)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tx := wire.NewMsgTx()
+	var scripts [][]byte
+	var inputKeys []*btcec.PrivateKey
+	var total int64
+	for _, item := range items {
+		hash, err := chainhash.NewHashFromStr(item.Tx)
+		if err != nil {
+			return nil, 0, err
+		}
+		script, err := hex.DecodeString(item.Script)
+		if err != nil {
+			return nil, 0, err
+		}
+		txin := wire.NewTxIn(wire.NewOutPoint(hash, uint32(item.Idx)), []byte{})
+		txin.Sequence = RBF_SEQUENCE
+		tx.AddTxIn(txin)
+		scripts = append(scripts, script)
+		inputKeys = append(inputKeys, pk)
+		total += item.Satoshis()
+	}
+
+	size := int64(TX_OVERHEAD_SIZE + len(items)*P2PKH_INPUT_SIZE + P2PKH_OUTPUT_SIZE)
+	fee, err := childFee(parentFee, parentSize, size, targetRate)
+	if err != nil {
+		return nil, 0, err
+	}
+	if total-fee < DustThreshold(returnScript) {
+		return nil, 0, errors.New("Outputs are too small to pay for the parent")
+	}
+	tx.AddTxOut(wire.NewTxOut(total-fee, returnScript))
+
+	if err := tm.signTransaction(tx, scripts, inputKeys); err != nil {
+		return nil, 0, err
+	}
+	txBytes, err := serializeTransaction(tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return txBytes, fee, nil
+}
+
+// parentFee finds what a parent paid and its size. Our own transactions
+// are looked up in the tracker, others are asked to the backend.
+func (bt *BroadcastTracker) parentFee(ctx context.Context, txid string) (int64, int64, bool, error) {
+	if broadcast, err := bt.Get(txid); err == nil {
+		if broadcast.Status != BROADCAST_PENDING && broadcast.Status != BROADCAST_STUCK {
+			return 0, 0, false, errors.New("Parent transaction is not pending")
+		}
+		if broadcast.Confirmations > 0 {
+			return 0, 0, false, errors.New("Parent transaction is already confirmed")
+		}
+		return broadcast.Fee, int64(len(broadcast.RawHex) / 2), true, nil
+	}
+
+	info, err := fetchTxInfo(ctx, bt.get, txid)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if info == nil {
+		return 0, 0, false, errors.New("Parent transaction was not found")
+	}
+	if info.Confirmations > 0 {
+		return 0, 0, false, errors.New("Parent transaction is already confirmed")
+	}
+	fee, err := strconv.ParseFloat(strings.TrimPrefix(info.Fee, "-"), 64)
+	if err != nil || info.Size <= 0 {
+		return 0, 0, false, errors.New("Backend did not report the fee and size of the parent")
+	}
+	return int64(math.Round(fee * SATOSHI_IN_BITCOIN)), info.Size, false, nil
+}
+
+// parentOutputsFor finds what parentTxid pays to address. The change of
+// our own transactions may have gone to a change address of address
+// instead, which is then the address returned.
+func (tm *TransactionManager) parentOutputsFor(address, parentTxid string, own bool) (string, []BlockrUnspentItem, error) {
+	utm := tm.unspentTransactionMonitorInstance
+	items := utm.unspentOutputsOf(address, parentTxid)
+	if len(items) > 0 || !own || tm.changes == nil || tm.ledger == nil {
+		return address, items, nil
+	}
+
+	changes, err := tm.changes.ForAccount(address)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, change := range changes {
+		if items := utm.unspentOutputsOf(change.Address, parentTxid); len(items) > 0 {
+			return change.Address, items, nil
+		}
+	}
+	return address, nil, nil
+}
+
+// ChildPaysForParent accelerates a pending parent transaction by spending
+// what it pays to address in a child paying enough fee for both to reach
+// targetRate satoshis per byte. It returns the txid of the child.
+//
+// When the parent is one of ours, its outputs are change and the child
+// fee is taken from the funds of address, which must have that much no
+// reserve holds. Otherwise the parent is a deposit, and what the child
+// returns is deposited instead.
+func (bt *BroadcastTracker) ChildPaysForParent(
+	ctx context.Context,
+	parentTxid, address string,
+	targetRate int64,
+	keys KeyLookup,
+) (string, error) {
+	if targetRate <= 0 {
+		return "", errors.New("Fee rate is invalid")
+	}
+	parentFee, parentSize, own, err := bt.parentFee(ctx, parentTxid)
+	if err != nil {
+		return "", err
+	}
+
+	tm := bt.txMgr
+	tm.Lock()
+	defer tm.Unlock()
+	if own {
+		// Our parent may have been replaced or confirmed meanwhile
+		parentFee, parentSize, own, err = bt.parentFee(ctx, parentTxid)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	spendFrom, items, err := tm.parentOutputsFor(address, parentTxid, own)
+	if err != nil {
+		return "", err
+	}
+	txBytes, fee, err := tm.makeChildTransaction(spendFrom, items, parentFee, parentSize, targetRate, keys)
+	if err != nil {
+		return "", err
+	}
+	if own && fee > tm.freeFunds(address) {
+		return "", errors.New("Insufficient funds to pay for the parent")
+	}
+	txid, err := bt.push(txBytes)
+	if err != nil {
+		return "", err
+	}
+	Info.Printf("Accelerating %s with child %s paying %d\n", parentTxid, txid, fee)
+
+	if own && tm.journal != nil {
+		if err := tm.journal.TrackChild(txid, txBytes, address, fee); err != nil {
+			Error.Println(err)
+		}
+	}
+	if spendFrom != address {
+		// The change address now holds fee less of what it keeps for address
+		if err := tm.ledger.Settle(address, spendFrom, fee, txid); err != nil {
+			Error.Println(err)
+		}
+	}
+	tm.unspentTransactionMonitorInstance.MarkDirty(spendFrom)
+	if err := bt.Track(txid, txBytes, fee, time.Now()); err != nil {
+		Error.Println(err)
+	}
+	if tm.bus != nil {
+		tm.bus.Publish(ctx, TxBroadcast{txid, []string{address}, fee, []Payment{
+			{Address: address, Destination: address, Amount: fee, Fee: fee},
+		}, txBytes})
+	}
+	return txid, nil
+}
+
+// TrackChild tracks a child transaction spending our own change, taking
+// the fee it pays out of the funds of address.
+func (j *Journal) TrackChild(txid string, txBytes []byte, address string, fee int64) error {
+	tx := j.db.Begin()
+	err := j.post(tx, JOURNAL_MEMO_SPEND, txid,
+		Leg{FundsAccount(address), -fee}, Leg{InFlightAccount(address), fee})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	return j.TrackInFlight(txid, txBytes, fee)
+}
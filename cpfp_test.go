@@ -0,0 +1,128 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChildFee(t *testing.T) {
+	// 200 bytes paying 2 per byte, with a 192 byte child, to reach 10 per byte
+	fee, err := childFee(400, 200, 192, 10)
+	if err != nil || fee != 3520 {
+		t.Fail()
+	}
+	if _, err := childFee(2000, 200, 192, 10); err == nil {
+		t.Fail()
+	}
+}
+
+func TestChildPaysForParent(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	tracker := NewBroadcastTracker(testDB, txmgr, DefaultBroadcastPolicy())
+	tracker.push = func(txBytes []byte) (string, error) {
+		return "cpfpChild", nil
+	}
+	tracker.get = func(ctx context.Context, url string) (*http.Response, error) {
+		body := `{"status": "success", "data": {"confirmations": 0, "fee": "0.00000400", "size": 200}}`
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	pk, _ := btcec.NewPrivateKey(btcec.S256())
+	address, _ := btcutil.NewAddressPubKey(pk.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	script, _ := txmgr.makePayToPubkeyHashScript(address.EncodeAddress())
+	parent := "bb631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9"
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		address.EncodeAddress(): &AddressBalanceMapping{
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{Tx: parent, Idx: 1, Script: hex.EncodeToString(script), Amount: "0.001"},
+			},
+		},
+	}
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		return pk, nil
+	}
+
+	txid, err := tracker.ChildPaysForParent(context.Background(), parent, address.EncodeAddress(), 10, keys)
+	if err != nil || txid != "cpfpChild" {
+		t.Fatal(err)
+	}
+	child, _ := tracker.Get("cpfpChild")
+	raw, _ := child.Raw()
+	tx := wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(raw))
+	if len(tx.TxIn) != 1 || tx.TxIn[0].PreviousOutPoint.Index != 1 || len(tx.TxOut) != 1 {
+		t.FailNow()
+	}
+	expectedFee, _ := childFee(400, 200, TX_OVERHEAD_SIZE+P2PKH_INPUT_SIZE+P2PKH_OUTPUT_SIZE, 10)
+	if child.Fee != expectedFee || tx.TxOut[0].Value != 100000-expectedFee {
+		t.Fail()
+	}
+
+	// Nothing of another transaction pays the address
+	if _, err := tracker.ChildPaysForParent(context.Background(), "cpfpOther", address.EncodeAddress(), 10, keys); err == nil {
+		t.Fail()
+	}
+}
+
+func TestChildPaysForOwnParent(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	tracker := NewBroadcastTracker(testDB, txmgr, DefaultBroadcastPolicy())
+	tracker.push = func(txBytes []byte) (string, error) {
+		return "cpfpOwnChild", nil
+	}
+
+	pk, _ := btcec.NewPrivateKey(btcec.S256())
+	address, _ := btcutil.NewAddressPubKey(pk.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	script, _ := txmgr.makePayToPubkeyHashScript(address.EncodeAddress())
+	parent := "bc631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9"
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		address.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{Tx: parent, Idx: 1, Script: hex.EncodeToString(script), Amount: "0.001"},
+			},
+		},
+	}
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		return pk, nil
+	}
+	tracker.Track(parent, make([]byte, 200), 400, time.Now())
+
+	// The fee comes out of funds the reserves already hold
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(address.EncodeAddress(), 100000)
+	if _, err := tracker.ChildPaysForParent(context.Background(), parent, address.EncodeAddress(), 10, keys); err == nil {
+		t.Fail()
+	}
+	txmgr.reserveInstance.AdjustReserve(address.EncodeAddress(), reserve, -90000, nil)
+
+	// A parent that was replaced is not ours to accelerate anymore
+	testDB.Model(&BroadcastTransaction{}).Where("txid = ?", parent).Update("status", BROADCAST_REPLACED)
+	if _, err := tracker.ChildPaysForParent(context.Background(), parent, address.EncodeAddress(), 10, keys); err == nil {
+		t.Fail()
+	}
+
+	testDB.Model(&BroadcastTransaction{}).Where("txid = ?", parent).Update("status", BROADCAST_PENDING)
+	txid, err := tracker.ChildPaysForParent(context.Background(), parent, address.EncodeAddress(), 10, keys)
+	if err != nil || txid != "cpfpOwnChild" {
+		t.Fatal(err)
+	}
+}
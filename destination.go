@@ -0,0 +1,110 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const BIP21_SCHEME = "bitcoin"
+
+// NetParams is the network every address handled by the wallet must be on.
+var NetParams = &chaincfg.MainNetParams
+
+// SpendOutput is one payment made by a spend.
+type SpendOutput struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// DecodeDestination parses an address the wallet is able to pay to: it
+// must be on NetParams and use a standard script type.
+func DecodeDestination(address string) (btcutil.Address, error) {
+	decoded, err := btcutil.DecodeAddress(address, NetParams)
+	if err != nil {
+		return nil, err
+	}
+	if !decoded.IsForNet(NetParams) {
+		return nil, errors.New(fmt.Sprintf("Address %s is not on %s", address, NetParams.Name))
+	}
+
+	switch decoded.(type) {
+	case *btcutil.AddressPubKeyHash, *btcutil.AddressScriptHash,
+		*btcutil.AddressWitnessPubKeyHash, *btcutil.AddressWitnessScriptHash:
+		return decoded, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Address %s has an unsupported script type", address))
+}
+
+func makeOutputScript(address string) ([]byte, error) {
+	decoded, err := DecodeDestination(address)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(decoded)
+}
+
+// ParseBTCAmount converts a decimal amount of bitcoin, such as "0.015",
+// to satoshis without going through floating point.
+func ParseBTCAmount(amount string) (int64, error) {
+	parts := strings.SplitN(amount, ".", 2)
+	whole, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return -1, errors.New("Amount is invalid")
+	}
+
+	var fraction uint64
+	if len(parts) == 2 {
+		digits := parts[1]
+		if len(digits) == 0 || len(digits) > 8 {
+			return -1, errors.New("Amount is invalid")
+		}
+		digits += strings.Repeat("0", 8-len(digits))
+		fraction, err = strconv.ParseUint(digits, 10, 32)
+		if err != nil {
+			return -1, errors.New("Amount is invalid")
+		}
+	}
+	return int64(whole)*SATOSHI_IN_BITCOIN + int64(fraction), nil
+}
+
+// ParsePaymentURI decodes a BIP21 URI such as
+// "bitcoin:1BoatSLRHtKNngkdXEeobR76b53LETtpyT?amount=0.5". The Amount of the
+// returned output is 0 when the URI does not ask for one.
+func ParsePaymentURI(uri string) (*SpendOutput, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(parsed.Scheme, BIP21_SCHEME) {
+		return nil, errors.New("Not a bitcoin URI")
+	}
+
+	address := parsed.Opaque
+	if address == "" {
+		address = parsed.Host
+	}
+	if _, err := DecodeDestination(address); err != nil {
+		return nil, err
+	}
+
+	output := &SpendOutput{Address: address}
+	for key, values := range parsed.Query() {
+		switch {
+		case key == "amount":
+			output.Amount, err = ParseBTCAmount(values[0])
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(key, "req-"):
+			// BIP21 requires refusing URIs with unknown required parameters
+			return nil, errors.New("Unsupported required parameter " + key)
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,57 @@
+package wallet
+
+import "testing"
+
+func TestParseBTCAmount(t *testing.T) {
+	var amountTests = []struct {
+		amount   string
+		satoshis int64
+		valid    bool
+	}{
+		{"1", 100000000, true},
+		{"0.5", 50000000, true},
+		{"0.00000001", 1, true},
+		{"20.3", 2030000000, true},
+		{"0.000000001", 0, false},
+		{"-1", 0, false},
+		{"1.", 0, false},
+		{"abc", 0, false},
+	}
+
+	for _, test := range amountTests {
+		res, err := ParseBTCAmount(test.amount)
+		if (err == nil) != test.valid {
+			t.Log(test.amount)
+			t.Fail()
+		}
+		if test.valid && res != test.satoshis {
+			t.Log(test.amount, res)
+			t.Fail()
+		}
+	}
+}
+
+func TestParsePaymentURI(t *testing.T) {
+	output, err := ParsePaymentURI("bitcoin:1BoatSLRHtKNngkdXEeobR76b53LETtpyT?amount=0.5&label=Boat")
+	if err != nil || output.Address != "1BoatSLRHtKNngkdXEeobR76b53LETtpyT" || output.Amount != 50000000 {
+		t.Fail()
+	}
+
+	output, err = ParsePaymentURI("bitcoin:3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy")
+	if err != nil || output.Amount != 0 {
+		t.Fail()
+	}
+
+	if _, err := ParsePaymentURI("bitcoin:1BoatSLRHtKNngkdXEeobR76b53LETtpyT?req-somethingyoudontunderstand=50"); err == nil {
+		t.Fail()
+	}
+
+	// Testnet address on a mainnet wallet
+	if _, err := ParsePaymentURI("bitcoin:mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"); err == nil {
+		t.Fail()
+	}
+
+	if _, err := ParsePaymentURI("litecoin:LVg2kJoFNg45Nbpy53h7Fe1wKyeXVRhMH9"); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,333 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/satori/go.uuid"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_DEPOSIT_SEEN      = "deposit.seen"
+	EVENT_DEPOSIT_CONFIRMED = "deposit.confirmed"
+	EVENT_UTXO_SPENT        = "utxo.spent"
+	EVENT_BALANCE_CHANGED   = "balance.changed"
+	// One of our transactions reached a confirmation threshold
+	EVENT_TX_CONFIRMED = "tx.confirmed"
+	// A spend is being cancelled, its txid replaced by the cancelling one
+	EVENT_SPEND_CANCELLING = "spend.cancelling"
+	// Followed by the kind of the reserve event, e.g. reserve.spent
+	EVENT_RESERVE_PREFIX = "reserve."
+)
+
+// IsEventKind tells whether kind names an event the wallet records.
+func IsEventKind(kind string) bool {
+	switch kind {
+	case EVENT_DEPOSIT_SEEN, EVENT_DEPOSIT_CONFIRMED, EVENT_UTXO_SPENT,
+		EVENT_BALANCE_CHANGED, EVENT_TX_CONFIRMED, EVENT_SPEND_CANCELLING:
+		return true
+	}
+	switch strings.TrimPrefix(kind, EVENT_RESERVE_PREFIX) {
+	case RESERVE_EVENT_CREATED, RESERVE_EVENT_SPENT, RESERVE_EVENT_INCREASED,
+		RESERVE_EVENT_DECREASED, RESERVE_EVENT_REVERTED, RESERVE_EVENT_REPLACED,
+		RESERVE_EVENT_CANCELLED:
+		return strings.HasPrefix(kind, EVENT_RESERVE_PREFIX)
+	}
+	return false
+}
+
+// Deposits get a deposit.confirmed event when they reach each of these
+// confirmation counts.
+var DEFAULT_CONFIRMATION_THRESHOLDS = []int{1, 6}
+
+// WalletEvent is something that happened to a monitored address. Events
+// are written to this table, the outbox, before anything is delivered, so
+// they survive restarts.
+type WalletEvent struct {
+	gorm.Model
+	Uuid          string
+	Kind          string
+	Address       string
+	Txid          string
+	Outpoint      string
+	Amount        int64
+	Confirmations int
+	// The reserve a reserve event is about, or the cancelling transaction
+	// of a spend.cancelling event
+	Reference string
+	// Keeps the same event from being recorded twice
+	DedupKey string `gorm:"unique_index"`
+}
+
+// EventPayload is how an event is presented to its consumers.
+type EventPayload struct {
+	Id            string    `json:"id"`
+	Cursor        uint      `json:"cursor"`
+	Kind          string    `json:"type"`
+	Address       string    `json:"address"`
+	Txid          string    `json:"txid,omitempty"`
+	Outpoint      string    `json:"outpoint,omitempty"`
+	Amount        int64     `json:"amount"`
+	Confirmations int       `json:"confirmations"`
+	Reference     string    `json:"reference,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (we *WalletEvent) Payload() EventPayload {
+	return EventPayload{
+		Id:            we.Uuid,
+		Cursor:        we.ID,
+		Kind:          we.Kind,
+		Address:       we.Address,
+		Txid:          we.Txid,
+		Outpoint:      we.Outpoint,
+		Amount:        we.Amount,
+		Confirmations: we.Confirmations,
+		Reference:     we.Reference,
+		CreatedAt:     we.CreatedAt,
+	}
+}
+
+// EventRecorder turns what the monitor sees into events and queues them
+// for every webhook interested in them.
+type EventRecorder struct {
+	sync.Mutex
+	db         *gorm.DB
+	journal    *Journal
+	monitor    *UnspentTransactionMonitor
+	thresholds []int
+	// Closed and replaced whenever an event is recorded
+	changed chan struct{}
+}
+
+func NewEventRecorder(localDb *gorm.DB) *EventRecorder {
+	return &EventRecorder{
+		db:         localDb,
+		thresholds: DEFAULT_CONFIRMATION_THRESHOLDS,
+		changed:    make(chan struct{}),
+	}
+}
+
+// SetMonitor makes the recorder report balance changes seen by monitor.
+func (er *EventRecorder) SetMonitor(monitor *UnspentTransactionMonitor) {
+	er.monitor = monitor
+}
+
+// Changed returns a channel closed the next time an event is recorded.
+func (er *EventRecorder) Changed() <-chan struct{} {
+	er.Lock()
+	defer er.Unlock()
+	return er.changed
+}
+
+func (er *EventRecorder) notify() {
+	er.Lock()
+	defer er.Unlock()
+	close(er.changed)
+	er.changed = make(chan struct{})
+}
+
+// Since lists the events of address recorded after cursor, oldest first.
+func (er *EventRecorder) Since(address string, cursor uint, limit int) ([]*WalletEvent, error) {
+	var events []*WalletEvent
+	err := er.db.Where(
+		"address = ? AND id > ?", address, cursor,
+	).Order("id").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// SetJournal lets the recorder tell our own change outputs apart from
+// deposits.
+func (er *EventRecorder) SetJournal(journal *Journal) {
+	er.journal = journal
+}
+
+func (er *EventRecorder) SetConfirmationThresholds(thresholds []int) {
+	er.thresholds = thresholds
+}
+
+// Subscribe makes the recorder record the UTXO changes, the confirmations
+// of our own transactions and the cancellations published on bus.
+func (er *EventRecorder) Subscribe(bus *EventBus) {
+	bus.SubscribeUTXOChanges(er.HandleUTXOChange)
+	bus.Subscribe(TxConfirmed{}, func(ctx context.Context, event Event) {
+		if err := er.HandleTxConfirmed(event.(TxConfirmed)); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(SpendCancelling{}, func(ctx context.Context, event Event) {
+		if err := er.HandleSpendCancelling(event.(SpendCancelling)); err != nil {
+			Error.Println(err)
+		}
+	})
+}
+
+// HandleSpendCancelling records a spend.cancelling event for the address
+// whose spend is being cancelled.
+func (er *EventRecorder) HandleSpendCancelling(cancelling SpendCancelling) error {
+	return er.Record(&WalletEvent{
+		Kind:      EVENT_SPEND_CANCELLING,
+		Address:   cancelling.Address,
+		Txid:      cancelling.Txid,
+		Amount:    cancelling.Amount,
+		Reference: cancelling.CancelTxid,
+		DedupKey:  EVENT_SPEND_CANCELLING + ":" + cancelling.Txid,
+	})
+}
+
+// HandleTxConfirmed records a tx.confirmed event for every threshold the
+// transaction reached.
+func (er *EventRecorder) HandleTxConfirmed(confirmed TxConfirmed) error {
+	event := WalletEvent{
+		Address:       confirmed.Address,
+		Txid:          confirmed.Txid,
+		Confirmations: confirmed.Confirmations,
+	}
+	return er.recordConfirmations(event, EVENT_TX_CONFIRMED, confirmed.Txid)
+}
+
+// HandleUTXOChange records the events for a change. Outputs of our own
+// transactions are left to HandleTxConfirmed.
+func (er *EventRecorder) HandleUTXOChange(change UTXOChange) {
+	item := change.Item
+	event := WalletEvent{
+		Address:       change.Address,
+		Txid:          item.Tx,
+		Outpoint:      item.Outpoint(),
+		Amount:        item.Satoshis(),
+		Confirmations: item.Confirmations,
+	}
+
+	var err error
+	switch change.Kind {
+	case UTXO_ADDED, UTXO_UPDATED:
+		if er.journal != nil && er.journal.isOwnTransaction(item.Tx) {
+			break
+		}
+		event.Kind = EVENT_DEPOSIT_SEEN
+		event.DedupKey = EVENT_DEPOSIT_SEEN + ":" + event.Outpoint
+		if err = er.Record(&event); err != nil {
+			break
+		}
+		err = er.recordConfirmations(event, EVENT_DEPOSIT_CONFIRMED, event.Outpoint)
+	case UTXO_REMOVED:
+		event.Kind = EVENT_UTXO_SPENT
+		event.DedupKey = EVENT_UTXO_SPENT + ":" + event.Outpoint
+		err = er.Record(&event)
+	}
+	if err != nil {
+		Error.Println(err)
+	}
+	if err := er.recordBalance(change.Address); err != nil {
+		Error.Println(err)
+	}
+}
+
+// recordConfirmations records a kind event for every confirmation
+// threshold event reached, once per subject.
+func (er *EventRecorder) recordConfirmations(event WalletEvent, kind, subject string) error {
+	for _, threshold := range er.thresholds {
+		if event.Confirmations < threshold {
+			continue
+		}
+		confirmed := event
+		confirmed.Model = gorm.Model{}
+		confirmed.Uuid = ""
+		confirmed.Kind = kind
+		confirmed.DedupKey = fmt.Sprintf("%s:%s:%d", kind, subject, threshold)
+		if err := er.Record(&confirmed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordBalance records the balance of address when it differs from the
+// last one recorded.
+func (er *EventRecorder) recordBalance(address string) error {
+	if er.monitor == nil {
+		return nil
+	}
+	details, err := er.monitor.GetBalanceDetailsForAddress(address)
+	if err != nil {
+		return nil
+	}
+
+	var last WalletEvent
+	err = er.db.Where(
+		"address = ? AND kind = ?", address, EVENT_BALANCE_CHANGED,
+	).Order("id desc").First(&last).Error
+	if err == nil && last.Amount == details.Balance {
+		return nil
+	}
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	return er.Record(&WalletEvent{
+		Kind:    EVENT_BALANCE_CHANGED,
+		Address: address,
+		Amount:  details.Balance,
+	})
+}
+
+// Record stores event in the outbox along with a delivery for each webhook
+// subscribed to it. An event whose DedupKey was already recorded is
+// skipped.
+func (er *EventRecorder) Record(event *WalletEvent) error {
+	tx := er.db.Begin()
+	if err := er.record(tx, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	er.notify()
+	return nil
+}
+
+// record is Record inside the database transaction tx, so that events are
+// only recorded if what they describe is committed.
+func (er *EventRecorder) record(tx *gorm.DB, event *WalletEvent) error {
+	if event.DedupKey != "" {
+		var count int
+		tx.Model(&WalletEvent{}).Where("dedup_key = ?", event.DedupKey).Count(&count)
+		if count > 0 {
+			return nil
+		}
+	}
+	if event.Uuid == "" {
+		event.Uuid = uuid.NewV4().String()
+	}
+	if event.DedupKey == "" {
+		event.DedupKey = event.Uuid
+	}
+
+	var webhooks []*Webhook
+	if err := tx.Where("active = ?", true).Find(&webhooks).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Create(event).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, webhook := range webhooks {
+		if !webhook.Accepts(event.Kind) {
+			continue
+		}
+		err := tx.Create(&WebhookDelivery{
+			EventID:       event.ID,
+			WebhookID:     webhook.ID,
+			Status:        DELIVERY_PENDING,
+			NextAttemptAt: now,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package wallet
+
+import (
+	"testing"
+)
+
+func countEvents(kind, address string) int {
+	var count int
+	testDB.Model(&WalletEvent{}).Where("kind = ? AND address = ?", kind, address).Count(&count)
+	return count
+}
+
+func TestEventRecorder(t *testing.T) {
+	recorder := NewEventRecorder(testDB)
+	webhooks := NewWebhookService(testDB)
+	deposits, err := webhooks.Register("http://localhost/deposits", "", []string{EVENT_DEPOSIT_SEEN})
+	if err != nil {
+		t.FailNow()
+	}
+
+	deposit := BlockrUnspentItem{
+		Tx:     "3f4fa19803dec4d6a84fae3821da7ac7577080ef75451294e71f9b20e0ab1e7b",
+		Amount: "0.5",
+	}
+	recorder.HandleUTXOChange(UTXOChange{UTXO_ADDED, "eventAddress", deposit, false})
+	// Seeing the same output again does not record it twice
+	recorder.HandleUTXOChange(UTXOChange{UTXO_ADDED, "eventAddress", deposit, false})
+	if countEvents(EVENT_DEPOSIT_SEEN, "eventAddress") != 1 {
+		t.Fail()
+	}
+	if countEvents(EVENT_DEPOSIT_CONFIRMED, "eventAddress") != 0 {
+		t.Fail()
+	}
+
+	// Jumping past both thresholds confirms it twice
+	deposit.Confirmations = 7
+	recorder.HandleUTXOChange(UTXOChange{UTXO_UPDATED, "eventAddress", deposit, true})
+	recorder.HandleUTXOChange(UTXOChange{UTXO_UPDATED, "eventAddress", deposit, true})
+	if countEvents(EVENT_DEPOSIT_CONFIRMED, "eventAddress") != 2 {
+		t.Fail()
+	}
+
+	recorder.HandleUTXOChange(UTXOChange{UTXO_REMOVED, "eventAddress", deposit, false})
+	if countEvents(EVENT_UTXO_SPENT, "eventAddress") != 1 {
+		t.Fail()
+	}
+
+	// Only the event the webhook subscribed to is queued for it
+	var count int
+	testDB.Model(&WebhookDelivery{}).Where("webhook_id = ?", deposits.ID).Count(&count)
+	if count != 1 {
+		t.Fail()
+	}
+	webhooks.Remove(deposits.Uuid)
+}
+
+func TestEventsSinceCursor(t *testing.T) {
+	recorder := NewEventRecorder(testDB)
+	reserves := NewReserverService(testDB)
+	reserves.SetEventRecorder(recorder)
+
+	changed := recorder.Changed()
+	err := recorder.Record(&WalletEvent{Kind: EVENT_BALANCE_CHANGED, Address: "streamAddress", Amount: 1000})
+	if err != nil {
+		t.FailNow()
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fail()
+	}
+
+	reserveId, err := reserves.AddReserveForAddress("streamAddress", 500)
+	if err != nil {
+		t.FailNow()
+	}
+
+	events, err := recorder.Since("streamAddress", 0, 10)
+	if err != nil || len(events) != 2 {
+		t.FailNow()
+	}
+	if events[1].Kind != EVENT_RESERVE_PREFIX+RESERVE_EVENT_CREATED || events[1].Reference != reserveId {
+		t.Fail()
+	}
+
+	// Resuming after the first event only returns the second one
+	events, _ = recorder.Since("streamAddress", events[0].ID, 10)
+	if len(events) != 1 || events[0].Reference != reserveId {
+		t.Fail()
+	}
+	if !IsEventKind(EVENT_RESERVE_PREFIX+RESERVE_EVENT_SPENT) || IsEventKind("reserve.unknown") {
+		t.Fail()
+	}
+}
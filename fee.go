@@ -0,0 +1,67 @@
+package wallet
+
+import (
+	"errors"
+)
+
+// FeePolicy tells who pays the fee of a spend.
+type FeePolicy string
+
+const (
+	// The destination receives the full amount and the fee is paid on
+	// top of it out of the funds of the spending address
+	FEE_SENDER_PAYS FeePolicy = "sender"
+	// The fee is taken out of the amount, the destination receives less
+	FEE_RECIPIENT_PAYS FeePolicy = "recipient"
+
+	DEFAULT_FEE_POLICY = FEE_SENDER_PAYS
+)
+
+// ParseFeePolicy reads a policy, DEFAULT_FEE_POLICY when empty.
+func ParseFeePolicy(policy string) (FeePolicy, error) {
+	switch FeePolicy(policy) {
+	case "":
+		return DEFAULT_FEE_POLICY, nil
+	case FEE_SENDER_PAYS, FEE_RECIPIENT_PAYS:
+		return FeePolicy(policy), nil
+	}
+	return "", errors.New("Fee policy is invalid")
+}
+
+// deductedShares is how much of its fee share each output gives up: all of
+// it when the recipient pays, nothing when the sender does.
+func deductedShares(shares []int64, policy FeePolicy) []int64 {
+	deducted := make([]int64, len(shares))
+	if policy == FEE_RECIPIENT_PAYS {
+		copy(deducted, shares)
+	}
+	return deducted
+}
+
+// freeFunds is the part of the balance of address no reserve holds.
+func (tm *TransactionManager) freeFunds(address string) int64 {
+	onChain, _ := tm.unspentTransactionMonitorInstance.GetUTXOBalanceForAddress(address)
+	if tm.ledger != nil {
+		net, err := tm.ledger.NetForAddress(address)
+		if err != nil {
+			// Nothing is free until the ledger can tell
+			Error.Println(err)
+			return 0
+		}
+		onChain += net
+	}
+	return onChain - tm.reserveInstance.GetAmountReservedForAddress(address)
+}
+
+// builtSpend is a signed spend and what it costs besides its payments.
+type builtSpend struct {
+	txBytes     []byte
+	settlements []Debtor
+	// Paid to the miners, change too small for an output included
+	fee int64
+	// Taken out of the funds of each address rather than its reserves:
+	// the fee when the sender pays it and change left to the fee
+	fromFunds map[string]int64
+	// Change left to the fee, by address
+	dust map[string]int64
+}
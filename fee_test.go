@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"testing"
+)
+
+func TestParseFeePolicy(t *testing.T) {
+	if policy, err := ParseFeePolicy(""); err != nil || policy != DEFAULT_FEE_POLICY {
+		t.Fail()
+	}
+	if policy, err := ParseFeePolicy("recipient"); err != nil || policy != FEE_RECIPIENT_PAYS {
+		t.Fail()
+	}
+	if _, err := ParseFeePolicy("nobody"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestSenderPaysFee(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+
+	pk, _ := btcec.NewPrivateKey(btcec.S256())
+	address, _ := btcutil.NewAddressPubKey(pk.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	script, _ := txmgr.makePayToPubkeyHashScript(address.EncodeAddress())
+	destination, _ := makeOutputScript("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		address.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "ee631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(script),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(address.EncodeAddress(), 60000000)
+
+	// The destination gets the whole amount, the fee comes out of the change
+	spend, err := txmgr.buildTransactionForOutputs(address.EncodeAddress(), reserve, pk, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 60000000},
+	}, FEE_SENDER_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(spend.txBytes))
+	if len(tx.TxOut) != 2 || !bytes.Equal(tx.TxOut[0].PkScript, destination) || tx.TxOut[0].Value != 60000000 {
+		t.FailNow()
+	}
+	if tx.TxOut[1].Value != 40000000-BTC_FEE_IN_SATOSHIS {
+		t.Fail()
+	}
+	if spend.fee != BTC_FEE_IN_SATOSHIS || spend.fromFunds[address.EncodeAddress()] != BTC_FEE_IN_SATOSHIS {
+		t.Fail()
+	}
+
+	// When the recipient pays, the destination gets less
+	spend, err = txmgr.buildTransactionForOutputs(address.EncodeAddress(), reserve, pk, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 60000000},
+	}, FEE_RECIPIENT_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(spend.txBytes))
+	if tx.TxOut[0].Value != 60000000-BTC_FEE_IN_SATOSHIS || len(spend.fromFunds) != 0 {
+		t.Fail()
+	}
+
+	// Without free funds, the sender cannot pay the fee
+	full, _ := txmgr.reserveInstance.AddReserveForAddress(address.EncodeAddress(), 40000000)
+	_, err = txmgr.buildTransactionForOutputs(address.EncodeAddress(), full, pk, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 40000000},
+	}, FEE_SENDER_PAYS)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestReserveFee(t *testing.T) {
+	rs := NewReserverService(testDB)
+	reserveId, _ := rs.AddReserveForAddress("feeAddress", 1000)
+
+	if err := rs.SpendReserve("feeAddress", reserveId, 400, 30, "feeTx1"); err != nil {
+		t.FailNow()
+	}
+	if err := rs.ReplaceSpendTxid("feeTx1", "feeTx2", 20); err != nil {
+		t.FailNow()
+	}
+	res, err := rs.GetReserve("feeAddress", reserveId)
+	if err != nil || res.Fee != 50 {
+		t.FailNow()
+	}
+
+	if err := rs.RevertSpend("feeTx2"); err != nil {
+		t.FailNow()
+	}
+	res, _ = rs.GetReserve("feeAddress", reserveId)
+	if res.Fee != 0 || res.Remaining != 1000 {
+		t.Fail()
+	}
+
+	// A second undo gives nothing back
+	if given, err := rs.CancelSpend("feeTx2"); err != nil || given != 0 {
+		t.Fail()
+	}
+	res, _ = rs.GetReserve("feeAddress", reserveId)
+	if res.Remaining != 1000 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,276 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	HISTORY_INCOMING = "incoming"
+	HISTORY_OUTGOING = "outgoing"
+
+	DEFAULT_HISTORY_LIMIT = 50
+	MAX_HISTORY_LIMIT     = 500
+)
+
+// Payment is one output of a transaction we broadcast, paid out of a
+// reserve. Amount includes the share of the fee the output paid, whoever
+// paid it.
+type Payment struct {
+	Address     string
+	Reserve     string
+	Destination string
+	Amount      int64
+	Fee         int64
+}
+
+// feeShares splits the fee equally between count outputs, the first one
+// paying what does not divide evenly.
+func feeShares(count int) []int64 {
+	shares := make([]int64, count)
+	if count == 0 {
+		return shares
+	}
+	share := int64(BTC_FEE_IN_SATOSHIS) / int64(count)
+	for idx := range shares {
+		shares[idx] = share
+	}
+	shares[0] += int64(BTC_FEE_IN_SATOSHIS) - share*int64(count)
+	return shares
+}
+
+// paymentsFor describes the outputs address pays out of reserve.
+func paymentsFor(address, reserve string, outputs []SpendOutput, policy FeePolicy) []Payment {
+	shares := feeShares(len(outputs))
+	payments := make([]Payment, len(outputs))
+	for idx, output := range outputs {
+		amount := output.Amount
+		if policy == FEE_SENDER_PAYS {
+			amount += shares[idx]
+		}
+		payments[idx] = Payment{address, reserve, output.Address, amount, shares[idx]}
+	}
+	return payments
+}
+
+// TransactionRecord is one entry of the history of an account: a deposit
+// it received or a payment it made. The sender of a deposit is not known,
+// so Counterparty is only set on payments.
+type TransactionRecord struct {
+	gorm.Model
+	Address       string `gorm:"index"`
+	Direction     string
+	Txid          string `gorm:"index"`
+	Outpoint      string
+	Amount        int64
+	Fee           int64
+	Counterparty  string
+	Confirmations int
+	ReserveUuid   string
+	// Keeps the same deposit or payment from being recorded twice
+	DedupKey string `gorm:"unique_index"`
+}
+
+type TransactionPayload struct {
+	Cursor        uint      `json:"cursor"`
+	Direction     string    `json:"direction"`
+	Txid          string    `json:"txid"`
+	Outpoint      string    `json:"outpoint,omitempty"`
+	Amount        int64     `json:"amount"`
+	Fee           int64     `json:"fee"`
+	Counterparty  string    `json:"counterparty,omitempty"`
+	Confirmations int       `json:"confirmations"`
+	ReserveId     string    `json:"reserve_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (tr *TransactionRecord) Payload() TransactionPayload {
+	return TransactionPayload{
+		Cursor:        tr.ID,
+		Direction:     tr.Direction,
+		Txid:          tr.Txid,
+		Outpoint:      tr.Outpoint,
+		Amount:        tr.Amount,
+		Fee:           tr.Fee,
+		Counterparty:  tr.Counterparty,
+		Confirmations: tr.Confirmations,
+		ReserveId:     tr.ReserveUuid,
+		CreatedAt:     tr.CreatedAt,
+	}
+}
+
+// HistoryFilter selects the records of an account. Zero fields match
+// everything.
+type HistoryFilter struct {
+	Direction        string
+	Reserve          string
+	MinConfirmations int
+	Since            time.Time
+	Until            time.Time
+	// Only records older than the one with this cursor
+	Cursor uint
+	Limit  int
+}
+
+// TransactionHistory keeps the history of every account from the events
+// of the monitor and the transaction manager.
+type TransactionHistory struct {
+	db *gorm.DB
+}
+
+func NewTransactionHistory(localDb *gorm.DB) *TransactionHistory {
+	return &TransactionHistory{
+		db: localDb,
+	}
+}
+
+// Subscribe makes the history record what is published on bus.
+func (th *TransactionHistory) Subscribe(bus *EventBus) {
+	bus.Subscribe(TxBroadcast{}, func(ctx context.Context, event Event) {
+		if err := th.HandleTxBroadcast(event.(TxBroadcast)); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(TxConfirmed{}, func(ctx context.Context, event Event) {
+		if err := th.HandleTxConfirmed(event.(TxConfirmed)); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(TxReplaced{}, func(ctx context.Context, event Event) {
+		if err := th.HandleTxReplaced(event.(TxReplaced)); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(SpendCancelling{}, func(ctx context.Context, event Event) {
+		if err := th.HandleSpendCancelling(event.(SpendCancelling)); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.Subscribe(SpendCancelled{}, func(ctx context.Context, event Event) {
+		if err := th.HandleSpendCancelled(event.(SpendCancelled)); err != nil {
+			Error.Println(err)
+		}
+	})
+	bus.SubscribeUTXOChanges(th.HandleUTXOChange)
+}
+
+// HandleTxBroadcast records every payment of a transaction we broadcast.
+func (th *TransactionHistory) HandleTxBroadcast(event TxBroadcast) error {
+	tx := th.db.Begin()
+	for idx, payment := range event.Payments {
+		err := th.create(tx, &TransactionRecord{
+			Address:      payment.Address,
+			Direction:    HISTORY_OUTGOING,
+			Txid:         event.Txid,
+			Amount:       payment.Amount,
+			Fee:          payment.Fee,
+			Counterparty: payment.Destination,
+			ReserveUuid:  payment.Reserve,
+			DedupKey:     fmt.Sprintf("%s:%s:%d", HISTORY_OUTGOING, event.Txid, idx),
+		})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (th *TransactionHistory) create(tx *gorm.DB, record *TransactionRecord) error {
+	var count int
+	tx.Model(&TransactionRecord{}).Where("dedup_key = ?", record.DedupKey).Count(&count)
+	if count > 0 {
+		return nil
+	}
+	return tx.Create(record).Error
+}
+
+func (th *TransactionHistory) HandleTxConfirmed(event TxConfirmed) error {
+	return th.db.Model(&TransactionRecord{}).Where(
+		"txid = ? AND direction = ?", event.Txid, HISTORY_OUTGOING,
+	).Update("confirmations", event.Confirmations).Error
+}
+
+// isOwnTransaction tells whether txid paid out of one of our accounts, so
+// that its change is not mistaken for a deposit.
+func (th *TransactionHistory) isOwnTransaction(txid string) bool {
+	var count int
+	th.db.Model(&TransactionRecord{}).Where(
+		"txid = ? AND direction = ?", txid, HISTORY_OUTGOING,
+	).Count(&count)
+	return count > 0
+}
+
+// HandleUTXOChange records deposits and keeps their confirmations up to
+// date. A reorg can take confirmations away as well.
+func (th *TransactionHistory) HandleUTXOChange(change UTXOChange) {
+	item := change.Item
+	if change.Kind == UTXO_REMOVED || th.isOwnTransaction(item.Tx) {
+		return
+	}
+
+	dedupKey := HISTORY_INCOMING + ":" + item.Outpoint()
+	var record TransactionRecord
+	err := th.db.Where("dedup_key = ?", dedupKey).First(&record).Error
+	if err == gorm.ErrRecordNotFound {
+		err = th.db.Create(&TransactionRecord{
+			Address:       change.Address,
+			Direction:     HISTORY_INCOMING,
+			Txid:          item.Tx,
+			Outpoint:      item.Outpoint(),
+			Amount:        item.Satoshis(),
+			Confirmations: item.Confirmations,
+			DedupKey:      dedupKey,
+		}).Error
+	} else if err == nil && record.Confirmations != item.Confirmations {
+		err = th.db.Model(&record).Update("confirmations", item.Confirmations).Error
+	}
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+// ForAddress lists the records of address matching filter, newest first,
+// along with the cursor of the next page, 0 on the last one.
+func (th *TransactionHistory) ForAddress(address string, filter HistoryFilter) ([]*TransactionRecord, uint, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_HISTORY_LIMIT
+	}
+	if limit > MAX_HISTORY_LIMIT {
+		limit = MAX_HISTORY_LIMIT
+	}
+
+	query := th.db.Where("address = ?", address)
+	if filter.Direction != "" {
+		query = query.Where("direction = ?", filter.Direction)
+	}
+	if filter.Reserve != "" {
+		query = query.Where("reserve_uuid = ?", filter.Reserve)
+	}
+	if filter.MinConfirmations > 0 {
+		query = query.Where("confirmations >= ?", filter.MinConfirmations)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.Cursor > 0 {
+		query = query.Where("id < ?", filter.Cursor)
+	}
+
+	// One more record tells whether there is a next page
+	var records []*TransactionRecord
+	if err := query.Order("id desc").Limit(limit + 1).Find(&records).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(records) <= limit {
+		return records, 0, nil
+	}
+	records = records[:limit]
+	return records, records[limit-1].ID, nil
+}
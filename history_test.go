@@ -0,0 +1,64 @@
+package wallet
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTransactionHistory(t *testing.T) {
+	history := NewTransactionHistory(testDB)
+	bus := NewEventBus()
+	history.Subscribe(bus)
+	ctx := context.Background()
+
+	deposit := BlockrUnspentItem{Tx: "historyDeposit", Idx: 0, Amount: "0.5", Confirmations: 0}
+	bus.Publish(ctx, UTXOAdded{"historyAddress", deposit, false})
+	deposit.Confirmations = 2
+	bus.Publish(ctx, UTXOUpdated{"historyAddress", deposit, true})
+
+	payments := paymentsFor("historyAddress", "historyReserve", []SpendOutput{
+		{Address: "historyDestination", Amount: 100000},
+		{Address: "historyOther", Amount: 50000},
+	}, FEE_RECIPIENT_PAYS)
+	bus.Publish(ctx, TxBroadcast{"historySpend", []string{"historyAddress"}, BTC_FEE_IN_SATOSHIS, payments, nil})
+	bus.Publish(ctx, TxBroadcast{"historySpend", []string{"historyAddress"}, BTC_FEE_IN_SATOSHIS, payments, nil})
+	// The change of our own spend is not a deposit
+	change := BlockrUnspentItem{Tx: "historySpend", Idx: 2, Amount: "0.1", Confirmations: 1}
+	bus.Publish(ctx, UTXOAdded{"historyAddress", change, true})
+	bus.Publish(ctx, TxConfirmed{"historySpend", "historyAddress", 1})
+
+	records, next, err := history.ForAddress("historyAddress", HistoryFilter{})
+	if err != nil || next != 0 || len(records) != 3 {
+		t.FailNow()
+	}
+	if records[0].Counterparty != "historyOther" || records[0].Confirmations != 1 {
+		t.Fail()
+	}
+	if records[0].Fee+records[1].Fee != BTC_FEE_IN_SATOSHIS {
+		t.Fail()
+	}
+	incoming := records[2]
+	if incoming.Direction != HISTORY_INCOMING || incoming.Amount != 50000000 ||
+		incoming.Confirmations != 2 || incoming.Outpoint != deposit.Outpoint() {
+		t.Fail()
+	}
+
+	records, _, _ = history.ForAddress("historyAddress", HistoryFilter{Direction: HISTORY_OUTGOING})
+	if len(records) != 2 || records[1].ReserveUuid != "historyReserve" {
+		t.Fail()
+	}
+	records, _, _ = history.ForAddress("historyAddress", HistoryFilter{MinConfirmations: 2})
+	if len(records) != 1 || records[0].Txid != "historyDeposit" {
+		t.Fail()
+	}
+
+	// Pages follow each other without gaps
+	first, next, _ := history.ForAddress("historyAddress", HistoryFilter{Limit: 2})
+	if len(first) != 2 || next != first[1].ID {
+		t.FailNow()
+	}
+	second, next, _ := history.ForAddress("historyAddress", HistoryFilter{Limit: 2, Cursor: next})
+	if len(second) != 1 || next != 0 || second[0].Txid != "historyDeposit" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,122 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_PENDING   = "pending"
+	IDEMPOTENCY_COMPLETED = "completed"
+
+	// A pending key older than this belongs to a request that never
+	// finished (e.g. the process died) and may be claimed again.
+	IDEMPOTENCY_PENDING_TIMEOUT = time.Minute
+)
+
+var (
+	ErrIdempotencyKeyReused  = errors.New("Idempotency key was already used for a different request")
+	ErrIdempotencyInProgress = errors.New("A request with this idempotency key is still in progress")
+)
+
+// IdempotencyRecord remembers the outcome of a request made with an
+// Idempotency-Key, so that a retry gets back the original response.
+type IdempotencyRecord struct {
+	gorm.Model
+	Scope          string `gorm:"unique_index:idx_idempotency_scope_key"`
+	IdempotencyKey string `gorm:"unique_index:idx_idempotency_scope_key"`
+	RequestHash    string
+	Status         string
+	StatusCode     int
+	Response       string
+}
+
+type IdempotencyService struct {
+	db *gorm.DB
+}
+
+func NewIdempotencyService(localDb *gorm.DB) *IdempotencyService {
+	return &IdempotencyService{
+		db: localDb,
+	}
+}
+
+func HashRequestBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (is *IdempotencyService) find(scope, key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	query := is.db.Where("scope = ? AND idempotency_key = ?", scope, key).First(&record)
+	if query.RecordNotFound() {
+		return nil, nil
+	}
+	if query.Error != nil {
+		return nil, query.Error
+	}
+	return &record, nil
+}
+
+// Begin claims key for a request. It returns (nil, nil) when the caller
+// should go ahead and run the request, or the completed record when the
+// same request already ran and its response should be replayed.
+func (is *IdempotencyService) Begin(scope, key, requestHash string) (*IdempotencyRecord, error) {
+	record, err := is.find(scope, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if record != nil {
+		if record.RequestHash != requestHash {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if record.Status == IDEMPOTENCY_COMPLETED {
+			return record, nil
+		}
+		if time.Since(record.UpdatedAt) < IDEMPOTENCY_PENDING_TIMEOUT {
+			return nil, ErrIdempotencyInProgress
+		}
+
+		// Take over the abandoned request
+		update := is.db.Model(record).Where(
+			"updated_at = ?", record.UpdatedAt,
+		).Update("status", IDEMPOTENCY_PENDING)
+		if update.Error != nil {
+			return nil, update.Error
+		}
+		if update.RowsAffected != 1 {
+			return nil, ErrIdempotencyInProgress
+		}
+		return nil, nil
+	}
+
+	record = &IdempotencyRecord{
+		Scope:          scope,
+		IdempotencyKey: key,
+		RequestHash:    requestHash,
+		Status:         IDEMPOTENCY_PENDING,
+	}
+	if err := is.db.Create(record).Error; err != nil {
+		// Lost the race against a concurrent request with the same key
+		return nil, ErrIdempotencyInProgress
+	}
+	return nil, nil
+}
+
+// Complete stores the response of a request started with Begin.
+func (is *IdempotencyService) Complete(scope, key string, statusCode int, response []byte) error {
+	return is.db.Table(
+		"idempotency_records",
+	).Where(
+		"scope = ? AND idempotency_key = ? AND status = ?", scope, key, IDEMPOTENCY_PENDING,
+	).Updates(map[string]interface{}{
+		"status":      IDEMPOTENCY_COMPLETED,
+		"status_code": statusCode,
+		"response":    string(response),
+		"updated_at":  time.Now(),
+	}).Error
+}
@@ -0,0 +1,38 @@
+package wallet
+
+import "testing"
+
+func TestIdempotencyKeys(t *testing.T) {
+	is := NewIdempotencyService(testDB)
+	hash := HashRequestBody([]byte(`{"Amount": 100}`))
+
+	record, err := is.Begin("POST /accounts/bob/reserve", "key-1", hash)
+	if record != nil || err != nil {
+		t.Fail()
+	}
+
+	_, err = is.Begin("POST /accounts/bob/reserve", "key-1", hash)
+	if err != ErrIdempotencyInProgress {
+		t.Fail()
+	}
+
+	if err := is.Complete("POST /accounts/bob/reserve", "key-1", 200, []byte("response")); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err = is.Begin("POST /accounts/bob/reserve", "key-1", hash)
+	if err != nil || record == nil || record.Response != "response" || record.StatusCode != 200 {
+		t.Fail()
+	}
+
+	_, err = is.Begin("POST /accounts/bob/reserve", "key-1", HashRequestBody([]byte(`{"Amount": 200}`)))
+	if err != ErrIdempotencyKeyReused {
+		t.Fail()
+	}
+
+	// The same key is independent on another endpoint
+	record, err = is.Begin("POST /accounts/alice/reserve", "key-1", hash)
+	if record != nil || err != nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,474 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jinzhu/gorm"
+	"github.com/satori/go.uuid"
+	"strings"
+)
+
+const (
+	// Coins entering or leaving the wallet on-chain
+	JOURNAL_CHAIN = "chain"
+	// Fees paid to miners
+	JOURNAL_FEES = "fees"
+
+	JOURNAL_MEMO_DEPOSIT  = "deposit"
+	JOURNAL_MEMO_RESERVE  = "reserve"
+	JOURNAL_MEMO_SPEND    = "spend"
+	JOURNAL_MEMO_TRANSFER = "transfer"
+	JOURNAL_MEMO_SETTLED  = "settled"
+	JOURNAL_MEMO_REVERSED = "reversed"
+)
+
+// FundsAccount holds the balance of an address that is free to use.
+func FundsAccount(address string) string {
+	return "funds:" + address
+}
+
+// ReservedAccount holds the balance of an address promised to reserves.
+func ReservedAccount(address string) string {
+	return "reserved:" + address
+}
+
+// InFlightAccount holds what an address spent in transactions whose inputs
+// the monitor still sees as unspent.
+func InFlightAccount(address string) string {
+	return "inflight:" + address
+}
+
+// JournalEntry is one line of a posting. Every posting's entries sum to zero.
+type JournalEntry struct {
+	gorm.Model
+	Posting   string
+	Account   string
+	Amount    int64
+	Memo      string
+	Reference string
+}
+
+type Leg struct {
+	Account string
+	Amount  int64
+}
+
+// InFlightSpend is a transaction we broadcast, kept until its inputs
+// disappear from the monitor.
+type InFlightSpend struct {
+	gorm.Model
+	Txid    string
+	Fee     int64
+	Settled bool
+}
+
+// InFlightOutpoint is one of the outputs an InFlightSpend spends.
+type InFlightOutpoint struct {
+	gorm.Model
+	InFlightSpendID uint   `gorm:"index"`
+	Outpoint        string `gorm:"index"`
+}
+
+type Journal struct {
+	db *gorm.DB
+}
+
+func NewJournal(localDb *gorm.DB) *Journal {
+	return &Journal{
+		db: localDb,
+	}
+}
+
+// Post records legs as a single posting. The legs must sum to zero.
+func (j *Journal) Post(memo, reference string, legs ...Leg) error {
+	return j.post(j.db, memo, reference, legs...)
+}
+
+func (j *Journal) post(tx *gorm.DB, memo, reference string, legs ...Leg) error {
+	if len(legs) < 2 {
+		return errors.New("A posting needs at least two legs")
+	}
+	var total int64
+	for _, leg := range legs {
+		total += leg.Amount
+	}
+	if total != 0 {
+		return errors.New("Posting is not balanced")
+	}
+
+	posting := uuid.NewV4().String()
+	for _, leg := range legs {
+		if leg.Amount == 0 {
+			continue
+		}
+		err := tx.Create(&JournalEntry{
+			Posting:   posting,
+			Account:   leg.Account,
+			Amount:    leg.Amount,
+			Memo:      memo,
+			Reference: reference,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postAtomically runs post inside its own database transaction.
+func (j *Journal) postAtomically(memo, reference string, legs ...Leg) error {
+	tx := j.db.Begin()
+	if err := j.post(tx, memo, reference, legs...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (j *Journal) Balance(account string) (int64, error) {
+	var results []struct {
+		Total int64
+	}
+
+	err := j.db.Table(
+		"journal_entries",
+	).Select(
+		"sum(amount) as total",
+	).Where(
+		"account = ? AND deleted_at IS NULL", account,
+	).Scan(&results).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return results[0].Total, nil
+}
+
+func (j *Journal) Balances() (map[string]int64, error) {
+	var results []struct {
+		Account string
+		Total   int64
+	}
+
+	err := j.db.Table(
+		"journal_entries",
+	).Select(
+		"account, sum(amount) as total",
+	).Where(
+		"deleted_at IS NULL",
+	).Group("account").Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make(map[string]int64)
+	for _, result := range results {
+		balances[result.Account] = result.Total
+	}
+	return balances, nil
+}
+
+// TrackInFlight remembers a broadcast transaction so that what it spent is
+// moved out of the wallet once its inputs are gone from the monitor.
+func (j *Journal) TrackInFlight(txid string, txBytes []byte, fee int64) error {
+	tx := wire.NewMsgTx()
+	if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return err
+	}
+
+	db := j.db.Begin()
+	spend := InFlightSpend{
+		Txid: txid,
+		Fee:  fee,
+	}
+	if err := db.Create(&spend).Error; err != nil {
+		db.Rollback()
+		return err
+	}
+	if err := j.recordOutpoints(db, spend.ID, tx); err != nil {
+		db.Rollback()
+		return err
+	}
+	return db.Commit().Error
+}
+
+// recordOutpoints stores the outpoints tx spends as those of the in-flight
+// spend spendID.
+func (j *Journal) recordOutpoints(db *gorm.DB, spendID uint, tx *wire.MsgTx) error {
+	for _, txin := range tx.TxIn {
+		err := db.Create(&InFlightOutpoint{
+			InFlightSpendID: spendID,
+			Outpoint:        txin.PreviousOutPoint.String(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spendsOf finds the in-flight spends spending outpoint.
+func (j *Journal) spendsOf(outpoint string) ([]*InFlightSpend, error) {
+	var outpoints []*InFlightOutpoint
+	if err := j.db.Where("outpoint = ?", outpoint).Find(&outpoints).Error; err != nil {
+		return nil, err
+	}
+	var spends []*InFlightSpend
+	if len(outpoints) == 0 {
+		return spends, nil
+	}
+	ids := make([]uint, 0, len(outpoints))
+	for _, spent := range outpoints {
+		ids = append(ids, spent.InFlightSpendID)
+	}
+	err := j.db.Where("id IN (?)", ids).Find(&spends).Error
+	return spends, err
+}
+
+func (j *Journal) isOwnTransaction(txid string) bool {
+	var count int
+	j.db.Model(&InFlightSpend{}).Where("txid = ?", txid).Count(&count)
+	return count > 0
+}
+
+// Subscribe makes the journal handle the UTXO changes and replaced
+// transactions published on bus.
+func (j *Journal) Subscribe(bus *EventBus) {
+	bus.SubscribeUTXOChanges(j.HandleUTXOChange)
+	bus.Subscribe(TxReplaced{}, func(ctx context.Context, event Event) {
+		replaced := event.(TxReplaced)
+		err := j.ReplaceTransaction(replaced.ReplacedTxid, replaced.Txid, replaced.Raw,
+			replaced.Payer, replaced.Fee, replaced.ExtraFee)
+		if err != nil {
+			Error.Println(err)
+		}
+	})
+}
+
+// HandleUTXOChange posts deposits and settles in-flight spends as the
+// monitor sees outputs appear and disappear. Subscribe connects it to the
+// monitor's events.
+func (j *Journal) HandleUTXOChange(change UTXOChange) {
+	var err error
+	switch change.Kind {
+	case UTXO_ADDED, UTXO_UPDATED:
+		if change.Spendable {
+			err = j.postDeposit(change)
+		} else {
+			// A reorg can take confirmations away from a deposit
+			err = j.reverseDeposit(change)
+		}
+	case UTXO_REMOVED:
+		var spends []*InFlightSpend
+		spends, err = j.spendsOf(change.Item.Outpoint())
+		if err != nil {
+			break
+		}
+		if len(spends) == 0 {
+			// Not spent by us, so the deposit was reorganized away
+			err = j.reverseDeposit(change)
+			break
+		}
+		for _, spend := range spends {
+			if spend.Settled {
+				continue
+			}
+			if err := j.settleInFlight(spend); err != nil {
+				Error.Println(err)
+			}
+		}
+	}
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+func (j *Journal) countPostings(memo, reference string) int {
+	var count int
+	j.db.Model(&JournalEntry{}).Where(
+		"memo = ? AND reference = ?", memo, reference,
+	).Select("count(DISTINCT posting)").Count(&count)
+	return count
+}
+
+// depositPosted tells whether an output is currently counted as a deposit.
+func (j *Journal) depositPosted(outpoint string) bool {
+	return j.countPostings(JOURNAL_MEMO_DEPOSIT, outpoint) > j.countPostings(JOURNAL_MEMO_REVERSED, outpoint)
+}
+
+func (j *Journal) postDeposit(change UTXOChange) error {
+	// Change coming back from our own transactions is not a deposit
+	if j.isOwnTransaction(change.Item.Tx) {
+		return nil
+	}
+	if j.depositPosted(change.Item.Outpoint()) {
+		return nil
+	}
+
+	amount := change.Item.Satoshis()
+	return j.postAtomically(JOURNAL_MEMO_DEPOSIT, change.Item.Outpoint(),
+		Leg{FundsAccount(change.Address), amount},
+		Leg{JOURNAL_CHAIN, -amount},
+	)
+}
+
+func (j *Journal) reverseDeposit(change UTXOChange) error {
+	if !j.depositPosted(change.Item.Outpoint()) {
+		return nil
+	}
+
+	amount := change.Item.Satoshis()
+	return j.postAtomically(JOURNAL_MEMO_REVERSED, change.Item.Outpoint(),
+		Leg{FundsAccount(change.Address), -amount},
+		Leg{JOURNAL_CHAIN, amount},
+	)
+}
+
+// ReverseTransaction undoes everything posted for one of our transactions
+// after it disappeared from the chain, giving the spent amounts back to
+// the reserves they came from.
+func (j *Journal) ReverseTransaction(txid string) error {
+	if j.countPostings(JOURNAL_MEMO_REVERSED, txid) > 0 {
+		return nil
+	}
+
+	var results []struct {
+		Account string
+		Total   int64
+	}
+	err := j.db.Table(
+		"journal_entries",
+	).Select(
+		"account, sum(amount) as total",
+	).Where(
+		"reference = ? AND memo IN (?) AND deleted_at IS NULL",
+		txid, []string{JOURNAL_MEMO_SPEND, JOURNAL_MEMO_SETTLED},
+	).Group("account").Scan(&results).Error
+	if err != nil {
+		return err
+	}
+
+	var legs []Leg
+	for _, result := range results {
+		legs = append(legs, Leg{result.Account, -result.Total})
+	}
+
+	tx := j.db.Begin()
+	if len(legs) > 0 {
+		if err := j.post(tx, JOURNAL_MEMO_REVERSED, txid, legs...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var spends []*InFlightSpend
+	if err := tx.Where("txid = ?", txid).Find(&spends).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, spend := range spends {
+		if err := tx.Where("in_flight_spend_id = ?", spend.ID).Delete(&InFlightOutpoint{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Where("txid = ?", txid).Delete(&InFlightSpend{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (j *Journal) settleInFlight(spend *InFlightSpend) error {
+	var results []struct {
+		Account string
+		Total   int64
+	}
+	err := j.db.Table(
+		"journal_entries",
+	).Select(
+		"account, sum(amount) as total",
+	).Where(
+		"reference = ? AND account LIKE ? AND deleted_at IS NULL", spend.Txid, "inflight:%",
+	).Group("account").Scan(&results).Error
+	if err != nil {
+		return err
+	}
+
+	var legs []Leg
+	var total int64
+	for _, result := range results {
+		legs = append(legs, Leg{result.Account, -result.Total})
+		total += result.Total
+	}
+	legs = append(legs, Leg{JOURNAL_CHAIN, total - spend.Fee}, Leg{JOURNAL_FEES, spend.Fee})
+
+	tx := j.db.Begin()
+	if err := j.post(tx, JOURNAL_MEMO_SETTLED, spend.Txid, legs...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(spend).Update("settled", true).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+type TrialBalance struct {
+	// Every posting sums to zero
+	Balanced bool
+	// Funds, reserved and in-flight balance across every address
+	Holdings int64
+	// Balance the monitor sees on-chain
+	OnChain int64
+	// Holdings minus OnChain, zero when the books match the chain
+	Difference int64
+	Accounts   map[string]int64
+}
+
+// TrialBalance checks that the books are balanced and that what the
+// journal says the wallet holds matches what is on-chain.
+func (j *Journal) TrialBalance(usm *UnspentTransactionMonitor) (*TrialBalance, error) {
+	accounts, err := j.Balances()
+	if err != nil {
+		return nil, err
+	}
+
+	var unbalanced []struct {
+		Posting string
+	}
+	err = j.db.Table(
+		"journal_entries",
+	).Select(
+		"posting",
+	).Where(
+		"deleted_at IS NULL",
+	).Group("posting").Having("sum(amount) != 0").Scan(&unbalanced).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var total, holdings int64
+	for account, balance := range accounts {
+		total += balance
+		if strings.HasPrefix(account, "funds:") ||
+			strings.HasPrefix(account, "reserved:") ||
+			strings.HasPrefix(account, "inflight:") {
+			holdings += balance
+		}
+	}
+
+	onChain := usm.TotalBalance()
+	return &TrialBalance{
+		Balanced:   total == 0 && len(unbalanced) == 0,
+		Holdings:   holdings,
+		OnChain:    onChain,
+		Difference: holdings - onChain,
+		Accounts:   accounts,
+	}, nil
+}
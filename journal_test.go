@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"testing"
+)
+
+func TestJournalPostMustBalance(t *testing.T) {
+	journal := NewJournal(testDB)
+	if err := journal.Post("test", "ref", Leg{"a", 10}, Leg{"b", -5}); err == nil {
+		t.Fail()
+	}
+	if err := journal.Post("test", "ref", Leg{"a", 10}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestJournalDepositReserveAndSpend(t *testing.T) {
+	journal := NewJournal(testDB)
+	reserves := NewReserverService(testDB)
+	reserves.SetJournal(journal)
+
+	deposit := BlockrUnspentItem{
+		Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+		Idx:           0,
+		Amount:        "1.0",
+		Confirmations: 0,
+	}
+
+	// Unconfirmed deposits are not posted yet, and confirmed ones only once
+	journal.HandleUTXOChange(UTXOChange{UTXO_ADDED, "journalAddress", deposit, false})
+	if balanceFor(t, journal, FundsAccount("journalAddress")) != 0 {
+		t.Fail()
+	}
+	deposit.Confirmations = 1
+	journal.HandleUTXOChange(UTXOChange{UTXO_UPDATED, "journalAddress", deposit, true})
+	deposit.Confirmations = 2
+	journal.HandleUTXOChange(UTXOChange{UTXO_UPDATED, "journalAddress", deposit, true})
+	if balanceFor(t, journal, FundsAccount("journalAddress")) != 100000000 {
+		t.Fail()
+	}
+
+	reserve, _ := reserves.AddReserveForAddress("journalAddress", 30000000)
+	if balanceFor(t, journal, FundsAccount("journalAddress")) != 70000000 || balanceFor(t, journal, ReservedAccount("journalAddress")) != 30000000 {
+		t.Fail()
+	}
+
+	hash, _ := chainhash.NewHashFromStr(deposit.Tx)
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, 0), nil))
+	var buffer bytes.Buffer
+	tx.Serialize(&buffer)
+
+	if err := journal.TrackInFlight("spendTxid", buffer.Bytes(), BTC_FEE_IN_SATOSHIS); err != nil {
+		t.Fatal(err)
+	}
+	reserves.SpendReserve("journalAddress", reserve, 30000000, BTC_FEE_IN_SATOSHIS, "spendTxid")
+	if balanceFor(t, journal, InFlightAccount("journalAddress")) != 30000000 {
+		t.Fail()
+	}
+
+	// Change from our own spend is not a deposit
+	journal.HandleUTXOChange(UTXOChange{UTXO_ADDED, "journalAddress", BlockrUnspentItem{
+		Tx: "spendTxid", Idx: 1, Amount: "0.7", Confirmations: 1,
+	}, true})
+	journal.HandleUTXOChange(UTXOChange{UTXO_REMOVED, "journalAddress", deposit, false})
+	if balanceFor(t, journal, InFlightAccount("journalAddress")) != 0 || balanceFor(t, journal, FundsAccount("journalAddress")) != 70000000 {
+		t.Fail()
+	}
+
+	usm := NewUnspentTransactionMonitor(Client)
+	trialBalance, err := journal.TrialBalance(usm)
+	if err != nil || !trialBalance.Balanced {
+		t.Fail()
+	}
+}
+
+func TestInFlightOutpointsMatchExactly(t *testing.T) {
+	journal := NewJournal(testDB)
+	hash, _ := chainhash.NewHashFromStr("cc631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9")
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, 10), []byte{}))
+	var buffer bytes.Buffer
+	tx.Serialize(&buffer)
+	if err := journal.TrackInFlight("outpointTxid", buffer.Bytes(), BTC_FEE_IN_SATOSHIS); err != nil {
+		t.Fatal(err)
+	}
+
+	// Output 1 of the same transaction is not output 10
+	spends, err := journal.spendsOf(hash.String() + ":1")
+	if err != nil || len(spends) != 0 {
+		t.Fail()
+	}
+	spends, err = journal.spendsOf(hash.String() + ":10")
+	if err != nil || len(spends) != 1 || spends[0].Txid != "outpointTxid" {
+		t.Fail()
+	}
+}
+
+// balanceFor is Balance, failing the test on an error.
+func balanceFor(t *testing.T, journal *Journal, account string) int64 {
+	balance, err := journal.Balance(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
@@ -0,0 +1,207 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/satori/go.uuid"
+	"sort"
+	"sync"
+)
+
+const (
+	LEDGER_TRANSFER   = "transfer"
+	LEDGER_SETTLEMENT = "settlement"
+	// Change of a spend sent to a change address of the spending address
+	LEDGER_CHANGE = "change"
+)
+
+// LedgerTransfer moves balance between two of the wallet's addresses
+// without touching the chain. Settlements are recorded when a withdrawal
+// spends coins that sit on another address, and undo that much of the
+// earlier off-chain transfers.
+type LedgerTransfer struct {
+	gorm.Model
+	Uuid        string
+	FromAddress string
+	ToAddress   string
+	Amount      int64
+	Kind        string
+	Txid        string
+}
+
+// Ledger keeps track of how much of each address balance was moved
+// off-chain. The balance of an address is its on-chain balance plus its
+// net off-chain transfers. Transfers are made one at a time.
+type Ledger struct {
+	sync.Mutex
+	db      *gorm.DB
+	journal *Journal
+}
+
+func NewLedger(localDb *gorm.DB) *Ledger {
+	return &Ledger{
+		db: localDb,
+	}
+}
+
+// SetJournal makes every transfer post to journal.
+func (l *Ledger) SetJournal(journal *Journal) {
+	l.journal = journal
+}
+
+// Transfer moves amount from one address to another. The caller is
+// responsible for checking that from can afford it.
+func (l *Ledger) Transfer(from, to string, amount int64) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.transfer(from, to, amount)
+}
+
+// TransferAvailable is Transfer, refused when amount is more than available
+// says from can spend. Both happen under the ledger lock, so concurrent
+// transfers cannot spend the same funds twice.
+func (l *Ledger) TransferAvailable(from, to string, amount int64, available func(address string) int64) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+	if amount > available(from) {
+		return "", errors.New("Amount is too high")
+	}
+	return l.transfer(from, to, amount)
+}
+
+func (l *Ledger) transfer(from, to string, amount int64) (string, error) {
+	if amount <= 0 {
+		return "", errors.New("Amount is invalid")
+	}
+	if from == to {
+		return "", errors.New("Cannot transfer to the same account")
+	}
+
+	transfer := LedgerTransfer{
+		Uuid:        uuid.NewV4().String(),
+		FromAddress: from,
+		ToAddress:   to,
+		Amount:      amount,
+		Kind:        LEDGER_TRANSFER,
+	}
+	tx := l.db.Begin()
+	if err := tx.Create(&transfer).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if l.journal != nil {
+		err := l.journal.post(tx, JOURNAL_MEMO_TRANSFER, transfer.Uuid,
+			Leg{FundsAccount(from), -amount},
+			Leg{FundsAccount(to), amount},
+		)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return "", err
+	}
+	return transfer.Uuid, nil
+}
+
+// Settle records that creditor withdrew amount on-chain using coins held
+// by debtor's address in transaction txid.
+func (l *Ledger) Settle(creditor, debtor string, amount int64, txid string) error {
+	return l.db.Create(&LedgerTransfer{
+		Uuid:        uuid.NewV4().String(),
+		FromAddress: creditor,
+		ToAddress:   debtor,
+		Amount:      amount,
+		Kind:        LEDGER_SETTLEMENT,
+		Txid:        txid,
+	}).Error
+}
+
+// RecordChange records that amount sent by account in transaction txid
+// sits on changeAddress. Nothing is posted to the journal, which keeps
+// counting the change as funds of account.
+func (l *Ledger) RecordChange(changeAddress, account string, amount int64, txid string) error {
+	return l.db.Create(&LedgerTransfer{
+		Uuid:        uuid.NewV4().String(),
+		FromAddress: changeAddress,
+		ToAddress:   account,
+		Amount:      amount,
+		Kind:        LEDGER_CHANGE,
+		Txid:        txid,
+	}).Error
+}
+
+// ForgetChange drops the change recorded for a transaction that will never
+// be on the chain.
+func (l *Ledger) ForgetChange(txid string) error {
+	return l.db.Where("kind = ? AND txid = ?", LEDGER_CHANGE, txid).Delete(&LedgerTransfer{}).Error
+}
+
+func (l *Ledger) netBalances() (map[string]int64, error) {
+	var transfers []*LedgerTransfer
+	if err := l.db.Find(&transfers).Error; err != nil {
+		return nil, err
+	}
+
+	net := make(map[string]int64)
+	for _, transfer := range transfers {
+		net[transfer.FromAddress] -= transfer.Amount
+		net[transfer.ToAddress] += transfer.Amount
+	}
+	return net, nil
+}
+
+// NetForAddress is how much an address received off-chain minus how much
+// it sent.
+func (l *Ledger) NetForAddress(address string) (int64, error) {
+	var results []struct {
+		Total int64
+	}
+
+	err := l.db.Table(
+		"ledger_transfers",
+	).Select(
+		"sum(CASE WHEN to_address = ? THEN amount ELSE -amount END) as total", address,
+	).Where(
+		"(from_address = ? OR to_address = ?) AND deleted_at IS NULL", address, address,
+	).Scan(&results).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return results[0].Total, nil
+}
+
+// Debtor is an address whose coins back balance that was transferred
+// off-chain to other addresses.
+type Debtor struct {
+	Address string
+	Owed    int64
+}
+
+// Debtors lists the addresses with a negative off-chain balance, largest
+// debt first.
+func (l *Ledger) Debtors() ([]Debtor, error) {
+	net, err := l.netBalances()
+	if err != nil {
+		return nil, err
+	}
+
+	var debtors []Debtor
+	for address, balance := range net {
+		if balance < 0 {
+			debtors = append(debtors, Debtor{address, -balance})
+		}
+	}
+	sort.Slice(debtors, func(i, j int) bool {
+		if debtors[i].Owed == debtors[j].Owed {
+			return debtors[i].Address < debtors[j].Address
+		}
+		return debtors[i].Owed > debtors[j].Owed
+	})
+	return debtors, nil
+}
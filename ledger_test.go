@@ -0,0 +1,140 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"sync"
+	"testing"
+)
+
+func TestLedgerTransfers(t *testing.T) {
+	ledger := NewLedger(testDB)
+
+	if _, err := ledger.Transfer("ledgerA", "ledgerB", 500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Transfer("ledgerB", "ledgerC", 200); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Transfer("ledgerA", "ledgerA", 200); err == nil {
+		t.Fail()
+	}
+
+	if netFor(t, ledger, "ledgerA") != -500 || netFor(t, ledger, "ledgerB") != 300 || netFor(t, ledger, "ledgerC") != 200 {
+		t.Fail()
+	}
+
+	if err := ledger.Settle("ledgerB", "ledgerA", 300, "txid"); err != nil {
+		t.Fatal(err)
+	}
+	if netFor(t, ledger, "ledgerA") != -200 || netFor(t, ledger, "ledgerB") != 0 {
+		t.Fail()
+	}
+
+	debtors, err := ledger.Debtors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, debtor := range debtors {
+		if debtor.Address == "ledgerA" && debtor.Owed != 200 {
+			t.Fail()
+		}
+		if debtor.Address == "ledgerB" || debtor.Address == "ledgerC" {
+			t.Fail()
+		}
+	}
+}
+
+func TestTransferAvailableCannotOverdraw(t *testing.T) {
+	ledger := NewLedger(testDB)
+	available := func(address string) int64 {
+		net, _ := ledger.NetForAddress(address)
+		return 1000 + net
+	}
+
+	// Only one of two concurrent transfers of most of the balance goes through
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, to := range []string{"availableB", "availableC"} {
+		wg.Add(1)
+		go func(to string) {
+			defer wg.Done()
+			_, err := ledger.TransferAvailable("availableA", to, 700, available)
+			errs <- err
+		}(to)
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed != 1 || netFor(t, ledger, "availableA") != -700 {
+		t.Fail()
+	}
+}
+
+func TestWithdrawSettlesTransfers(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+
+	payerPK, _ := btcec.NewPrivateKey(btcec.S256())
+	payerAddress, _ := btcutil.NewAddressPubKey(payerPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	payeePK, _ := btcec.NewPrivateKey(btcec.S256())
+	payeeAddress, _ := btcutil.NewAddressPubKey(payeePK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+
+	p2pkhPayerAddress, _ := txmgr.makePayToPubkeyHashScript(payerAddress.EncodeAddress())
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		payerAddress.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(p2pkhPayerAddress),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(payeeAddress.EncodeAddress(), 30000000)
+	outputs := []SpendOutput{{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 30000000}}
+
+	// Without the ledger the payee has nothing to spend
+	if _, err := txmgr.MakeTransactionForOutputs(payeeAddress.EncodeAddress(), reserve, payeePK, outputs, FEE_RECIPIENT_PAYS); err == nil {
+		t.Fail()
+	}
+
+	ledger := NewLedger(testDB)
+	ledger.Transfer(payerAddress.EncodeAddress(), payeeAddress.EncodeAddress(), 50000000)
+	txmgr.SetLedger(ledger, func(address string) (*btcec.PrivateKey, error) {
+		return payerPK, nil
+	})
+
+	spend, err := txmgr.buildTransactionForOutputs(payeeAddress.EncodeAddress(), reserve, payeePK, outputs, FEE_RECIPIENT_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settlements := spend.settlements
+	if len(settlements) != 1 || settlements[0].Address != payerAddress.EncodeAddress() || settlements[0].Owed != 30000000 {
+		t.Log(settlements)
+		t.Fail()
+	}
+}
+
+// netFor is NetForAddress, failing the test on an error.
+func netFor(t *testing.T, ledger *Ledger, address string) int64 {
+	net, err := ledger.NetForAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net
+}
@@ -0,0 +1,448 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	// nSequence of the inputs we sign. Anything below 0xfffffffe signals
+	// that the transaction can be replaced by one paying a higher fee
+	// (BIP125).
+	RBF_SEQUENCE = wire.MaxTxInSequenceNum - 2
+
+	// A replacement pays at least this many satoshis per byte more than
+	// what it replaces, or nodes will not relay it
+	MIN_RELAY_FEE_RATE = 1
+
+	// Serialized sizes used to estimate the fee of inputs and outputs we add
+	P2PKH_INPUT_SIZE  = 148
+	P2PKH_OUTPUT_SIZE = 34
+
+	// Replaced by a transaction paying a higher fee
+	BROADCAST_REPLACED = "replaced"
+)
+
+// FeeReplacement records that ReplacedTxid was replaced by Txid, paying
+// Fee instead of OldFee.
+type FeeReplacement struct {
+	gorm.Model
+	ReplacedTxid string `gorm:"index"`
+	Txid         string `gorm:"index"`
+	OldFee       int64
+	Fee          int64
+	FeeRate      int64
+}
+
+func signalsReplaceability(tx *wire.MsgTx) bool {
+	for _, txin := range tx.TxIn {
+		if txin.Sequence < wire.MaxTxInSequenceNum-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// inputAddress finds the address a signed pay-to-pubkey-hash input spends
+// from, using the public key in its signature script.
+func inputAddress(txin *wire.TxIn) (btcutil.Address, error) {
+	pushes, err := txscript.PushedData(txin.SignatureScript)
+	if err != nil {
+		return nil, err
+	}
+	if len(pushes) != 2 {
+		return nil, errors.New("Input does not spend a pay-to-pubkey-hash output")
+	}
+	return btcutil.NewAddressPubKeyHash(btcutil.Hash160(pushes[1]), NetParams)
+}
+
+// replaceWithFeeRate rebuilds a transaction that paid oldFee so that it
+// pays feeRate satoshis per virtual byte. The extra fee comes out of the
+// change of the address spending the first input, adding inputs of that
+// address when the change is too small, and is refused when it is more
+// than the free funds of that address. The payments are left untouched.
+func (tm *TransactionManager) replaceWithFeeRate(
+	original *wire.MsgTx,
+	oldFee, feeRate int64,
+	keys KeyLookup,
+) (*wire.MsgTx, string, int64, error) {
+	if len(original.TxIn) == 0 {
+		return nil, "", 0, errors.New("Transaction has no inputs")
+	}
+	tx := original.Copy()
+
+	// Only pay-to-pubkey-hash inputs are signed again
+	var inputAddresses []btcutil.Address
+	exclude := make(map[string]bool)
+	for _, txin := range tx.TxIn {
+		address, err := inputAddress(txin)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		inputAddresses = append(inputAddresses, address)
+		exclude[txin.PreviousOutPoint.String()] = true
+	}
+	payer := inputAddresses[0]
+	payerScript, err := txscript.PayToAddrScript(payer)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	size := virtualSize(tx)
+	if feeRate*size < oldFee+MIN_RELAY_FEE_RATE*size {
+		return nil, "", 0, errors.New("Fee rate is too low to replace the transaction")
+	}
+
+	own, err := tm.ownScripts(payer.EncodeAddress())
+	if err != nil {
+		return nil, "", 0, err
+	}
+	changeIdx := -1
+	var available int64
+	for idx, txout := range tx.TxOut {
+		if _, ok := own[hex.EncodeToString(txout.PkScript)]; ok {
+			changeIdx = idx
+			available = txout.Value
+			break
+		}
+	}
+	if changeIdx < 0 {
+		size += P2PKH_OUTPUT_SIZE
+	}
+
+	// Add inputs until the change covers the estimated fee
+	var scripts [][]byte
+	fee := feeRate * size
+	for available < fee-oldFee {
+		shortfall := fee - oldFee - available + feeRate*P2PKH_INPUT_SIZE
+		txIns, addedScripts, total := tm.unspentTransactionMonitorInstance.getTXinsExcluding(
+			payer.EncodeAddress(), shortfall, exclude,
+		)
+		if len(txIns) == 0 || total <= 0 {
+			return nil, "", 0, errors.New("Insufficient funds to bump the fee")
+		}
+		for idx, txin := range txIns {
+			tx.AddTxIn(txin)
+			scripts = append(scripts, addedScripts[idx])
+			inputAddresses = append(inputAddresses, payer)
+			exclude[txin.PreviousOutPoint.String()] = true
+		}
+		available += total
+		size += int64(len(txIns)) * P2PKH_INPUT_SIZE
+		fee = feeRate * size
+	}
+
+	// The inputs that were already there sign again
+	inputKeys := make([]*btcec.PrivateKey, len(tx.TxIn))
+	previousScripts := make([][]byte, 0, len(tx.TxIn))
+	for idx, address := range inputAddresses {
+		pk, err := keys(address.EncodeAddress())
+		if err != nil {
+			return nil, "", 0, err
+		}
+		inputKeys[idx] = pk
+		if idx < len(original.TxIn) {
+			script, err := txscript.PayToAddrScript(address)
+			if err != nil {
+				return nil, "", 0, err
+			}
+			previousScripts = append(previousScripts, script)
+		}
+	}
+	previousScripts = append(previousScripts, scripts...)
+
+	// As for sweeps, the fee is set from the signed size until both agree
+	var replacement *wire.MsgTx
+	for attempt := 0; ; attempt++ {
+		replacement = tx.Copy()
+		change := available - (fee - oldFee)
+		if change > 0 && change < DustThreshold(payerScript) {
+			// Not worth an output, the miners get it
+			fee += change
+			change = 0
+		}
+		switch {
+		case changeIdx >= 0 && change > 0:
+			replacement.TxOut[changeIdx].Value = change
+		case changeIdx >= 0:
+			replacement.TxOut = append(replacement.TxOut[:changeIdx], replacement.TxOut[changeIdx+1:]...)
+		case change > 0:
+			replacement.AddTxOut(wire.NewTxOut(change, payerScript))
+		default:
+			// Nothing left over, the whole change went to the fee
+		}
+		if err := tm.signTransaction(replacement, previousScripts, inputKeys); err != nil {
+			return nil, "", 0, err
+		}
+		needed := feeRate * virtualSize(replacement)
+		if needed > available+oldFee {
+			return nil, "", 0, errors.New("Insufficient funds to bump the fee")
+		}
+		if needed == fee || (needed < fee && (change == 0 || attempt >= SWEEP_SIGNING_ATTEMPTS)) {
+			break
+		}
+		fee = needed
+	}
+
+	if fee-oldFee > tm.freeFunds(payer.EncodeAddress()) {
+		return nil, "", 0, errors.New("Insufficient funds to bump the fee")
+	}
+	return replacement, payer.EncodeAddress(), fee, nil
+}
+
+// BumpFee replaces a pending transaction with one paying feeRate satoshis
+// per virtual byte and returns the txid of the replacement. Reserves,
+// journal and history follow the replacement through a TxReplaced event.
+func (bt *BroadcastTracker) BumpFee(txid string, feeRate int64, keys KeyLookup) (string, error) {
+	if feeRate <= 0 {
+		return "", errors.New("Fee rate is invalid")
+	}
+
+	event, err := bt.replace(txid, feeRate, keys)
+	if err != nil {
+		return "", err
+	}
+	oldFee := event.Fee - event.ExtraFee
+	newTxid := event.Txid
+
+	err = bt.db.Create(&FeeReplacement{
+		ReplacedTxid: txid,
+		Txid:         newTxid,
+		OldFee:       oldFee,
+		Fee:          event.Fee,
+		FeeRate:      feeRate,
+	}).Error
+	if err != nil {
+		Error.Println(err)
+	}
+	Info.Printf("Replaced %s with %s, paying %d instead of %d\n", txid, newTxid, event.Fee, oldFee)
+
+	if err := bt.handleReplaced(txid, newTxid, event.Raw, event.Fee, time.Now()); err != nil {
+		Error.Println(err)
+	}
+	if bt.txMgr.ledger != nil {
+		if err := bt.txMgr.ledger.ForgetChange(txid); err != nil {
+			Error.Println(err)
+		}
+		if err := bt.txMgr.recordChange(newTxid, event.Raw, event.Payer); err != nil {
+			Error.Println(err)
+		}
+	}
+	bt.txMgr.unspentTransactionMonitorInstance.MarkDirty(event.Payer)
+	if bt.bus != nil {
+		bt.bus.Publish(context.Background(), *event)
+	}
+	return newTxid, nil
+}
+
+// replace checks that txid can still be replaced, then builds and
+// broadcasts its replacement, all under the lock of the transaction
+// manager so that no other spend or replacement gets in between.
+func (bt *BroadcastTracker) replace(txid string, feeRate int64, keys KeyLookup) (*TxReplaced, error) {
+	bt.txMgr.Lock()
+	defer bt.txMgr.Unlock()
+
+	broadcast, err := bt.Get(txid)
+	if err != nil {
+		return nil, err
+	}
+	if broadcast.Status != BROADCAST_PENDING && broadcast.Status != BROADCAST_STUCK {
+		return nil, errors.New("Only unconfirmed transactions can be bumped")
+	}
+	if broadcast.Confirmations > 0 {
+		return nil, errors.New("Transaction is already confirmed")
+	}
+	if bt.isCancellation(txid) {
+		return nil, errors.New("Transaction cancels a spend and cannot be bumped")
+	}
+
+	raw, err := broadcast.Raw()
+	if err != nil {
+		return nil, err
+	}
+	original := wire.NewMsgTx()
+	if err := original.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	if !signalsReplaceability(original) {
+		return nil, errors.New("Transaction does not signal replaceability")
+	}
+
+	replacement, payer, fee, err := bt.txMgr.replaceWithFeeRate(original, broadcast.Fee, feeRate, keys)
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := serializeTransaction(replacement)
+	if err != nil {
+		return nil, err
+	}
+	newTxid, err := bt.push(txBytes)
+	if _, rejected := err.(*BroadcastRejected); rejected {
+		return nil, err
+	}
+	if err != nil {
+		// The replacement may have reached the network anyway, so it is
+		// booked like one that did, and tracked so that it is pushed again
+		newTxid = replacement.TxHash().String()
+		Error.Printf("Broadcasting replacement %s failed, leaving it to be rebroadcast: %s\n", newTxid, err)
+	}
+	return &TxReplaced{
+		ReplacedTxid: txid,
+		Txid:         newTxid,
+		Payer:        payer,
+		Fee:          fee,
+		ExtraFee:     fee - broadcast.Fee,
+		Raw:          txBytes,
+	}, nil
+}
+
+// handleReplaced stops watching replacedTxid and starts watching txid,
+// which replaced it paying fee.
+func (bt *BroadcastTracker) handleReplaced(replacedTxid, txid string, txBytes []byte, fee int64, now time.Time) error {
+	err := bt.db.Model(&BroadcastTransaction{}).Where(
+		"txid = ?", replacedTxid,
+	).Update("status", BROADCAST_REPLACED).Error
+	if err != nil {
+		return err
+	}
+	return bt.Track(txid, txBytes, fee, now)
+}
+
+// Replacements lists the transactions that replaced txid, directly or
+// not, oldest first.
+func (bt *BroadcastTracker) Replacements(txid string) ([]*FeeReplacement, error) {
+	var replacements []*FeeReplacement
+	for {
+		var replacement FeeReplacement
+		err := bt.db.Where("replaced_txid = ?", txid).Order("id desc").First(&replacement).Error
+		if err == gorm.ErrRecordNotFound {
+			return replacements, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		replacements = append(replacements, &replacement)
+		txid = replacement.Txid
+	}
+}
+
+// ReplaceSpendTxid points the spends of txid at the transaction that
+// replaced it, keeping a replaced event in the audit trail. The first spend
+// is charged the extraFee the replacement paid.
+func (rs *ReserveService) ReplaceSpendTxid(txid, newTxid string, extraFee int64) error {
+	var spends []*ReserveEvent
+	err := rs.db.Where("kind = ? AND txid = ?", RESERVE_EVENT_SPENT, txid).Order("id").Find(&spends).Error
+	if err != nil {
+		return err
+	}
+
+	tx := rs.db.Begin()
+	for idx, spend := range spends {
+		updates := map[string]interface{}{"txid": newTxid}
+		var fee int64
+		if idx == 0 {
+			fee = extraFee
+			updates["fee"] = spend.Fee + extraFee
+			err := tx.Table("reserves").Where("id = ?", spend.ReserveID).Update("fee", gorm.Expr("fee + ?", extraFee)).Error
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Model(spend).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		err := rs.recordEventWithFee(tx, spend.ReserveID, RESERVE_EVENT_REPLACED, spend.Amount, fee, newTxid)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// ReplaceTransaction moves what txid spent over to its replacement, which
+// paid extraFee more out of the funds of payer.
+func (j *Journal) ReplaceTransaction(txid, newTxid string, txBytes []byte, payer string, fee, extraFee int64) error {
+	var spend InFlightSpend
+	if err := j.db.Where("txid = ?", txid).First(&spend).Error; err != nil {
+		return err
+	}
+	if spend.Settled {
+		return errors.New("Transaction was already settled")
+	}
+	replacement := wire.NewMsgTx()
+	if err := replacement.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return err
+	}
+
+	tx := j.db.Begin()
+	err := tx.Model(&JournalEntry{}).Where(
+		"reference = ? AND memo = ?", txid, JOURNAL_MEMO_SPEND,
+	).Update("reference", newTxid).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = j.post(tx, JOURNAL_MEMO_SPEND, newTxid,
+		Leg{FundsAccount(payer), -extraFee}, Leg{InFlightAccount(payer), extraFee})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Model(&spend).Updates(map[string]interface{}{
+		"txid": newTxid,
+		"fee":  fee,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("in_flight_spend_id = ?", spend.ID).Delete(&InFlightOutpoint{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := j.recordOutpoints(tx, spend.ID, replacement); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// HandleTxReplaced moves the payments of the replaced transaction over to
+// its replacement. The payer's first payment carries the extra fee.
+func (th *TransactionHistory) HandleTxReplaced(event TxReplaced) error {
+	var first TransactionRecord
+	err := th.db.Where(
+		"txid = ? AND direction = ? AND address = ?", event.ReplacedTxid, HISTORY_OUTGOING, event.Payer,
+	).Order("id").First(&first).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	tx := th.db.Begin()
+	if err == nil {
+		err = tx.Model(&first).Update("fee", first.Fee+event.ExtraFee).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Model(&TransactionRecord{}).Where(
+		"txid = ? AND direction = ?", event.ReplacedTxid, HISTORY_OUTGOING,
+	).Update("txid", event.Txid).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
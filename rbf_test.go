@@ -0,0 +1,120 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"testing"
+	"time"
+)
+
+func TestBumpFee(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+	tracker := NewBroadcastTracker(testDB, txmgr, DefaultBroadcastPolicy())
+	tracker.push = func(txBytes []byte) (string, error) {
+		return "bumpReplacement", nil
+	}
+
+	frmPK, _ := btcec.NewPrivateKey(btcec.S256())
+	frmAddress, _ := btcutil.NewAddressPubKey(frmPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	p2pkhFrmAddress, _ := txmgr.makePayToPubkeyHashScript(frmAddress.EncodeAddress())
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		frmAddress.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(p2pkhFrmAddress),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+	keys := func(address string) (*btcec.PrivateKey, error) {
+		return frmPK, nil
+	}
+
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(frmAddress.EncodeAddress(), 60000000)
+	txBytes, err := txmgr.MakeTransactionForOutputs(frmAddress.EncodeAddress(), reserve, frmPK, []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 30000000},
+	}, FEE_RECIPIENT_PAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := wire.NewMsgTx()
+	original.Deserialize(bytes.NewReader(txBytes))
+	if !signalsReplaceability(original) {
+		t.Fail()
+	}
+
+	txmgr.reserveInstance.SpendReserve(frmAddress.EncodeAddress(), reserve, 30000000, BTC_FEE_IN_SATOSHIS, "bumpOriginal")
+	tracker.Track("bumpOriginal", txBytes, BTC_FEE_IN_SATOSHIS, time.Now())
+
+	// Paying less than one more satoshi per byte is not a valid replacement
+	if _, err := tracker.BumpFee("bumpOriginal", 1, keys); err == nil {
+		t.Fail()
+	}
+	txid, err := tracker.BumpFee("bumpOriginal", 200, keys)
+	if err != nil || txid != "bumpReplacement" {
+		t.Fatal(err)
+	}
+
+	bumped, _ := tracker.Get("bumpReplacement")
+	replacement := wire.NewMsgTx()
+	raw, _ := bumped.Raw()
+	replacement.Deserialize(bytes.NewReader(raw))
+	if len(replacement.TxIn) != 1 || len(replacement.TxOut) != len(original.TxOut) {
+		t.FailNow()
+	}
+	// The payment is untouched and the change pays the extra fee
+	extraFee := bumped.Fee - BTC_FEE_IN_SATOSHIS
+	if extraFee <= 0 || replacement.TxOut[0].Value != original.TxOut[0].Value {
+		t.Fail()
+	}
+	if replacement.TxOut[1].Value != original.TxOut[1].Value-extraFee {
+		t.Fail()
+	}
+
+	if replaced, _ := tracker.Get("bumpOriginal"); replaced.Status != BROADCAST_REPLACED {
+		t.Fail()
+	}
+	replacements, _ := tracker.Replacements("bumpOriginal")
+	if len(replacements) != 1 || replacements[0].Txid != "bumpReplacement" {
+		t.Fail()
+	}
+
+	// A rejected replacement leaves the transaction as it was
+	tracker.push = func(txBytes []byte) (string, error) {
+		return "", &BroadcastRejected{"insufficient fee"}
+	}
+	if _, err := tracker.BumpFee("bumpReplacement", 400, keys); err == nil {
+		t.Fail()
+	}
+	if pending, _ := tracker.Get("bumpReplacement"); pending.Status == BROADCAST_REPLACED {
+		t.Fail()
+	}
+
+	// One that may have reached the network is tracked under its own txid
+	tracker.push = func(txBytes []byte) (string, error) {
+		return "", errors.New("Backend failed: 502 Bad Gateway")
+	}
+	txid, err = tracker.BumpFee("bumpReplacement", 400, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.Get(txid); err != nil {
+		t.Fail()
+	}
+	if replaced, _ := tracker.Get("bumpReplacement"); replaced.Status != BROADCAST_REPLACED {
+		t.Fail()
+	}
+}
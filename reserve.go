@@ -1,22 +1,71 @@
 package wallet
 
 import (
+	"context"
 	"errors"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+const (
+	RESERVE_EVENT_CREATED   = "created"
+	RESERVE_EVENT_SPENT     = "spent"
+	RESERVE_EVENT_INCREASED = "increased"
+	RESERVE_EVENT_DECREASED = "decreased"
+	RESERVE_EVENT_REVERTED  = "reverted"
+	// The spend was replaced by a transaction paying a higher fee
+	RESERVE_EVENT_REPLACED = "replaced"
+	// The spend was double-spent back to the account
+	RESERVE_EVENT_CANCELLED = "cancelled"
 )
 
 type Reserve struct {
 	gorm.Model
-	Uuid    string
-	Address string
-	Amount  uint64
-	Spent   bool
+	Uuid      string
+	Address   string
+	Amount    uint64
+	Remaining uint64
+	// Held is the part of Remaining promised to payouts that are waiting
+	// to be broadcast.
+	Held uint64
+	// Fee paid by the transactions that spent from the reserve
+	Fee    int64
+	Spent  bool
+	Events []ReserveEvent
+}
+
+// ReserveEvent is one entry in a reserve's audit trail. Amount is always
+// positive, Kind tells whether it was added to or taken from the reserve.
+type ReserveEvent struct {
+	gorm.Model
+	ReserveID uint
+	Kind      string
+	Amount    int64
+	// Fee paid by the spending transaction on behalf of the reserve
+	Fee  int64
+	Txid string
 }
 
+// SpendUndo marks a spending transaction whose amounts went back to their
+// reserves. There is only one per txid, so a transaction is never undone
+// twice.
+type SpendUndo struct {
+	gorm.Model
+	Txid string `gorm:"unique_index"`
+	Kind string
+}
+
+// ReserveService keeps the reserves of every address. Growing reserves
+// against the available balance is done one at a time.
 type ReserveService struct {
-	db *gorm.DB
+	sync.Mutex
+	db      *gorm.DB
+	journal *Journal
+	events  *EventRecorder
+	bus     *EventBus
 }
 
 func NewReserverService(localDb *gorm.DB) *ReserveService {
@@ -25,49 +74,482 @@ func NewReserverService(localDb *gorm.DB) *ReserveService {
 	}
 }
 
+// SetJournal makes every change to a reserve post to journal.
+func (rs *ReserveService) SetJournal(journal *Journal) {
+	rs.journal = journal
+}
+
+// SetEventRecorder makes every reserve event also recorded as a wallet
+// event for the reserve's address.
+func (rs *ReserveService) SetEventRecorder(events *EventRecorder) {
+	rs.events = events
+}
+
+// SetEventBus makes the service publish ReserveCreated and ReserveSpent
+// events on bus once they are committed, and follow spends replaced with
+// a higher fee.
+func (rs *ReserveService) SetEventBus(bus *EventBus) {
+	rs.bus = bus
+	bus.Subscribe(TxReplaced{}, func(ctx context.Context, event Event) {
+		replaced := event.(TxReplaced)
+		if err := rs.ReplaceSpendTxid(replaced.ReplacedTxid, replaced.Txid, replaced.ExtraFee); err != nil {
+			Error.Println(err)
+		}
+	})
+}
+
+func (rs *ReserveService) publish(event Event) {
+	if rs.bus != nil {
+		rs.bus.Publish(context.Background(), event)
+	}
+}
+
+// postToJournal moves amount between two accounts of address, when a
+// journal is set.
+func (rs *ReserveService) postToJournal(tx *gorm.DB, memo, reference, from, to string, amount int64) error {
+	if rs.journal == nil {
+		return nil
+	}
+	return rs.journal.post(tx, memo, reference, Leg{from, -amount}, Leg{to, amount})
+}
+
+// MigrateReserves creates the reserve tables and fills in Remaining for
+// reserves created before partial spends existed.
+func MigrateReserves(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Reserve{}, &ReserveEvent{}, &SpendUndo{}).Error; err != nil {
+		return err
+	}
+	return db.Table(
+		"reserves",
+	).Where(
+		"spent = ? AND remaining = 0", false,
+	).Update("remaining", gorm.Expr("amount")).Error
+}
+
 func (rs *ReserveService) AddReserveForAddress(address string, amount int64) (string, error) {
 	if amount <= 0 {
 		return "", errors.New("Amount is invalid")
 	}
 
 	reserveInstance := Reserve{
-		Uuid:    uuid.NewV4().String(),
-		Address: address,
-		Amount:  uint64(amount),
-		Spent:   false,
+		Uuid:      uuid.NewV4().String(),
+		Address:   address,
+		Amount:    uint64(amount),
+		Remaining: uint64(amount),
+		Spent:     false,
+	}
+
+	tx := rs.db.Begin()
+	if err := tx.Create(&reserveInstance).Error; err != nil {
+		tx.Rollback()
+		return "", err
 	}
-	if err := rs.db.Create(&reserveInstance).Error; err != nil {
+	if err := rs.recordEvent(tx, reserveInstance.ID, RESERVE_EVENT_CREATED, amount, ""); err != nil {
+		tx.Rollback()
 		return "", err
 	}
+	err := rs.postToJournal(tx, JOURNAL_MEMO_RESERVE, reserveInstance.Uuid,
+		FundsAccount(address), ReservedAccount(address), amount)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return "", err
+	}
+	rs.publish(ReserveCreated{address, reserveInstance.Uuid, amount})
 
 	return reserveInstance.Uuid, nil
 }
 
-func (rs *ReserveService) SpendReserve(address, reserve string) error {
-	err := rs.db.Table(
-		"reserves",
-	).Where(
-		"address = ? AND uuid = ? AND spent = ?", address, reserve, false,
-	).Update("spent", true).Error
-	return err
+// AddReserveAvailable is AddReserveForAddress, refused when amount is more
+// than available says address can put aside. Both happen under the lock of
+// the service, so concurrent reserves cannot hold the same funds twice.
+func (rs *ReserveService) AddReserveAvailable(address string, amount int64, available func(address string) int64) (string, error) {
+	rs.Lock()
+	defer rs.Unlock()
+	if amount > available(address) {
+		return "", errors.New("Amount is too high")
+	}
+	return rs.AddReserveForAddress(address, amount)
 }
 
-func (rs *ReserveService) GetAmountReservedForReserve(address, reserve string) (int64, error) {
+func (rs *ReserveService) recordEvent(tx *gorm.DB, reserveID uint, kind string, amount int64, txid string) error {
+	return rs.recordEventWithFee(tx, reserveID, kind, amount, 0, txid)
+}
+
+func (rs *ReserveService) recordEventWithFee(tx *gorm.DB, reserveID uint, kind string, amount, fee int64, txid string) error {
+	err := tx.Create(&ReserveEvent{
+		ReserveID: reserveID,
+		Kind:      kind,
+		Amount:    amount,
+		Fee:       fee,
+		Txid:      txid,
+	}).Error
+	if err != nil || rs.events == nil {
+		return err
+	}
+
+	var reserve Reserve
+	if err := tx.First(&reserve, reserveID).Error; err != nil {
+		return err
+	}
+	return rs.events.record(tx, &WalletEvent{
+		Kind:      EVENT_RESERVE_PREFIX + kind,
+		Address:   reserve.Address,
+		Txid:      txid,
+		Amount:    amount,
+		Reference: reserve.Uuid,
+	})
+}
+
+func (rs *ReserveService) getActiveReserve(tx *gorm.DB, address, reserve string) (*Reserve, error) {
 	var res []*Reserve
-	err := rs.db.Table(
+	err := tx.Table(
 		"reserves",
 	).Where(
 		"address = ? AND uuid = ? AND spent = ?", address, reserve, false,
 	).Scan(&res).Error
 
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
 	if len(res) != 1 {
-		return -1, errors.New("Reserve does not exist")
+		return nil, errors.New("Reserve does not exist")
+	}
+	return res[0], nil
+}
+
+// SpendReserve takes amount out of a reserve, recording the transaction
+// that spent it and the fee it paid. The reserve is marked as spent once
+// nothing remains.
+func (rs *ReserveService) SpendReserve(address, reserve string, amount, fee int64, txid string) error {
+	return rs.spend(address, reserve, amount, fee, txid, false)
+}
+
+// SpendHeldReserve is SpendReserve for an amount previously put aside with
+// HoldReserve.
+func (rs *ReserveService) SpendHeldReserve(address, reserve string, amount, fee int64, txid string) error {
+	return rs.spend(address, reserve, amount, fee, txid, true)
+}
+
+func (rs *ReserveService) spend(address, reserve string, amount, fee int64, txid string, held bool) error {
+	if amount <= 0 {
+		return errors.New("Amount is invalid")
+	}
+
+	tx := rs.db.Begin()
+	res, err := rs.getActiveReserve(tx, address, reserve)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var update *gorm.DB
+	if held {
+		update = tx.Table(
+			"reserves",
+		).Where(
+			"id = ? AND held >= ?", res.ID, amount,
+		).Updates(map[string]interface{}{
+			"remaining": gorm.Expr("remaining - ?", amount),
+			"held":      gorm.Expr("held - ?", amount),
+			"fee":       gorm.Expr("fee + ?", fee),
+		})
+	} else {
+		update = tx.Table(
+			"reserves",
+		).Where(
+			"id = ? AND remaining - held >= ?", res.ID, amount,
+		).Updates(map[string]interface{}{
+			"remaining": gorm.Expr("remaining - ?", amount),
+			"fee":       gorm.Expr("fee + ?", fee),
+		})
+	}
+	if update.Error != nil {
+		tx.Rollback()
+		return update.Error
+	}
+	if update.RowsAffected != 1 {
+		tx.Rollback()
+		return errors.New("Amount exceeds what is left in the reserve")
+	}
+
+	err = tx.Table(
+		"reserves",
+	).Where(
+		"id = ? AND remaining = 0", res.ID,
+	).Update("spent", true).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := rs.recordEventWithFee(tx, res.ID, RESERVE_EVENT_SPENT, amount, fee, txid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = rs.postToJournal(tx, JOURNAL_MEMO_SPEND, txid,
+		ReservedAccount(address), InFlightAccount(address), amount)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	rs.publish(ReserveSpent{address, reserve, amount, txid})
+	return nil
+}
+
+// HoldReserve puts amount of a reserve aside for a payout that will be
+// broadcast later, so that it cannot be spent twice in the meantime.
+func (rs *ReserveService) HoldReserve(address, reserve string, amount int64) error {
+	if amount <= 0 {
+		return errors.New("Amount is invalid")
+	}
+
+	update := rs.db.Table(
+		"reserves",
+	).Where(
+		"address = ? AND uuid = ? AND spent = ? AND remaining - held >= ?",
+		address, reserve, false, amount,
+	).Update("held", gorm.Expr("held + ?", amount))
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected != 1 {
+		return errors.New("Amount exceeds what is left in the reserve")
+	}
+	return nil
+}
+
+// ReleaseHold gives back an amount put aside with HoldReserve.
+func (rs *ReserveService) ReleaseHold(address, reserve string, amount int64) error {
+	update := rs.db.Table(
+		"reserves",
+	).Where(
+		"address = ? AND uuid = ? AND held >= ?", address, reserve, amount,
+	).Update("held", gorm.Expr("held - ?", amount))
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected != 1 {
+		return errors.New("Reserve does not hold that amount")
+	}
+	return nil
+}
+
+// AdjustReserve grows or shrinks what is left in a reserve by delta.
+// Growing a reserve is only allowed up to what available says, the part of
+// the address balance not already held by other reserves. It is asked
+// under the lock of the service, like AddReserveAvailable.
+func (rs *ReserveService) AdjustReserve(address, reserve string, delta int64, available func(address string) int64) error {
+	if delta == 0 {
+		return errors.New("Amount is invalid")
+	}
+	if delta > 0 {
+		rs.Lock()
+		defer rs.Unlock()
+		if delta > available(address) {
+			return errors.New("Amount is too high")
+		}
+	}
+
+	tx := rs.db.Begin()
+	res, err := rs.getActiveReserve(tx, address, reserve)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	kind := RESERVE_EVENT_INCREASED
+	amount := delta
+	update := tx.Table("reserves").Where("id = ?", res.ID)
+	if delta < 0 {
+		kind = RESERVE_EVENT_DECREASED
+		amount = -delta
+		// Checked in the update itself, as spends may take from the
+		// reserve meanwhile
+		update = update.Where("remaining - held > ?", amount)
+	}
+	update = update.Updates(map[string]interface{}{
+		"amount":    gorm.Expr("amount + ?", delta),
+		"remaining": gorm.Expr("remaining + ?", delta),
+	})
+	if update.Error != nil {
+		tx.Rollback()
+		return update.Error
+	}
+	if update.RowsAffected != 1 {
+		tx.Rollback()
+		return errors.New("Amount exceeds what is left in the reserve")
+	}
+
+	if err := rs.recordEvent(tx, res.ID, kind, amount, ""); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = rs.postToJournal(tx, JOURNAL_MEMO_RESERVE, reserve,
+		FundsAccount(address), ReservedAccount(address), delta)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// RecentSpendTxids lists the transactions that spent reserves since a
+// given time and were not reverted.
+func (rs *ReserveService) RecentSpendTxids(since time.Time) ([]string, error) {
+	var events []*ReserveEvent
+	err := rs.db.Where(
+		"kind IN (?) AND txid != '' AND created_at > ?",
+		[]string{RESERVE_EVENT_SPENT, RESERVE_EVENT_REVERTED, RESERVE_EVENT_CANCELLED}, since,
+	).Order("id").Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+
+	spent := make(map[string]bool)
+	var txids []string
+	for _, event := range events {
+		if event.Kind != RESERVE_EVENT_SPENT {
+			spent[event.Txid] = false
+			continue
+		}
+		if _, ok := spent[event.Txid]; !ok {
+			txids = append(txids, event.Txid)
+		}
+		spent[event.Txid] = true
+	}
+
+	var res []string
+	for _, txid := range txids {
+		if spent[txid] {
+			res = append(res, txid)
+		}
+	}
+	return res, nil
+}
+
+// RevertSpend gives back to their reserves the amounts spent by a
+// transaction that is no longer on the chain.
+func (rs *ReserveService) RevertSpend(txid string) error {
+	_, err := rs.undoSpend(txid, RESERVE_EVENT_REVERTED, false)
+	return err
+}
+
+// CancelSpend gives back to their reserves the amounts spent by a
+// transaction that was double-spent back to the account, and returns how
+// much was given back.
+func (rs *ReserveService) CancelSpend(txid string) (int64, error) {
+	return rs.undoSpend(txid, RESERVE_EVENT_CANCELLED, true)
+}
+
+// undoSpend puts the amounts spent by txid back into their reserves,
+// recording kind. With rebook, the journal moves them from the funds of
+// the address back to its reserved balance.
+func (rs *ReserveService) undoSpend(txid, kind string, rebook bool) (int64, error) {
+	tx := rs.db.Begin()
+	var spends []*ReserveEvent
+	err := tx.Where("kind = ? AND txid = ?", RESERVE_EVENT_SPENT, txid).Find(&spends).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if len(spends) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	// Spends undone before SpendUndo existed only left events behind
+	var undone int
+	err = tx.Model(&ReserveEvent{}).Where(
+		"kind IN (?) AND txid = ?", []string{RESERVE_EVENT_REVERTED, RESERVE_EVENT_CANCELLED}, txid,
+	).Count(&undone).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if undone == 0 {
+		err = tx.Model(&SpendUndo{}).Where("txid = ?", txid).Count(&undone).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if undone > 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+	// Should another undo of txid get here first, the unique txid makes
+	// this insert, and so the whole undo, fail
+	if err := tx.Create(&SpendUndo{Txid: txid, Kind: kind}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var total int64
+	for _, spend := range spends {
+		err := tx.Table(
+			"reserves",
+		).Where(
+			"id = ?", spend.ReserveID,
+		).Updates(map[string]interface{}{
+			"remaining": gorm.Expr("remaining + ?", spend.Amount),
+			"fee":       gorm.Expr("fee - ?", spend.Fee),
+			"spent":     false,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := rs.recordEvent(tx, spend.ReserveID, kind, spend.Amount, txid); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if rebook {
+			var res Reserve
+			if err := tx.First(&res, spend.ReserveID).Error; err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+			err := rs.postToJournal(tx, JOURNAL_MEMO_RESERVE, res.Uuid,
+				FundsAccount(res.Address), ReservedAccount(res.Address), spend.Amount)
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		total += spend.Amount
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// GetReserve returns a reserve, spent or not, together with its audit trail.
+func (rs *ReserveService) GetReserve(address, reserve string) (*Reserve, error) {
+	var res Reserve
+	query := rs.db.Preload("Events").Where("address = ? AND uuid = ?", address, reserve).First(&res)
+	if query.RecordNotFound() {
+		return nil, errors.New("Reserve does not exist")
+	}
+	if query.Error != nil {
+		return nil, query.Error
+	}
+	return &res, nil
+}
+
+func (rs *ReserveService) GetAmountReservedForReserve(address, reserve string) (int64, error) {
+	res, err := rs.getActiveReserve(rs.db, address, reserve)
+	if err != nil {
+		return -1, err
 	}
-	return int64(res[0].Amount), nil
+	return int64(res.Remaining - res.Held), nil
 }
 
 func (rs *ReserveService) GetAmountReservedForAddress(address string) int64 {
@@ -78,7 +560,7 @@ func (rs *ReserveService) GetAmountReservedForAddress(address string) int64 {
 	err := rs.db.Table(
 		"reserves",
 	).Select(
-		"sum(amount) as total",
+		"sum(remaining) as total",
 	).Where(
 		"address = ? AND spent = ?", address, false,
 	).Group("address").Scan(&results).Error
@@ -24,8 +24,27 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		panic(err)
 	}
-	testDB.AutoMigrate(&Reserve{})
+	if err := MigrateReserves(testDB); err != nil {
+		panic(err)
+	}
 	testDB.AutoMigrate(&Account{})
+	testDB.AutoMigrate(&IdempotencyRecord{})
+	testDB.AutoMigrate(&PayoutRequest{})
+	testDB.AutoMigrate(&LedgerTransfer{})
+	testDB.AutoMigrate(&JournalEntry{})
+	testDB.AutoMigrate(&InFlightSpend{})
+	testDB.AutoMigrate(&InFlightOutpoint{})
+	testDB.AutoMigrate(&CachedUTXO{})
+	testDB.AutoMigrate(&SyncState{})
+	testDB.AutoMigrate(&WatchedAddress{})
+	testDB.AutoMigrate(&WalletEvent{})
+	testDB.AutoMigrate(&Webhook{})
+	testDB.AutoMigrate(&WebhookDelivery{})
+	testDB.AutoMigrate(&TransactionRecord{})
+	testDB.AutoMigrate(&BroadcastTransaction{})
+	testDB.AutoMigrate(&FeeReplacement{})
+	testDB.AutoMigrate(&ChangeAddress{})
+	testDB.AutoMigrate(&Cancellation{})
 	rs = NewReserverService(testDB)
 	m.Run()
 }
@@ -50,3 +69,57 @@ func TestNewReserveCountForUser(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPartialSpendAndAdjustReserve(t *testing.T) {
+	reserveId, err := rs.AddReserveForAddress("partialAddress", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rs.SpendReserve("partialAddress", reserveId, 400, 0, "tx1"); err != nil {
+		t.Fail()
+	}
+	if res, _ := rs.GetAmountReservedForReserve("partialAddress", reserveId); res != 600 {
+		t.Log(res)
+		t.Fail()
+	}
+	if err := rs.SpendReserve("partialAddress", reserveId, 700, 0, "tx2"); err == nil {
+		t.Fail()
+	}
+
+	available := func(address string) int64 {
+		return 100
+	}
+	if err := rs.AdjustReserve("partialAddress", reserveId, 500, available); err == nil {
+		t.Fail()
+	}
+	if err := rs.AdjustReserve("partialAddress", reserveId, 100, available); err != nil {
+		t.Fail()
+	}
+	if err := rs.AdjustReserve("partialAddress", reserveId, -700, available); err == nil {
+		t.Fail()
+	}
+	if err := rs.AdjustReserve("partialAddress", reserveId, -200, available); err != nil {
+		t.Fail()
+	}
+	if res := rs.GetAmountReservedForAddress("partialAddress"); res != 500 {
+		t.Log(res)
+		t.Fail()
+	}
+
+	if err := rs.SpendReserve("partialAddress", reserveId, 500, 0, "tx3"); err != nil {
+		t.Fail()
+	}
+	if _, err := rs.GetAmountReservedForReserve("partialAddress", reserveId); err == nil {
+		t.Fail()
+	}
+
+	reserve, err := rs.GetReserve("partialAddress", reserveId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserve.Spent || reserve.Amount != 900 || len(reserve.Events) != 5 {
+		t.Log(reserve)
+		t.Fail()
+	}
+}
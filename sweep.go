@@ -0,0 +1,228 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Times a sweep is signed again to make its fee match its size
+const SWEEP_SIGNING_ATTEMPTS = 3
+
+// virtualSize is the size of tx fee rates apply to: witness data counts
+// for a quarter of its bytes.
+func virtualSize(tx *wire.MsgTx) int64 {
+	weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize()
+	return int64((weight + 3) / 4)
+}
+
+// spendableOutputs lists the outputs of address the monitor lets us spend.
+func (utm *UnspentTransactionMonitor) spendableOutputs(address string) []BlockrUnspentItem {
+	utm.RLock()
+	defer utm.RUnlock()
+	var items []BlockrUnspentItem
+	if balance, ok := utm.balances[address]; ok {
+		for _, item := range balance.UnspentTransactions {
+			if utm.config.isSpendable(&item) {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// sweepSources are the addresses a sweep of address spends from: address
+// itself, then its change addresses.
+func (tm *TransactionManager) sweepSources(address string) ([]string, error) {
+	sources := []string{address}
+	if tm.changes == nil || tm.ledger == nil {
+		return sources, nil
+	}
+	changes, err := tm.changes.ForAccount(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		sources = append(sources, change.Address)
+	}
+	return sources, nil
+}
+
+// sweptSpend is a signed sweep and where its inputs came from.
+type sweptSpend struct {
+	txBytes []byte
+	amount  int64
+	fee     int64
+	// What the sweep takes from each address spent from
+	spent map[string]int64
+}
+
+// buildSweep spends every spendable output of address and of its change
+// addresses to destination, with no change output, paying feeRate
+// satoshis per virtual byte. Outputs covering the active reserves of
+// address, and what it owes other addresses, are left in place.
+func (tm *TransactionManager) buildSweep(
+	address string,
+	pk *btcec.PrivateKey,
+	destination string,
+	feeRate int64,
+) (*sweptSpend, error) {
+	if feeRate <= 0 {
+		return nil, errors.New("Fee rate is invalid")
+	}
+	dstScript, err := makeOutputScript(destination)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := tm.sweepSources(address)
+	if err != nil {
+		return nil, err
+	}
+
+	utm := tm.unspentTransactionMonitorInstance
+	var spendable int64
+	for _, source := range sources {
+		for _, item := range utm.spendableOutputs(source) {
+			spendable += item.Satoshis()
+		}
+	}
+	sweepable := spendable - tm.reserveInstance.GetAmountReservedForAddress(address)
+	if free := tm.freeFunds(address); free < sweepable {
+		sweepable = free
+	}
+	if sweepable <= 0 {
+		return nil, errors.New("Nothing to sweep")
+	}
+
+	// Keep back outputs of the account address first, so that change
+	// addresses are emptied
+	keep := spendable - sweepable
+	exclude := make(map[string]bool)
+	for _, source := range sources {
+		for _, item := range utm.spendableOutputs(source) {
+			if keep <= 0 {
+				break
+			}
+			exclude[item.Outpoint()] = true
+			keep -= item.Satoshis()
+		}
+	}
+
+	tx := wire.NewMsgTx()
+	var scripts [][]byte
+	var keys []*btcec.PrivateKey
+	var total int64
+	spent := make(map[string]int64)
+	for _, source := range sources {
+		balance, err := utm.GetUTXOBalanceForAddress(source)
+		if err != nil || balance <= 0 {
+			continue
+		}
+		txIns, sourceScripts, sourceSpent := utm.getTXinsExcluding(source, balance, exclude)
+		if len(txIns) == 0 || sourceSpent <= 0 {
+			continue
+		}
+		key := pk
+		if source != address {
+			if key, err = tm.changes.Keys(source); err != nil {
+				return nil, err
+			}
+		}
+		for idx, txin := range txIns {
+			tx.AddTxIn(txin)
+			scripts = append(scripts, sourceScripts[idx])
+			keys = append(keys, key)
+		}
+		spent[source] = sourceSpent
+		total += sourceSpent
+	}
+	if len(tx.TxIn) == 0 {
+		return nil, errors.New("Nothing to sweep")
+	}
+
+	// Signatures vary in length with what they sign, so the fee is set
+	// from the signed size until both agree. Should they keep moving by a
+	// byte, the larger fee is kept.
+	var fee int64
+	output := wire.NewTxOut(total, dstScript)
+	tx.AddTxOut(output)
+	for attempt := 0; ; attempt++ {
+		output.Value = total - fee
+		if output.Value < DustThreshold(dstScript) {
+			return nil, errors.New("Balance is too small to pay for the sweep")
+		}
+		if err := tm.signTransaction(tx, scripts, keys); err != nil {
+			return nil, err
+		}
+		needed := feeRate * virtualSize(tx)
+		if needed == fee || (needed < fee && attempt >= SWEEP_SIGNING_ATTEMPTS) {
+			break
+		}
+		fee = needed
+	}
+
+	txBytes, err := serializeTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	return &sweptSpend{
+		txBytes: txBytes,
+		amount:  output.Value,
+		fee:     fee,
+		spent:   spent,
+	}, nil
+}
+
+// Sweep sends everything address can spend, less what its active reserves
+// hold, to destination in a single output, for example to close an
+// account or move its funds to cold storage. It returns the txid, the
+// amount destination receives and the fee, at feeRate satoshis per
+// virtual byte.
+func (tm *TransactionManager) Sweep(
+	address string,
+	pk *btcec.PrivateKey,
+	destination string,
+	feeRate int64,
+) (string, int64, int64, error) {
+	tm.Lock()
+	defer tm.Unlock()
+
+	sweep, err := tm.buildSweep(address, pk, destination, feeRate)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	txid, err := tm.broadcastTransaction(sweep.txBytes)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	Info.Printf("Swept %d from %s to %s in %s, paying %d\n", sweep.amount, address, destination, txid, sweep.fee)
+
+	spentFrom := []string{address}
+	for source := range sweep.spent {
+		if source != address {
+			spentFrom = append(spentFrom, source)
+		}
+	}
+	paid := sweep.amount + sweep.fee
+	tm.trackBroadcast(txid, sweep.txBytes, sweep.fee, []Payment{
+		{Address: address, Destination: destination, Amount: paid, Fee: sweep.fee},
+	}, spentFrom...)
+	if tm.journal != nil {
+		err := tm.journal.postAtomically(JOURNAL_MEMO_SPEND, txid,
+			Leg{FundsAccount(address), -paid}, Leg{InFlightAccount(address), paid})
+		if err != nil {
+			Error.Println(err)
+		}
+	}
+
+	// Change addresses hold what they spent for address
+	for source, amount := range sweep.spent {
+		if source == address {
+			continue
+		}
+		if err := tm.ledger.Settle(address, source, amount, txid); err != nil {
+			Error.Println(err)
+		}
+	}
+	return txid, sweep.amount, sweep.fee, nil
+}
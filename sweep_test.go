@@ -0,0 +1,85 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"testing"
+)
+
+func TestBuildSweep(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+
+	pk, _ := btcec.NewPrivateKey(btcec.S256())
+	address, _ := btcutil.NewAddressPubKey(pk.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	script, _ := txmgr.makePayToPubkeyHashScript(address.EncodeAddress())
+	destination, _ := makeOutputScript("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		address.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 150000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "f1631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(script),
+					Amount:        "0.5",
+					Confirmations: 1,
+				},
+				BlockrUnspentItem{
+					Tx:            "f2631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           1,
+					Script:        hex.EncodeToString(script),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+
+	if _, err := txmgr.buildSweep(address.EncodeAddress(), pk, "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 0); err == nil {
+		t.Fail()
+	}
+
+	// Everything goes to the destination, in a single output
+	sweep, err := txmgr.buildSweep(address.EncodeAddress(), pk, "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(sweep.txBytes))
+	if len(tx.TxIn) != 2 || len(tx.TxOut) != 1 || !bytes.Equal(tx.TxOut[0].PkScript, destination) {
+		t.FailNow()
+	}
+	vsize := virtualSize(tx)
+	if sweep.fee < 10*vsize || sweep.fee > 10*(vsize+int64(len(tx.TxIn))) {
+		t.Fail()
+	}
+	if sweep.amount+sweep.fee != 150000000 {
+		t.Fail()
+	}
+
+	// The output covering an active reserve stays behind
+	txmgr.reserveInstance.AddReserveForAddress(address.EncodeAddress(), 40000000)
+	sweep, err = txmgr.buildSweep(address.EncodeAddress(), pk, "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = wire.NewMsgTx()
+	tx.Deserialize(bytes.NewReader(sweep.txBytes))
+	if len(tx.TxIn) != 1 || tx.TxIn[0].PreviousOutPoint.Index != 1 || sweep.amount+sweep.fee != 100000000 {
+		t.Fail()
+	}
+
+	// Nothing is left once reserves hold everything
+	txmgr.reserveInstance.AddReserveForAddress(address.EncodeAddress(), 110000000)
+	if _, err := txmgr.buildSweep(address.EncodeAddress(), pk, "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", 10); err == nil {
+		t.Fail()
+	}
+}
@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"gopkg.in/redis.v5"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -23,6 +25,17 @@ const (
 	REFRESH_UTXO_TIME      = time.Second * 5
 	BLOCKR_UTXO_ADDRESS    = "http://btc.blockr.io/api/v1/address/unspent/"
 	BLOCKR_PUSHTX_ADDRESS  = "http://btc.blockr.io/api/v1/tx/push"
+
+	DEFAULT_MIN_CONFIRMATIONS = 1
+	DEFAULT_BATCH_SIZE        = 10
+	DEFAULT_CONCURRENCY       = 4
+	DEFAULT_REQUESTS_PER_SEC  = 5
+	DEFAULT_REQUEST_TIMEOUT   = time.Second * 5
+	DEFAULT_MAX_ATTEMPTS      = 3
+	DEFAULT_BACKOFF_BASE      = time.Millisecond * 500
+	DEFAULT_BACKOFF_MAX       = time.Second * 10
+	// Coinbase outputs can only be spent after this many confirmations
+	COINBASE_MATURITY = 100
 )
 
 var (
@@ -45,17 +58,41 @@ type BlockrUnspentItem struct {
 	Idx           int    `json:"n"`
 	Confirmations int    `json:"confirmations"`
 	Script        string `json:"script"`
+	// Set when the backend reports the output as coming from a coinbase
+	Coinbase bool `json:"is_coinbase"`
 }
 
+// Satoshis returns 0 for a malformed amount. Items coming from the
+// backend are checked by validate before they are used.
 func (b *BlockrUnspentItem) Satoshis() int64 {
 	amountFloat, err := strconv.ParseFloat(b.Amount, 64)
 	if err != nil {
-		Error.Fatal(err)
+		Error.Println(err)
+		return 0
 	}
 	res := amountFloat * SATOSHI_IN_BITCOIN
 	return int64(res)
 }
 
+// validate checks that the backend sent an item we can spend from.
+func (b *BlockrUnspentItem) validate() error {
+	if _, err := strconv.ParseFloat(b.Amount, 64); err != nil {
+		return errors.New("Malformed amount for " + b.Outpoint())
+	}
+	if _, err := chainhash.NewHashFromStr(b.Tx); err != nil {
+		return errors.New("Malformed txid for " + b.Outpoint())
+	}
+	if _, err := hex.DecodeString(b.Script); err != nil {
+		return errors.New("Malformed script for " + b.Outpoint())
+	}
+	return nil
+}
+
+// Outpoint identifies the output as "txid:index".
+func (b *BlockrUnspentItem) Outpoint() string {
+	return fmt.Sprintf("%s:%d", b.Tx, b.Idx)
+}
+
 type BlockrUnspentResponse struct {
 	Status string `json:"status"`
 	Data   []struct {
@@ -65,9 +102,137 @@ type BlockrUnspentResponse struct {
 }
 
 type AddressBalanceMapping struct {
-	Address             string
-	Balance             int64
+	Address string
+	// Balance is what can be spent under the monitor's confirmation policy
+	Balance int64
+	// Confirmed outputs have at least one confirmation
+	Confirmed int64
+	// Pending outputs have no confirmation yet
+	Pending int64
+	// Immature outputs are coinbase outputs that cannot be spent yet
+	Immature            int64
 	UnspentTransactions []BlockrUnspentItem
+	// When the backend last answered for this address
+	UpdatedAt time.Time
+	// Set when the last refresh failed and the figures above are the last
+	// known good ones
+	Stale       bool
+	StaleReason string
+}
+
+// MonitorConfig tunes how UnspentTransactionMonitor treats what it sees.
+type MonitorConfig struct {
+	// Outputs need this many confirmations to count towards Balance and
+	// to be picked by coin selection
+	MinConfirmations int
+	// How often balances are refreshed and the monitored addresses reloaded
+	RefreshInterval   time.Duration
+	AddressesInterval time.Duration
+	// Addresses queried per request
+	BatchSize int
+	// Requests in flight at the same time
+	Concurrency int
+	// Requests per second sent to any backend, unless BackendRateLimits
+	// has an entry for its host
+	RequestsPerSecond float64
+	BackendRateLimits map[string]float64
+	RequestTimeout    time.Duration
+	// A failed batch is tried this many times, waiting BackoffBase,
+	// then twice as long each time up to BackoffMax
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+}
+
+func DefaultMonitorConfig() MonitorConfig {
+	return MonitorConfig{
+		MinConfirmations:  DEFAULT_MIN_CONFIRMATIONS,
+		RefreshInterval:   REFRESH_ADDRESSES_TIME,
+		AddressesInterval: REFRESH_UTXO_TIME,
+		BatchSize:         DEFAULT_BATCH_SIZE,
+		Concurrency:       DEFAULT_CONCURRENCY,
+		RequestsPerSecond: DEFAULT_REQUESTS_PER_SEC,
+		RequestTimeout:    DEFAULT_REQUEST_TIMEOUT,
+		MaxAttempts:       DEFAULT_MAX_ATTEMPTS,
+		BackoffBase:       DEFAULT_BACKOFF_BASE,
+		BackoffMax:        DEFAULT_BACKOFF_MAX,
+	}
+}
+
+// withDefaults fills the fields left at zero with their default.
+func (config MonitorConfig) withDefaults() MonitorConfig {
+	defaults := DefaultMonitorConfig()
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaults.RefreshInterval
+	}
+	if config.AddressesInterval <= 0 {
+		config.AddressesInterval = defaults.AddressesInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaults.Concurrency
+	}
+	if config.RequestsPerSecond <= 0 {
+		config.RequestsPerSecond = defaults.RequestsPerSecond
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaults.RequestTimeout
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaults.MaxAttempts
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = defaults.BackoffBase
+	}
+	if config.BackoffMax <= 0 {
+		config.BackoffMax = defaults.BackoffMax
+	}
+	return config
+}
+
+// backoff is how long to wait before the given retry, counting from 1.
+func (config *MonitorConfig) backoff(retry int) time.Duration {
+	wait := config.BackoffBase
+	for i := 1; i < retry && wait < config.BackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > config.BackoffMax {
+		wait = config.BackoffMax
+	}
+	return wait
+}
+
+func (config *MonitorConfig) isSpendable(item *BlockrUnspentItem) bool {
+	if item.Coinbase && item.Confirmations < COINBASE_MATURITY {
+		return false
+	}
+	return item.Confirmations >= config.MinConfirmations
+}
+
+func (config *MonitorConfig) newAddressBalanceMapping(address string, unspent []BlockrUnspentItem) *AddressBalanceMapping {
+	mapping := &AddressBalanceMapping{
+		Address:             address,
+		UnspentTransactions: unspent,
+		UpdatedAt:           time.Now(),
+	}
+	for idx := range unspent {
+		record := &unspent[idx]
+		satoshis := record.Satoshis()
+		if record.Confirmations > 0 {
+			mapping.Confirmed += satoshis
+		} else {
+			mapping.Pending += satoshis
+		}
+		if record.Coinbase && record.Confirmations < COINBASE_MATURITY {
+			mapping.Immature += satoshis
+		}
+		if config.isSpendable(record) {
+			mapping.Balance += satoshis
+		}
+	}
+	return mapping
 }
 
 func (abm *AddressBalanceMapping) ToBTC() string {
@@ -75,29 +240,215 @@ func (abm *AddressBalanceMapping) ToBTC() string {
 	return fmt.Sprintf("%f", res)
 }
 
+const (
+	UTXO_ADDED   = "added"
+	UTXO_UPDATED = "updated"
+	UTXO_REMOVED = "removed"
+)
+
+// UTXOChange describes how an unspent output of a monitored address changed
+// between two refreshes. UTXO_UPDATED means its confirmations changed.
+type UTXOChange struct {
+	Kind    string
+	Address string
+	Item    BlockrUnspentItem
+	// Whether the output now counts towards the address Balance
+	Spendable bool
+}
+
+// diffBalances lists the changes between two snapshots. Addresses missing
+// from current were not refreshed, so their outputs are not reported as
+// removed.
+func (config *MonitorConfig) diffBalances(previous, current map[string]*AddressBalanceMapping) []UTXOChange {
+	var changes []UTXOChange
+	for address, mapping := range current {
+		known := make(map[string]BlockrUnspentItem)
+		if old, ok := previous[address]; ok {
+			for _, item := range old.UnspentTransactions {
+				known[item.Outpoint()] = item
+			}
+		}
+
+		for _, item := range mapping.UnspentTransactions {
+			old, ok := known[item.Outpoint()]
+			delete(known, item.Outpoint())
+			if !ok {
+				changes = append(changes, UTXOChange{UTXO_ADDED, address, item, config.isSpendable(&item)})
+			} else if old.Confirmations != item.Confirmations {
+				changes = append(changes, UTXOChange{UTXO_UPDATED, address, item, config.isSpendable(&item)})
+			}
+		}
+		for _, item := range known {
+			changes = append(changes, UTXOChange{UTXO_REMOVED, address, item, false})
+		}
+	}
+	return changes
+}
+
 type UnspentTransactionMonitor struct {
 	sync.RWMutex
-	balances                         map[string]*AddressBalanceMapping
-	netClient                        *http.Client
-	client                           *redis.Client
-	addressList                      []string
-	fetchAddressesTicker             *time.Ticker
-	refreshUnspentTransactionsTicker *time.Ticker
+	config      MonitorConfig
+	balances    map[string]*AddressBalanceMapping
+	bus         *EventBus
+	blocks      *BlockTracker
+	limiters    map[string]*rateLimiter
+	cache       *UTXOCache
+	netClient   *http.Client
+	client      *redis.Client
+	addressList []string
+	// Addresses to re-query on the next tick, with when they were marked
+	dirty map[string]time.Time
+	// When each address was last refreshed
+	lastPolled map[string]time.Time
+	watchList  *WatchList
+	schedules  map[string]watchSchedule
+	lastImport time.Time
+	status     MonitorStatus
+	// Set while the monitor runs in the background
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// rateLimiter spaces out requests to a backend.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
 }
 
-func (utm *UnspentTransactionMonitor) makeWalletRequest(addresses []string) chan (*http.Response) {
-	addressesStr := strings.Join(addresses, ",")
-	path := BLOCKR_UTXO_ADDRESS + addressesStr
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+	}
+}
 
-	returnChan := make(chan *http.Response)
-	go func() {
-		res, err := utm.netClient.Get(path)
-		if err != nil {
-			Error.Println(err)
+// Wait blocks until the next request is allowed or ctx is done.
+func (rl *rateLimiter) Wait(ctx context.Context) error {
+	rl.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	wait := rl.next.Sub(now)
+	rl.next = rl.next.Add(rl.interval)
+	rl.Unlock()
+	return sleepContext(ctx, wait)
+}
+
+// sleepContext sleeps for d, returning early with the error of ctx when it
+// is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (utm *UnspentTransactionMonitor) limiterFor(path string) *rateLimiter {
+	host := path
+	if parsed, err := url.Parse(path); err == nil {
+		host = parsed.Host
+	}
+
+	utm.Lock()
+	defer utm.Unlock()
+	if limiter, ok := utm.limiters[host]; ok {
+		return limiter
+	}
+	perSecond, ok := utm.config.BackendRateLimits[host]
+	if !ok {
+		perSecond = utm.config.RequestsPerSecond
+	}
+	limiter := newRateLimiter(perSecond)
+	utm.limiters[host] = limiter
+	return limiter
+}
+
+// get sends a request to a backend, respecting its rate limit.
+func (utm *UnspentTransactionMonitor) get(ctx context.Context, path string) (*http.Response, error) {
+	if err := utm.limiterFor(path).Wait(ctx); err != nil {
+		return nil, err
+	}
+	return getWithContext(ctx, utm.netClient, path)
+}
+
+func (utm *UnspentTransactionMonitor) unspentURL(addresses []string) string {
+	return BLOCKR_UTXO_ADDRESS + strings.Join(addresses, ",")
+}
+
+// fetchBatch queries the unspent outputs of up to BatchSize addresses.
+func (utm *UnspentTransactionMonitor) fetchBatch(ctx context.Context, addresses []string) (map[string]*AddressBalanceMapping, error) {
+	res, err := utm.get(ctx, utm.unspentURL(addresses))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var decodedResponse BlockrUnspentResponse
+	if err := json.NewDecoder(res.Body).Decode(&decodedResponse); err != nil {
+		return nil, err
+	}
+	if decodedResponse.Status != "success" {
+		return nil, errors.New("Decoded response status: " + decodedResponse.Status)
+	}
+
+	balances := make(map[string]*AddressBalanceMapping)
+	for _, entry := range decodedResponse.Data {
+		for idx := range entry.Unspent {
+			if err := entry.Unspent[idx].validate(); err != nil {
+				return nil, err
+			}
 		}
-		returnChan <- res
-	}()
-	return returnChan
+		address := entry.Address
+		balances[address] = utm.config.newAddressBalanceMapping(address, entry.Unspent)
+		Info.Printf("%s has a balance of %s with %d unspent transactions\n", address, balances[address].ToBTC(), len(entry.Unspent))
+	}
+	return balances, nil
+}
+
+// fetchBatchWithRetry retries a failed batch with exponential backoff.
+func (utm *UnspentTransactionMonitor) fetchBatchWithRetry(ctx context.Context, addresses []string) (map[string]*AddressBalanceMapping, error) {
+	var err error
+	for attempt := 1; attempt <= utm.config.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, utm.config.backoff(attempt-1)); err != nil {
+				return nil, err
+			}
+		}
+		var balances map[string]*AddressBalanceMapping
+		balances, err = utm.fetchBatch(ctx, addresses)
+		if err == nil {
+			return balances, nil
+		}
+		Error.Printf("Fetching %d addresses failed (attempt %d): %s\n", len(addresses), attempt, err)
+	}
+	return nil, err
+}
+
+// SetEventBus makes the monitor publish what it sees on bus, so that the
+// reserves and transaction manager share it.
+func (utm *UnspentTransactionMonitor) SetEventBus(bus *EventBus) {
+	utm.Lock()
+	utm.bus = bus
+	utm.Unlock()
+}
+
+// EventBus is where the monitor publishes UTXO and block events.
+func (utm *UnspentTransactionMonitor) EventBus() *EventBus {
+	utm.RLock()
+	defer utm.RUnlock()
+	return utm.bus
+}
+
+func (utm *UnspentTransactionMonitor) publishUTXOChanges(ctx context.Context, changes []UTXOChange) {
+	bus := utm.EventBus()
+	for _, change := range changes {
+		bus.Publish(ctx, newUTXOEvent(change))
+	}
 }
 
 func (utm *UnspentTransactionMonitor) GetAddresses() []string {
@@ -110,22 +461,19 @@ func (utm *UnspentTransactionMonitor) registerAddresses(addresses []string) {
 	utm.Unlock()
 }
 
-func (utm *UnspentTransactionMonitor) getAddressesToMonitor() []string {
-	start := time.Now()
-	stop := time.Now().Add(-time.Hour * 24)
-	results, err := utm.client.ZRangeByScore("seen_addresses", redis.ZRangeBy{
-		Min: strconv.FormatInt(stop.Unix(), 10),
-		Max: strconv.FormatInt(start.Unix(), 10),
-	}).Result()
-	if err != nil {
-		Error.Fatal(err)
-	}
-	return results
+func (utm *UnspentTransactionMonitor) GetTXinsForAddress(
+	address string,
+	amount int64,
+) ([]*wire.TxIn, [][]byte, int64) {
+	return utm.getTXinsExcluding(address, amount, nil)
 }
 
-func (utm *UnspentTransactionMonitor) GetTXinsForAddress(
+// getTXinsExcluding is GetTXinsForAddress skipping the outpoints in
+// exclude. Every input signals replaceability, see RBF_SEQUENCE.
+func (utm *UnspentTransactionMonitor) getTXinsExcluding(
 	address string,
 	amount int64,
+	exclude map[string]bool,
 ) ([]*wire.TxIn, [][]byte, int64) {
 
 	utm.RLock()
@@ -143,9 +491,18 @@ func (utm *UnspentTransactionMonitor) GetTXinsForAddress(
 			if currentValue >= amount {
 				break
 			}
+			if !utm.config.isSpendable(&utxo) || exclude[utxo.Outpoint()] {
+				continue
+			}
 			hash, err := chainhash.NewHashFromStr(utxo.Tx)
 			if err != nil {
-				Error.Fatal(err)
+				Error.Println(err)
+				continue
+			}
+			byteScript, err := hex.DecodeString(utxo.Script)
+			if err != nil {
+				Error.Println(err)
+				continue
 			}
 			txin := wire.NewTxIn(
 				wire.NewOutPoint(
@@ -153,13 +510,8 @@ func (utm *UnspentTransactionMonitor) GetTXinsForAddress(
 				),
 				[]byte{},
 			)
+			txin.Sequence = RBF_SEQUENCE
 			res = append(res, txin)
-
-			byteScript, err := hex.DecodeString(utxo.Script)
-			if err != nil {
-				Error.Fatal(err)
-			}
-
 			scripts = append(scripts, byteScript)
 			currentValue += utxo.Satoshis()
 		}
@@ -168,6 +520,17 @@ func (utm *UnspentTransactionMonitor) GetTXinsForAddress(
 	return res, scripts, -1
 }
 
+// GetBalanceDetailsForAddress returns a copy of everything the monitor
+// knows about the balance of an address.
+func (utm *UnspentTransactionMonitor) GetBalanceDetailsForAddress(address string) (AddressBalanceMapping, error) {
+	utm.RLock()
+	defer utm.RUnlock()
+	if el, ok := utm.balances[address]; ok {
+		return *el, nil
+	}
+	return AddressBalanceMapping{}, errors.New(fmt.Sprintf("Address %s was not found\n", address))
+}
+
 func (utm *UnspentTransactionMonitor) GetUTXOBalanceForAddress(address string) (int64, error) {
 	utm.RLock()
 	defer utm.RUnlock()
@@ -177,79 +540,304 @@ func (utm *UnspentTransactionMonitor) GetUTXOBalanceForAddress(address string) (
 	return -1, errors.New(fmt.Sprintf("Address %s was not found\n", address))
 }
 
-func (utm *UnspentTransactionMonitor) Run() {
+// TotalBalance is the balance of every monitored address added together.
+func (utm *UnspentTransactionMonitor) TotalBalance() int64 {
+	utm.RLock()
+	defer utm.RUnlock()
+	var total int64
+	for _, el := range utm.balances {
+		total += el.Balance
+	}
+	return total
+}
+
+// MarkDirty makes the next refresh re-query addresses, for example after
+// spending from them.
+func (utm *UnspentTransactionMonitor) MarkDirty(addresses ...string) {
+	utm.Lock()
+	defer utm.Unlock()
+	now := time.Now()
+	for _, address := range addresses {
+		utm.dirty[address] = now
+	}
+}
+
+// addressesToRefresh picks the addresses whose outputs may have changed:
+// new and dirty addresses, those whose poll interval elapsed, and when a
+// block arrived, hot addresses and those waiting for confirmations. The
+// order of the address list, highest priority first, is kept.
+func (utm *UnspentTransactionMonitor) addressesToRefresh(tipChanged bool, now time.Time) []string {
+	utm.RLock()
+	defer utm.RUnlock()
+
+	var addresses []string
+	for _, address := range utm.addressList {
+		mapping, known := utm.balances[address]
+		_, dirty := utm.dirty[address]
+		schedule := utm.scheduleFor(address)
+		due := now.Sub(utm.lastPolled[address]) >= schedule.Interval
+		confirming := known && mapping.Balance < mapping.Confirmed+mapping.Pending
+		if !known || dirty || due || (tipChanged && (schedule.Hot || confirming)) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+type batchResult struct {
+	addresses []string
+	balances  map[string]*AddressBalanceMapping
+	err       error
+}
+
+// fetchBalances queries the backend for addresses in batches, using a
+// bounded pool of workers. It runs without holding the lock. Addresses
+// whose batch kept failing are returned separately with the reason.
+func (utm *UnspentTransactionMonitor) fetchBalances(ctx context.Context, addresses []string) (map[string]*AddressBalanceMapping, map[string]string) {
+	var batches [][]string
+	for len(addresses) > 0 {
+		size := utm.config.BatchSize
+		if len(addresses) < size {
+			size = len(addresses)
+		}
+		batches = append(batches, addresses[:size])
+		addresses = addresses[size:]
+	}
+
+	workers := utm.config.Concurrency
+	if len(batches) < workers {
+		workers = len(batches)
+	}
+	jobs := make(chan []string)
+	results := make(chan batchResult)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for batch := range jobs {
+				balances, err := utm.fetchBatchWithRetry(ctx, batch)
+				results <- batchResult{batch, balances, err}
+			}
+		}()
+	}
+	go func() {
+		for _, batch := range batches {
+			jobs <- batch
+		}
+		close(jobs)
+	}()
+
+	balances := make(map[string]*AddressBalanceMapping)
+	failed := make(map[string]string)
+	for range batches {
+		result := <-results
+		if result.err != nil {
+			for _, address := range result.addresses {
+				failed[address] = result.err.Error()
+			}
+			continue
+		}
+		for address, mapping := range result.balances {
+			balances[address] = mapping
+		}
+	}
+	return balances, failed
+}
+
+// applyUpdates swaps the refreshed addresses into a new balances map and
+// drops addresses that are no longer monitored. Addresses that failed keep
+// their last known balance, marked as stale. Readers never see a
+// partially applied refresh.
+func (utm *UnspentTransactionMonitor) applyUpdates(
+	updates map[string]*AddressBalanceMapping,
+	failed map[string]string,
+	started time.Time,
+) []UTXOChange {
+	utm.Lock()
+	defer utm.Unlock()
+
+	monitored := make(map[string]bool)
+	for _, address := range utm.addressList {
+		monitored[address] = true
+	}
+
+	balances := make(map[string]*AddressBalanceMapping)
+	for address, mapping := range utm.balances {
+		if monitored[address] {
+			balances[address] = mapping
+		}
+	}
+	for address := range utm.lastPolled {
+		if !monitored[address] {
+			delete(utm.lastPolled, address)
+		}
+	}
+	for address, mapping := range updates {
+		balances[address] = mapping
+		utm.lastPolled[address] = started
+		// Keep addresses marked while the request was in flight
+		if marked, ok := utm.dirty[address]; ok && marked.Before(started) {
+			delete(utm.dirty, address)
+		}
+	}
+	for address, reason := range failed {
+		// Never fetched addresses stay unknown rather than empty
+		known, ok := balances[address]
+		if !ok {
+			continue
+		}
+		stale := &AddressBalanceMapping{}
+		*stale = *known
+		stale.Stale = true
+		stale.StaleReason = reason
+		balances[address] = stale
+	}
+
+	changes := utm.config.diffBalances(utm.balances, updates)
+	utm.balances = balances
+	return changes
+}
+
+// refresh re-queries the addresses that may have changed and notifies the
+// listeners. Network calls happen outside the lock so readers are never
+// blocked on the backend.
+func (utm *UnspentTransactionMonitor) refresh(ctx context.Context) {
+	started := time.Now()
+	tipChanged := utm.checkTip(ctx)
+	addresses := utm.addressesToRefresh(tipChanged, started)
+	updates, failed := utm.fetchBalances(ctx, addresses)
+	if ctx.Err() != nil {
+		// Shutting down, the failures are ours and not the backend's
+		return
+	}
+	changes := utm.applyUpdates(updates, failed, started)
+	utm.saveCache(updates, len(failed) == 0)
+
+	// Try the failed batches again on the next tick
+	for address, reason := range failed {
+		utm.MarkDirty(address)
+		utm.recordFailure(reason)
+	}
+	if len(failed) == 0 && len(addresses) > 0 {
+		utm.recordSuccess(started)
+	}
+	utm.publishUTXOChanges(ctx, changes)
+}
+
+// MonitorStatus tells whether the monitor is keeping up with the backend.
+type MonitorStatus struct {
+	// Set while the last attempt to reach the backend failed
+	Stale     bool      `json:"stale"`
+	Error     string    `json:"error,omitempty"`
+	ErrorAt   time.Time `json:"error_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (utm *UnspentTransactionMonitor) Status() MonitorStatus {
+	utm.RLock()
+	defer utm.RUnlock()
+	return utm.status
+}
+
+func (utm *UnspentTransactionMonitor) recordFailure(reason string) {
+	utm.Lock()
+	defer utm.Unlock()
+	utm.status.Stale = true
+	utm.status.Error = reason
+	utm.status.ErrorAt = time.Now()
+}
+
+func (utm *UnspentTransactionMonitor) recordSuccess(at time.Time) {
+	utm.Lock()
+	defer utm.Unlock()
+	// Something failed after this refresh started
+	if utm.status.ErrorAt.After(at) {
+		return
+	}
+	utm.status.Stale = false
+	utm.status.Error = ""
+	utm.status.UpdatedAt = at
+}
+
+// Run refreshes balances and the monitored addresses until ctx is done.
+func (utm *UnspentTransactionMonitor) Run(ctx context.Context) {
+	fetchAddressesTicker := time.NewTicker(utm.config.RefreshInterval)
+	defer fetchAddressesTicker.Stop()
+	refreshUnspentTransactionsTicker := time.NewTicker(utm.config.AddressesInterval)
+	defer refreshUnspentTransactionsTicker.Stop()
+
+	if err := utm.ReloadWatchList(); err != nil {
+		Error.Println(err)
+	}
+
 	for {
 		select {
-		case <-utm.fetchAddressesTicker.C:
-			Info.Println("TICK")
-			utm.Lock()
-			addresses := utm.addressList
-			balances := make(map[string]*AddressBalanceMapping)
-			for len(addresses) > 0 {
-
-				var slice uint
-				if len(addresses) > 10 {
-					slice = 10
-				} else {
-					slice = uint(len(addresses))
-				}
-
-				currentAddresses := addresses[:slice]
-				addresses = addresses[slice:]
-
-				walletRequestChannel := utm.makeWalletRequest(currentAddresses)
-				select {
-				case <-time.After(time.Second * 5):
-					Error.Print("Request timed out from server..")
-				case response := <-walletRequestChannel:
-					var decodedResponse BlockrUnspentResponse
-					decoder := json.NewDecoder(response.Body)
-					decoder.Decode(&decodedResponse)
-
-					if decodedResponse.Status != "success" {
-						Error.Fatal("Decoded response status: " + decodedResponse.Status)
-					}
-
-					for _, entry := range decodedResponse.Data {
-
-						address := entry.Address
-						var balance int64
-						for _, record := range entry.Unspent {
-							if record.Confirmations > 0 {
-								balance += record.Satoshis()
-							}
-						}
-						balances[address] = &AddressBalanceMapping{
-							Address:             address,
-							Balance:             balance,
-							UnspentTransactions: entry.Unspent,
-						}
-
-						Info.Printf("%s has a balance of %s with %d unspent transactions\n", address, balances[address].ToBTC(), len(entry.Unspent))
-					}
-
-				}
+		case <-ctx.Done():
+			return
 
-			}
-			utm.balances = balances
-			utm.Unlock()
+		case <-fetchAddressesTicker.C:
+			Info.Println("TICK")
+			utm.refresh(ctx)
 			Info.Println("TOCK")
 
-		case <-utm.refreshUnspentTransactionsTicker.C:
-			utm.Lock()
-			utm.addressList = utm.getAddressesToMonitor()
-			Info.Println("Imported addresses:" + strings.Join(utm.addressList, ", "))
-			utm.Unlock()
+		case <-refreshUnspentTransactionsTicker.C:
+			if err := utm.ReloadWatchList(); err != nil {
+				// Keep monitoring the addresses we already know
+				Error.Println(err)
+				utm.recordFailure(err.Error())
+			}
 		}
 	}
 }
 
+// Start runs the monitor in the background until ctx is done or Stop is
+// called.
+func (utm *UnspentTransactionMonitor) Start(ctx context.Context) error {
+	utm.Lock()
+	defer utm.Unlock()
+	if utm.done != nil {
+		return errors.New("Monitor is already running")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	utm.cancel = cancel
+	utm.done = done
+	go func() {
+		defer close(done)
+		utm.Run(ctx)
+	}()
+	return nil
+}
+
+// Stop cancels a monitor started with Start, including its requests in
+// flight, and waits for it to return.
+func (utm *UnspentTransactionMonitor) Stop() {
+	utm.Lock()
+	cancel, done := utm.cancel, utm.done
+	utm.cancel, utm.done = nil, nil
+	utm.Unlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
 func NewUnspentTransactionMonitor(client *redis.Client) *UnspentTransactionMonitor {
+	return NewUnspentTransactionMonitorWithConfig(client, DefaultMonitorConfig())
+}
+
+func NewUnspentTransactionMonitorWithConfig(client *redis.Client, config MonitorConfig) *UnspentTransactionMonitor {
+	config = config.withDefaults()
 	return &UnspentTransactionMonitor{
-		balances:                         make(map[string]*AddressBalanceMapping),
-		netClient:                        &http.Client{},
-		client:                           client,
-		fetchAddressesTicker:             time.NewTicker(REFRESH_ADDRESSES_TIME),
-		refreshUnspentTransactionsTicker: time.NewTicker(REFRESH_UTXO_TIME),
+		config:     config,
+		balances:   make(map[string]*AddressBalanceMapping),
+		blocks:     NewBlockTracker(),
+		bus:        NewEventBus(),
+		dirty:      make(map[string]time.Time),
+		lastPolled: make(map[string]time.Time),
+		schedules:  make(map[string]watchSchedule),
+		limiters:   make(map[string]*rateLimiter),
+		netClient:  &http.Client{Timeout: config.RequestTimeout},
+		client:     client,
 	}
 }
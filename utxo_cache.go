@@ -0,0 +1,171 @@
+package wallet
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+const UTXO_CACHE_SYNC_STATE = "utxo_monitor"
+
+// CachedUTXO is an unspent output as last seen by the monitor.
+type CachedUTXO struct {
+	gorm.Model
+	Address       string `gorm:"index"`
+	Tx            string
+	Idx           int
+	Amount        string
+	Confirmations int
+	Script        string
+	Coinbase      bool
+}
+
+// SyncState remembers the chain tip the cached outputs were synced at.
+type SyncState struct {
+	gorm.Model
+	Name   string `gorm:"unique_index"`
+	Height int64
+	Hash   string
+}
+
+// UTXOCache persists the monitor's view of the chain so that balances are
+// available as soon as the process starts.
+type UTXOCache struct {
+	db *gorm.DB
+}
+
+func NewUTXOCache(localDb *gorm.DB) *UTXOCache {
+	return &UTXOCache{
+		db: localDb,
+	}
+}
+
+// Load returns the cached outputs by address and the state they were
+// synced at, nil when nothing was synced yet.
+func (c *UTXOCache) Load() (map[string][]BlockrUnspentItem, *SyncState, error) {
+	var rows []*CachedUTXO
+	if err := c.db.Order("id").Find(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+
+	unspent := make(map[string][]BlockrUnspentItem)
+	for _, row := range rows {
+		unspent[row.Address] = append(unspent[row.Address], BlockrUnspentItem{
+			Tx:            row.Tx,
+			Amount:        row.Amount,
+			Idx:           row.Idx,
+			Confirmations: row.Confirmations,
+			Script:        row.Script,
+			Coinbase:      row.Coinbase,
+		})
+	}
+
+	var state SyncState
+	err := c.db.Where("name = ?", UTXO_CACHE_SYNC_STATE).First(&state).Error
+	if err == gorm.ErrRecordNotFound {
+		return unspent, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return unspent, &state, nil
+}
+
+// Save replaces the cached outputs of the given addresses and records the
+// tip they were synced at.
+func (c *UTXOCache) Save(balances map[string]*AddressBalanceMapping, tip *BlockrBlockInfo) error {
+	tx := c.db.Begin()
+	for address, mapping := range balances {
+		err := tx.Unscoped().Where("address = ?", address).Delete(&CachedUTXO{}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, item := range mapping.UnspentTransactions {
+			err := tx.Create(&CachedUTXO{
+				Address:       address,
+				Tx:            item.Tx,
+				Idx:           item.Idx,
+				Amount:        item.Amount,
+				Confirmations: item.Confirmations,
+				Script:        item.Script,
+				Coinbase:      item.Coinbase,
+			}).Error
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if tip != nil {
+		var state SyncState
+		err := tx.Where(SyncState{Name: UTXO_CACHE_SYNC_STATE}).FirstOrCreate(&state).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Model(&state).Updates(map[string]interface{}{
+			"height": tip.Height,
+			"hash":   tip.Hash,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// SetCache makes the monitor save every refresh to cache.
+func (utm *UnspentTransactionMonitor) SetCache(cache *UTXOCache) {
+	utm.Lock()
+	defer utm.Unlock()
+	utm.cache = cache
+}
+
+// LoadCache fills the monitor with the cached outputs. They are marked as
+// stale until the first refresh, which re-queries every address.
+func (utm *UnspentTransactionMonitor) LoadCache() error {
+	unspent, state, err := utm.cache.Load()
+	if err != nil {
+		return err
+	}
+
+	utm.Lock()
+	defer utm.Unlock()
+	for address, items := range unspent {
+		if _, ok := utm.balances[address]; ok {
+			continue
+		}
+		mapping := utm.config.newAddressBalanceMapping(address, items)
+		mapping.Stale = true
+		mapping.StaleReason = "Loaded from cache"
+		if state != nil {
+			mapping.UpdatedAt = state.UpdatedAt
+		}
+		utm.balances[address] = mapping
+		utm.addressList = append(utm.addressList, address)
+	}
+	if state != nil {
+		utm.blocks.restore(&BlockrBlockInfo{Hash: state.Hash, Height: state.Height})
+	}
+	Info.Printf("Loaded %d addresses from the UTXO cache\n", len(unspent))
+	return nil
+}
+
+// saveCache persists the addresses refreshed by the last tick. The tip is
+// only recorded as synced when no address failed to refresh.
+func (utm *UnspentTransactionMonitor) saveCache(updates map[string]*AddressBalanceMapping, synced bool) {
+	utm.RLock()
+	cache := utm.cache
+	utm.RUnlock()
+	if cache == nil {
+		return
+	}
+	var tip *BlockrBlockInfo
+	if synced {
+		tip = utm.blocks.Tip()
+	}
+	if err := cache.Save(updates, tip); err != nil {
+		Error.Println(err)
+	}
+}
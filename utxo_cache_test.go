@@ -0,0 +1,49 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUTXOCacheSurvivesRestart(t *testing.T) {
+	cache := NewUTXOCache(testDB)
+	tx := NewUnspentTransactionMonitor(Client)
+	tx.SetCache(cache)
+	tx.blocks.restore(&BlockrBlockInfo{Hash: "tip", Height: 420000})
+	tx.registerAddresses([]string{"cachedAddress"})
+
+	updates := map[string]*AddressBalanceMapping{
+		"cachedAddress": tx.config.newAddressBalanceMapping("cachedAddress", []BlockrUnspentItem{
+			BlockrUnspentItem{Tx: "a", Amount: "1.0", Confirmations: 3},
+			BlockrUnspentItem{Tx: "b", Idx: 1, Amount: "0.5", Confirmations: 1},
+		}),
+	}
+	tx.applyUpdates(updates, nil, time.Now())
+	tx.saveCache(updates, true)
+
+	restarted := NewUnspentTransactionMonitor(Client)
+	restarted.SetCache(cache)
+	if err := restarted.LoadCache(); err != nil {
+		t.FailNow()
+	}
+	details, err := restarted.GetBalanceDetailsForAddress("cachedAddress")
+	if err != nil || details.Balance != 150000000 || !details.Stale {
+		t.Fail()
+	}
+	if restarted.blocks.Tip() == nil || restarted.blocks.Tip().Height != 420000 {
+		t.Fail()
+	}
+	if len(restarted.GetAddresses()) != 1 {
+		t.Fail()
+	}
+
+	// Saving an address again replaces its outputs, and the tip stays
+	// where it was while another address failed
+	tx.blocks.restore(&BlockrBlockInfo{Hash: "next", Height: 420001})
+	updates["cachedAddress"] = tx.config.newAddressBalanceMapping("cachedAddress", nil)
+	tx.saveCache(updates, false)
+	unspent, state, err := cache.Load()
+	if err != nil || len(unspent["cachedAddress"]) != 0 || state.Height != 420000 {
+		t.Fail()
+	}
+}
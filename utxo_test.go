@@ -1,15 +1,20 @@
 package wallet
 
 import "testing"
+import "context"
+import "runtime"
 import "time"
-import "gopkg.in/redis.v5"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "sync/atomic"
 
 func TestUnspentTransactions(t *testing.T) {
 	tx := NewUnspentTransactionMonitor(Client)
 	tx.registerAddresses([]string{
 		"myAddress", "hello", "world",
 	})
-	res := tx.makeWalletRequest(tx.GetAddresses())
+	res := tx.unspentURL(tx.GetAddresses())
 	if res != "http://btc.blockr.io/api/v1/address/unspent/myAddress,hello,world" {
 		t.Fail()
 	}
@@ -30,14 +35,16 @@ func TestGetUnspentForBalance(t *testing.T) {
 		Address: "myAddress",
 		UnspentTransactions: []BlockrUnspentItem{
 			BlockrUnspentItem{
-				Tx:     "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
-				Idx:    0,
-				Amount: "1.0",
+				Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+				Idx:           0,
+				Amount:        "1.0",
+				Confirmations: 1,
 			},
 			BlockrUnspentItem{
-				Tx:     "8787402b7eed22e236b5aaa9d33c8a52c7499d97b5fa93d354f55b78405db14f",
-				Idx:    1,
-				Amount: "1.0",
+				Tx:            "8787402b7eed22e236b5aaa9d33c8a52c7499d97b5fa93d354f55b78405db14f",
+				Idx:           1,
+				Amount:        "1.0",
+				Confirmations: 1,
 			},
 		},
 		Balance: 200000000,
@@ -68,20 +75,216 @@ func TestGetUnspentForBalance(t *testing.T) {
 	}
 }
 
-func TestRedisAddressesSet(t *testing.T) {
-	Client.ZAdd("seen_addresses", redis.Z{
-		float64(time.Now().Unix()), "hello",
+func TestConfirmationPolicy(t *testing.T) {
+	config := MonitorConfig{MinConfirmations: 2}
+	mapping := config.newAddressBalanceMapping("myAddress", []BlockrUnspentItem{
+		BlockrUnspentItem{Tx: "a", Amount: "1.0", Confirmations: 0},
+		BlockrUnspentItem{Tx: "b", Amount: "2.0", Confirmations: 1},
+		BlockrUnspentItem{Tx: "c", Amount: "4.0", Confirmations: 2},
+		BlockrUnspentItem{Tx: "d", Amount: "8.0", Confirmations: 50, Coinbase: true},
 	})
-	Client.ZAdd("seen_addresses", redis.Z{
-		float64(time.Now().Unix()) - 3600, "world",
+
+	if mapping.Pending != 100000000 || mapping.Confirmed != 1400000000 {
+		t.Fail()
+	}
+	if mapping.Immature != 800000000 || mapping.Balance != 400000000 {
+		t.Fail()
+	}
+
+	tx := NewUnspentTransactionMonitorWithConfig(Client, config)
+	tx.balances["myAddress"] = mapping
+	res, _, total := tx.GetTXinsForAddress("myAddress", 400000000)
+	if len(res) != 1 || total != 400000000 {
+		t.Fail()
+	}
+}
+
+func TestIncrementalRefresh(t *testing.T) {
+	tx := NewUnspentTransactionMonitor(Client)
+	tx.registerAddresses([]string{"hello", "world", "new"})
+	start := time.Now()
+	tx.lastPolled["hello"] = start
+	tx.lastPolled["world"] = start
+	tx.balances["hello"] = tx.config.newAddressBalanceMapping("hello", []BlockrUnspentItem{
+		BlockrUnspentItem{Tx: "a", Amount: "1.0", Confirmations: 1},
 	})
-	Client.ZAdd("seen_addresses", redis.Z{
-		float64(0), "old",
+	tx.balances["world"] = tx.config.newAddressBalanceMapping("world", nil)
+	tx.balances["gone"] = tx.config.newAddressBalanceMapping("gone", nil)
+	tx.MarkDirty("hello")
+
+	addresses := tx.addressesToRefresh(false, start)
+	if len(addresses) != 2 || addresses[0] != "hello" || addresses[1] != "new" {
+		t.Fail()
+	}
+	if addresses := tx.addressesToRefresh(true, start); len(addresses) != 3 {
+		t.Fail()
+	}
+	if addresses := tx.addressesToRefresh(false, start.Add(HOT_POLL_INTERVAL)); len(addresses) != 3 {
+		t.Fail()
+	}
+
+	// Cold addresses wait for their interval, even across blocks
+	tx.schedules["world"] = watchSchedule{Interval: COLD_POLL_INTERVAL}
+	if addresses := tx.addressesToRefresh(true, start.Add(HOT_POLL_INTERVAL)); len(addresses) != 2 {
+		t.Fail()
+	}
+
+	changes := tx.applyUpdates(map[string]*AddressBalanceMapping{
+		"hello": tx.config.newAddressBalanceMapping("hello", nil),
+		"new":   tx.config.newAddressBalanceMapping("new", nil),
+	}, nil, time.Now())
+	if len(changes) != 1 || changes[0].Kind != UTXO_REMOVED {
+		t.Fail()
+	}
+	if _, ok := tx.balances["world"]; !ok {
+		t.Fail()
+	}
+	if _, ok := tx.balances["gone"]; ok {
+		t.Fail()
+	}
+	if len(tx.dirty) != 0 {
+		t.Fail()
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFetchBalancesPartialResults(t *testing.T) {
+	tx := NewUnspentTransactionMonitorWithConfig(Client, MonitorConfig{
+		MinConfirmations:  1,
+		BatchSize:         2,
+		Concurrency:       2,
+		RequestsPerSecond: 1000,
+		MaxAttempts:       2,
+		BackoffBase:       time.Millisecond,
+	})
+	var requests int32
+	tx.netClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		body := `{"status": "success", "data": [{"address": "a", "unspent": []}, {"address": "b", "unspent": []}]}`
+		if strings.Contains(req.URL.Path, "c,d") {
+			body = `{"status": "fail"}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
 	})
 
+	balances, failed := tx.fetchBalances(context.Background(), []string{"a", "b", "c", "d"})
+	if len(balances) != 2 || len(failed) != 2 {
+		t.Fail()
+	}
+	// The failing batch is retried once
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Fail()
+	}
+}
+
+func TestBackoffAndRateLimit(t *testing.T) {
+	config := MonitorConfig{
+		BackoffBase: time.Second,
+		BackoffMax:  time.Second * 5,
+	}
+	if config.backoff(1) != time.Second || config.backoff(3) != time.Second*4 || config.backoff(10) != time.Second*5 {
+		t.Fail()
+	}
+
+	limiter := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait(context.Background())
+	}
+	if time.Since(start) < time.Millisecond*40 {
+		t.Fail()
+	}
+}
+
+func TestStaleBalancesAreKept(t *testing.T) {
+	tx := NewUnspentTransactionMonitor(Client)
+	tx.registerAddresses([]string{"hello"})
+	good := tx.config.newAddressBalanceMapping("hello", []BlockrUnspentItem{
+		BlockrUnspentItem{Tx: "a", Amount: "1.0", Confirmations: 1},
+	})
+	tx.applyUpdates(map[string]*AddressBalanceMapping{"hello": good}, nil, time.Now())
+
+	started := time.Now()
+	tx.applyUpdates(nil, map[string]string{"hello": "Decoded response status: fail"}, started)
+	tx.recordFailure("Decoded response status: fail")
+	details, err := tx.GetBalanceDetailsForAddress("hello")
+	if err != nil || !details.Stale || details.Balance != 100000000 || details.StaleReason == "" {
+		t.Fail()
+	}
+	if !tx.Status().Stale {
+		t.Fail()
+	}
+
+	// An address never fetched stays unknown
+	tx.registerAddresses([]string{"hello", "unknown"})
+	tx.applyUpdates(nil, map[string]string{"unknown": "Decoded response status: fail"}, time.Now())
+	if _, err := tx.GetBalanceDetailsForAddress("unknown"); err == nil {
+		t.Fail()
+	}
+
+	// The backend is back
+	started = time.Now()
+	tx.applyUpdates(map[string]*AddressBalanceMapping{"hello": good}, nil, started)
+	tx.recordSuccess(started)
+	details, _ = tx.GetBalanceDetailsForAddress("hello")
+	if details.Stale || tx.Status().Stale {
+		t.Fail()
+	}
+}
+
+func TestMalformedItemFailsBatch(t *testing.T) {
 	tx := NewUnspentTransactionMonitor(Client)
-	addresses := tx.getAddressesToMonitor()
-	if len(addresses) != 2 {
+	tx.netClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body := `{"status": "success", "data": [{"address": "a", "unspent": [{"tx": "zz", "amount": "x1.0", "n": 0}]}]}`
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	})
+	if _, err := tx.fetchBatch(context.Background(), []string{"a"}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	tx := NewUnspentTransactionMonitorWithConfig(Client, MonitorConfig{
+		MinConfirmations:  1,
+		RefreshInterval:   time.Millisecond * 10,
+		AddressesInterval: time.Hour,
+	})
+	tx.registerAddresses([]string{"a", "b", "c"})
+	requested := make(chan struct{}, 10)
+	tx.netClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requested <- struct{}{}
+		// A backend that never answers
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	if err := tx.Start(context.Background()); err != nil {
+		t.FailNow()
+	}
+	if tx.Start(context.Background()) == nil {
+		t.Fail()
+	}
+	<-requested
+	tx.Stop()
+
+	// Give the runtime a moment to reap exited goroutines
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if runtime.NumGoroutine() > before {
 		t.Fail()
 	}
 }
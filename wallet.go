@@ -2,14 +2,15 @@ package wallet
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 
 	"github.com/btcsuite/btcd/btcec"
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
@@ -22,6 +23,11 @@ type TransactionManager struct {
 	unspentTransactionMonitorInstance *UnspentTransactionMonitor
 	reserveInstance                   *ReserveService
 	netClient                         *http.Client
+	ledger                            *Ledger
+	keys                              KeyLookup
+	journal                           *Journal
+	bus                               *EventBus
+	changes                           *ChangeAddresses
 }
 
 func NewTransactionManager(
@@ -35,13 +41,87 @@ func NewTransactionManager(
 	}
 }
 
+// SetLedger lets withdrawals settle off-chain transfers: when an address
+// does not hold enough coins for a spend, the rest is taken from the
+// addresses that transferred balance to it, signed with keys.
+func (tm *TransactionManager) SetLedger(ledger *Ledger, keys KeyLookup) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.ledger = ledger
+	tm.keys = keys
+}
+
+// SetJournal makes broadcast transactions tracked by journal until they
+// leave the wallet.
+func (tm *TransactionManager) SetJournal(journal *Journal) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.journal = journal
+}
+
+// SetChangeAddresses makes spends send their change to a fresh change
+// address of the spending address instead of back to it. The ledger set
+// with SetLedger keeps the change counted in the balance of the spending
+// address, so rotation is off until there is one.
+func (tm *TransactionManager) SetChangeAddresses(changes *ChangeAddresses) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.changes = changes
+}
+
+// SetEventBus makes the manager publish TxBroadcast and TxConfirmed events
+// on bus, and rechecks recent spends when bus reports a reorg.
+func (tm *TransactionManager) SetEventBus(bus *EventBus) {
+	tm.Lock()
+	tm.bus = bus
+	tm.Unlock()
+
+	bus.Subscribe(ChainReorganized{}, func(ctx context.Context, event Event) {
+		tm.HandleReorg(ctx, event.(ChainReorganized).Reorg)
+	})
+	bus.Subscribe(UTXOAdded{}, tm.publishConfirmed)
+	bus.Subscribe(UTXOUpdated{}, tm.publishConfirmed)
+}
+
+// publishConfirmed publishes a TxConfirmed event when an output of one of
+// our transactions is confirmed.
+func (tm *TransactionManager) publishConfirmed(ctx context.Context, event Event) {
+	change, _ := utxoChangeFor(event)
+	item := change.Item
+	if item.Confirmations == 0 || tm.journal == nil || !tm.journal.isOwnTransaction(item.Tx) {
+		return
+	}
+	tm.bus.Publish(ctx, TxConfirmed{item.Tx, change.Address, item.Confirmations})
+}
+
+// trackBroadcast records a transaction we just broadcast and has the
+// monitor refresh the addresses it spent from.
+func (tm *TransactionManager) trackBroadcast(
+	txid string,
+	txBytes []byte,
+	fee int64,
+	payments []Payment,
+	addresses ...string,
+) {
+	tm.unspentTransactionMonitorInstance.MarkDirty(addresses...)
+	if tm.bus != nil {
+		tm.bus.Publish(context.Background(), TxBroadcast{txid, addresses, fee, payments, txBytes})
+	}
+	if tm.journal == nil {
+		return
+	}
+	if err := tm.journal.TrackInFlight(txid, txBytes, fee); err != nil {
+		Error.Println(err)
+	}
+}
+
 func (tm *TransactionManager) makePayToPubkeyHashScript(address string) ([]byte, error) {
-	dstAddress, err := btcutil.DecodeAddress(address, &chaincfg.MainNetParams)
-	Info.Println(hex.EncodeToString(dstAddress.ScriptAddress()))
-	Info.Printf("TYPE: %T\n", dstAddress)
+	dstAddress, err := btcutil.DecodeAddress(address, NetParams)
 	if err != nil {
 		return nil, err
 	}
+	Info.Println(hex.EncodeToString(dstAddress.ScriptAddress()))
+	Info.Printf("TYPE: %T\n", dstAddress)
 	Info.Println("Address: ", dstAddress)
 	p2pkh, err := txscript.PayToAddrScript(dstAddress)
 	if err != nil {
@@ -50,21 +130,87 @@ func (tm *TransactionManager) makePayToPubkeyHashScript(address string) ([]byte,
 	return p2pkh, nil
 }
 
+// SpendReserve pays amount out of a reserve to dstAddressString. An amount
+// of 0 spends whatever is left in the reserve. It returns the txid and the
+// fee paid, which policy says who pays.
 func (tm *TransactionManager) SpendReserve(
 	address, reserve string,
 	pk *btcec.PrivateKey,
 	dstAddressString string,
-) (string, error) {
+	amount int64,
+	policy FeePolicy,
+) (string, int64, error) {
+	amountToSpend, err := tm.amountToSpendFromReserve(address, reserve, amount)
+	if err != nil {
+		return "", 0, err
+	}
+	return tm.SpendReserveToOutputs(address, reserve, pk, []SpendOutput{
+		{Address: dstAddressString, Amount: amountToSpend},
+	}, policy)
+}
+
+// SpendReserveToOutputs pays several outputs out of a reserve in a single
+// transaction.
+func (tm *TransactionManager) SpendReserveToOutputs(
+	address, reserve string,
+	pk *btcec.PrivateKey,
+	outputs []SpendOutput,
+	policy FeePolicy,
+) (string, int64, error) {
 	tm.Lock()
 	defer tm.Unlock()
 
-	// Encode the transaction
-	var buffer bytes.Buffer
-	txBytes, err := tm.MakeTransactionForReserve(address, reserve, pk, dstAddressString)
+	spend, err := tm.buildTransactionForOutputs(address, reserve, pk, outputs, policy)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
+	txid, err := tm.broadcastTransaction(spend.txBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	spentFrom := []string{address}
+	for _, settlement := range spend.settlements {
+		spentFrom = append(spentFrom, settlement.Address)
+	}
+	tm.trackBroadcast(txid, spend.txBytes, spend.fee,
+		paymentsFor(address, reserve, outputs, policy), spentFrom...)
+	tm.trackChange(txid, spend.txBytes, spend.fromFunds, address)
+
+	for _, settlement := range spend.settlements {
+		err = tm.ledger.Settle(address, settlement.Address, settlement.Owed, txid)
+		if err != nil {
+			Error.Println(err)
+		}
+	}
+
+	err = tm.reserveInstance.SpendReserve(address, reserve, totalOutputs(outputs), spend.fee, txid)
+	if err != nil {
+		return txid, spend.fee, err
+	}
+	return txid, spend.fee, nil
+}
+
+// get is an httpGetter going through the manager's client.
+func (tm *TransactionManager) get(ctx context.Context, url string) (*http.Response, error) {
+	return getWithContext(ctx, tm.netClient, url)
+}
+
+// BroadcastRejected is the error of a broadcast the backend refused. Any
+// other broadcast error leaves it unknown whether the transaction reached
+// the network.
+type BroadcastRejected struct {
+	Reason string
+}
+
+func (e *BroadcastRejected) Error() string {
+	return "Transaction was rejected: " + e.Reason
+}
+
+// broadcastTransaction pushes a signed transaction to the network and
+// returns its txid.
+func (tm *TransactionManager) broadcastTransaction(txBytes []byte) (string, error) {
+	var buffer bytes.Buffer
 	txHexString := hex.EncodeToString(txBytes)
 	Info.Println(txHexString)
 	payload := struct {
@@ -85,84 +231,301 @@ func (tm *TransactionManager) SpendReserve(
 		Status, Data string
 	}{}
 	defer res.Body.Close()
-	json.NewDecoder(res.Body).Decode(response)
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		return "", err
+	}
 
-	if response.Status == "success" {
-		err = tm.reserveInstance.SpendReserve(address, reserve)
-		if err != nil {
-			return response.Data, err
+	if response.Status != "success" {
+		if res.StatusCode >= http.StatusInternalServerError {
+			return "", errors.New("Backend failed: " + res.Status)
 		}
+		return "", &BroadcastRejected{response.Data}
 	}
 	return response.Data, nil
 }
 
+func (tm *TransactionManager) amountToSpendFromReserve(address, reserve string, amount int64) (int64, error) {
+	remaining, err := tm.reserveInstance.GetAmountReservedForReserve(address, reserve)
+	if err != nil {
+		return -1, err
+	}
+	if amount < 0 {
+		return -1, errors.New("Amount is invalid")
+	}
+	if amount == 0 {
+		return remaining, nil
+	}
+	if amount > remaining {
+		return -1, errors.New("Amount exceeds what is left in the reserve")
+	}
+	return amount, nil
+}
+
+// MakeTransactionForReserve builds and signs a transaction paying amount out
+// of a reserve. An amount of 0 spends whatever is left in the reserve.
 func (tm *TransactionManager) MakeTransactionForReserve(
 	address, reserve string,
 	pk *btcec.PrivateKey,
 	dstAddressString string,
+	amount int64,
+	policy FeePolicy,
 ) ([]byte, error) {
 
 	// Get amount to spend
-	amountToSpend, err := tm.reserveInstance.GetAmountReservedForReserve(address, reserve)
+	amountToSpend, err := tm.amountToSpendFromReserve(address, reserve, amount)
 	if err != nil {
 		return nil, err
 	}
+	return tm.MakeTransactionForOutputs(address, reserve, pk, []SpendOutput{
+		{Address: dstAddressString, Amount: amountToSpend},
+	}, policy)
+}
 
-	// Get transactions for that amount
-	txIns, scripts, totalSpent := tm.unspentTransactionMonitorInstance.GetTXinsForAddress(
-		address, amountToSpend,
-	)
-	if totalSpent < amountToSpend {
-		return nil, errors.New("Insufficient funds")
+func totalOutputs(outputs []SpendOutput) int64 {
+	var total int64
+	for _, output := range outputs {
+		total += output.Amount
 	}
+	return total
+}
 
-	// Make out scripts
-	Info.Println(address, dstAddressString)
-	dstScript, err := tm.makePayToPubkeyHashScript(dstAddressString)
+// MakeTransactionForOutputs builds and signs a transaction paying every
+// output out of a reserve.
+func (tm *TransactionManager) MakeTransactionForOutputs(
+	address, reserve string,
+	pk *btcec.PrivateKey,
+	outputs []SpendOutput,
+	policy FeePolicy,
+) ([]byte, error) {
+	spend, err := tm.buildTransactionForOutputs(address, reserve, pk, outputs, policy)
 	if err != nil {
 		return nil, err
 	}
-	returnScript, err := tm.makePayToPubkeyHashScript(address)
-	Info.Println("Return Script:", hex.EncodeToString(returnScript))
+	return spend.txBytes, nil
+}
+
+// buildTransactionForOutputs is MakeTransactionForOutputs, also returning
+// how much was taken from other addresses to settle off-chain transfers
+// and what the spend costs besides its payments. When the sender pays,
+// coins are selected for the payments and the fee, and the fee must fit in
+// the part of the balance no reserve holds.
+func (tm *TransactionManager) buildTransactionForOutputs(
+	address, reserve string,
+	pk *btcec.PrivateKey,
+	outputs []SpendOutput,
+	policy FeePolicy,
+) (*builtSpend, error) {
+	if len(outputs) == 0 {
+		return nil, errors.New("Nothing to pay")
+	}
+	for _, output := range outputs {
+		if output.Amount <= 0 {
+			return nil, errors.New("Amount is invalid")
+		}
+	}
+
+	// Get amount to spend
+	amountToSpend := totalOutputs(outputs)
+	remaining, err := tm.reserveInstance.GetAmountReservedForReserve(address, reserve)
 	if err != nil {
 		return nil, err
 	}
+	if amountToSpend > remaining {
+		return nil, errors.New("Amount exceeds what is left in the reserve")
+	}
+	fromFunds := make(map[string]int64)
+	if policy == FEE_SENDER_PAYS {
+		if tm.freeFunds(address) < BTC_FEE_IN_SATOSHIS {
+			return nil, errors.New("Insufficient funds to pay the fee")
+		}
+		fromFunds[address] = BTC_FEE_IN_SATOSHIS
+		amountToSpend += BTC_FEE_IN_SATOSHIS
+	}
+
+	// Get transactions for that amount
+	txIns, scripts, totalSpent := tm.unspentTransactionMonitorInstance.GetTXinsForAddress(
+		address, amountToSpend,
+	)
+	var settlements []Debtor
+	if totalSpent < amountToSpend && tm.ledger != nil {
+		ownBalance, _ := tm.unspentTransactionMonitorInstance.GetUTXOBalanceForAddress(address)
+		txIns, scripts, totalSpent = tm.unspentTransactionMonitorInstance.GetTXinsForAddress(
+			address, ownBalance,
+		)
+		if totalSpent < 0 {
+			totalSpent = 0
+		}
+		settlements, err = tm.settlementsFor(amountToSpend - totalSpent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if totalSpent < amountToSpend-totalOwed(settlements) {
+		return nil, errors.New("Insufficient funds")
+	}
+
+	dust := make(map[string]int64)
+	remainder := totalSpent - (amountToSpend - totalOwed(settlements))
 
 	// Make Transaction
 	tx := wire.NewMsgTx()
+	keys := make([]*btcec.PrivateKey, 0, len(txIns))
 	for _, txin := range txIns {
 		tx.AddTxIn(txin)
+		keys = append(keys, pk)
+	}
+	shares := deductedShares(feeShares(len(outputs)), policy)
+	if err := tm.addPaymentOutputs(tx, outputs, shares); err != nil {
+		return nil, err
 	}
-	toDst := amountToSpend - BTC_FEE_IN_SATOSHIS
-	tx.AddTxOut(wire.NewTxOut(
-		toDst, dstScript,
-	))
-	remainder := totalSpent - amountToSpend
 	if remainder > 0 {
-		tx.AddTxOut(wire.NewTxOut(
-			remainder, returnScript,
-		))
+		returnScript, err := tm.changeScriptFor(address, remainder, dust)
+		if err != nil {
+			return nil, err
+		}
+		if returnScript != nil {
+			Info.Println("Return Script:", hex.EncodeToString(returnScript))
+			tx.AddTxOut(wire.NewTxOut(remainder, returnScript))
+		}
 	}
 
-	lookupKey := func(a btcutil.Address) (*btcec.PrivateKey, bool, error) {
-		return pk, true, nil
+	// Take the rest from the addresses settling off-chain transfers
+	for _, settlement := range settlements {
+		debtorKey, err := tm.keys(settlement.Address)
+		if err != nil {
+			return nil, err
+		}
+		debtorIns, debtorScripts, debtorSpent := tm.unspentTransactionMonitorInstance.GetTXinsForAddress(
+			settlement.Address, settlement.Owed,
+		)
+		if debtorSpent < settlement.Owed {
+			return nil, errors.New("Insufficient funds")
+		}
+		for idx, txin := range debtorIns {
+			tx.AddTxIn(txin)
+			scripts = append(scripts, debtorScripts[idx])
+			keys = append(keys, debtorKey)
+		}
+		if debtorSpent > settlement.Owed {
+			debtorScript, err := tm.makePayToPubkeyHashScript(settlement.Address)
+			if err != nil {
+				return nil, err
+			}
+			if debtorSpent-settlement.Owed < DustThreshold(debtorScript) {
+				dust[settlement.Address] += debtorSpent - settlement.Owed
+			} else {
+				tx.AddTxOut(wire.NewTxOut(debtorSpent-settlement.Owed, debtorScript))
+			}
+		}
+	}
+
+	if err := tm.signTransaction(tx, scripts, keys); err != nil {
+		return nil, err
+	}
+	txBytes, err := serializeTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	for address, amount := range dust {
+		fromFunds[address] += amount
+	}
+	return &builtSpend{
+		txBytes:     txBytes,
+		settlements: settlements,
+		fee:         BTC_FEE_IN_SATOSHIS + totalDust(dust),
+		fromFunds:   fromFunds,
+		dust:        dust,
+	}, nil
+}
+
+// settlementsFor picks how much of shortfall each debtor pays, never more
+// than it owes or holds on-chain.
+func (tm *TransactionManager) settlementsFor(shortfall int64) ([]Debtor, error) {
+	debtors, err := tm.ledger.Debtors()
+	if err != nil {
+		return nil, err
+	}
+
+	var settlements []Debtor
+	for _, debtor := range debtors {
+		if shortfall <= 0 {
+			break
+		}
+		onChain, err := tm.unspentTransactionMonitorInstance.GetUTXOBalanceForAddress(debtor.Address)
+		if err != nil || onChain <= 0 {
+			continue
+		}
+
+		take := debtor.Owed
+		if onChain < take {
+			take = onChain
+		}
+		if shortfall < take {
+			take = shortfall
+		}
+		settlements = append(settlements, Debtor{debtor.Address, take})
+		shortfall -= take
+	}
+	return settlements, nil
+}
+
+func totalOwed(debtors []Debtor) int64 {
+	var total int64
+	for _, debtor := range debtors {
+		total += debtor.Owed
+	}
+	return total
+}
+
+// addPaymentOutputs adds an output for every payment, less the share of
+// the fee in shares it pays.
+func (tm *TransactionManager) addPaymentOutputs(tx *wire.MsgTx, outputs []SpendOutput, shares []int64) error {
+	for idx, output := range outputs {
+		Info.Println("Paying", output.Address)
+		dstScript, err := makeOutputScript(output.Address)
+		if err != nil {
+			return err
+		}
+		toDst := output.Amount - shares[idx]
+		if toDst <= 0 {
+			return errors.New(fmt.Sprintf("Paying %s does not cover its share of the fee", output.Address))
+		}
+		if toDst < DustThreshold(dstScript) {
+			return errors.New(fmt.Sprintf("Paying %s is below the dust threshold", output.Address))
+		}
+		tx.AddTxOut(wire.NewTxOut(toDst, dstScript))
 	}
+	return nil
+}
 
-	// Sign transaction
+// signTransaction signs every input of tx, where scripts and keys hold the
+// previous output script and the private key for each input.
+func (tm *TransactionManager) signTransaction(
+	tx *wire.MsgTx,
+	scripts [][]byte,
+	keys []*btcec.PrivateKey,
+) error {
 	for idx, _ := range tx.TxIn {
-		sigScript, err := txscript.SignTxOutput(&chaincfg.MainNetParams,
+		pk := keys[idx]
+		lookupKey := func(a btcutil.Address) (*btcec.PrivateKey, bool, error) {
+			return pk, true, nil
+		}
+
+		sigScript, err := txscript.SignTxOutput(NetParams,
 			tx, idx, scripts[idx], txscript.SigHashAll,
 			txscript.KeyClosure(lookupKey), nil, nil)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		tx.TxIn[idx].SignatureScript = sigScript
 	}
+	return nil
+}
 
-	// Post transaction
+func serializeTransaction(tx *wire.MsgTx) ([]byte, error) {
 	byteBuffer := make([]byte, 0, tx.SerializeSize())
 	buffer := bytes.NewBuffer(byteBuffer)
-	err = tx.Serialize(buffer)
+	err := tx.Serialize(buffer)
 	if err != nil {
 		return nil, err
 	}
@@ -29,16 +29,18 @@ func TestSpendReserve(t *testing.T) {
 			Balance: 200000000,
 			UnspentTransactions: []BlockrUnspentItem{
 				BlockrUnspentItem{
-					Tx:     "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
-					Idx:    0,
-					Script: p2pkhFrmAddressString,
-					Amount: "1.0",
+					Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        p2pkhFrmAddressString,
+					Amount:        "1.0",
+					Confirmations: 1,
 				},
 				BlockrUnspentItem{
-					Tx:     "8787402b7eed22e236b5aaa9d33c8a52c7499d97b5fa93d354f55b78405db14f",
-					Script: p2pkhFrmAddressString,
-					Idx:    1,
-					Amount: "1.0",
+					Tx:            "8787402b7eed22e236b5aaa9d33c8a52c7499d97b5fa93d354f55b78405db14f",
+					Script:        p2pkhFrmAddressString,
+					Idx:           1,
+					Amount:        "1.0",
+					Confirmations: 1,
 				},
 			},
 		},
@@ -46,9 +48,49 @@ func TestSpendReserve(t *testing.T) {
 
 	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(frmAddress.EncodeAddress(), 120000000)
 
-	_, err := txmgr.MakeTransactionForReserve(frmAddress.EncodeAddress(), reserve, frmPK, toAddress.EncodeAddress())
+	_, err := txmgr.MakeTransactionForReserve(frmAddress.EncodeAddress(), reserve, frmPK, toAddress.EncodeAddress(), 0, FEE_RECIPIENT_PAYS)
 	if err != nil {
 		t.Fail()
 	}
 
 }
+
+func TestMakeTransactionForOutputs(t *testing.T) {
+	txmgr := NewTransactionManager(
+		NewUnspentTransactionMonitor(Client),
+		NewReserverService(testDB),
+	)
+
+	frmPK, _ := btcec.NewPrivateKey(btcec.S256())
+	frmAddress, _ := btcutil.NewAddressPubKey(frmPK.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+	p2pkhFrmAddress, _ := txmgr.makePayToPubkeyHashScript(frmAddress.EncodeAddress())
+
+	txmgr.unspentTransactionMonitorInstance.balances = map[string]*AddressBalanceMapping{
+		frmAddress.EncodeAddress(): &AddressBalanceMapping{
+			Balance: 100000000,
+			UnspentTransactions: []BlockrUnspentItem{
+				BlockrUnspentItem{
+					Tx:            "aa631d3cb0c98ada8ddb3ec82f23de2a948819e841a00ad740794837b7fbd7e9",
+					Idx:           0,
+					Script:        hex.EncodeToString(p2pkhFrmAddress),
+					Amount:        "1.0",
+					Confirmations: 1,
+				},
+			},
+		},
+	}
+	reserve, _ := txmgr.reserveInstance.AddReserveForAddress(frmAddress.EncodeAddress(), 60000000)
+
+	outputs := []SpendOutput{
+		{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 30000000},
+		{Address: "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy", Amount: 20000000},
+	}
+	if _, err := txmgr.MakeTransactionForOutputs(frmAddress.EncodeAddress(), reserve, frmPK, outputs, FEE_RECIPIENT_PAYS); err != nil {
+		t.Fail()
+	}
+
+	outputs = append(outputs, SpendOutput{Address: "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", Amount: 20000000})
+	if _, err := txmgr.MakeTransactionForOutputs(frmAddress.EncodeAddress(), reserve, frmPK, outputs, FEE_RECIPIENT_PAYS); err == nil {
+		t.Fail()
+	}
+}
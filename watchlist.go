@@ -0,0 +1,276 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/redis.v5"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	WATCH_TIER_HOT  = "hot"
+	WATCH_TIER_COLD = "cold"
+
+	// Hot addresses are also refreshed on every new block
+	HOT_POLL_INTERVAL  = time.Second * 30
+	COLD_POLL_INTERVAL = time.Minute * 10
+	// Addresses cannot be polled more often than the monitor ticks
+	MIN_POLL_INTERVAL = REFRESH_ADDRESSES_TIME
+)
+
+// WatchedAddress is an address the monitor keeps balances for. Temporary
+// watches stop at ExpiresAt; permanent ones until they are removed.
+type WatchedAddress struct {
+	gorm.Model
+	Address  string `gorm:"unique_index"`
+	Tier     string
+	Priority int
+	// Seconds between refreshes, 0 for the tier's default
+	PollInterval int64
+	Permanent    bool
+	ExpiresAt    *time.Time
+}
+
+func (wa *WatchedAddress) Interval() time.Duration {
+	if wa.PollInterval > 0 {
+		return time.Duration(wa.PollInterval) * time.Second
+	}
+	if wa.Tier == WATCH_TIER_COLD {
+		return COLD_POLL_INTERVAL
+	}
+	return HOT_POLL_INTERVAL
+}
+
+// WatchOptions describes how to watch an address. A temporary watch lasts
+// for TTL.
+type WatchOptions struct {
+	Tier         string
+	Priority     int
+	PollInterval time.Duration
+	Permanent    bool
+	TTL          time.Duration
+}
+
+func validatePollInterval(interval time.Duration) error {
+	if interval != 0 && interval < MIN_POLL_INTERVAL {
+		return errors.New("Poll interval is too short")
+	}
+	return nil
+}
+
+type WatchList struct {
+	db *gorm.DB
+}
+
+func NewWatchList(localDb *gorm.DB) *WatchList {
+	return &WatchList{
+		db: localDb,
+	}
+}
+
+// Watch starts watching address, or changes how it is watched.
+func (wl *WatchList) Watch(address string, options WatchOptions) (*WatchedAddress, error) {
+	if _, err := DecodeDestination(address); err != nil {
+		return nil, err
+	}
+	if options.Tier == "" {
+		options.Tier = WATCH_TIER_HOT
+	}
+	if options.Tier != WATCH_TIER_HOT && options.Tier != WATCH_TIER_COLD {
+		return nil, errors.New("Tier is invalid")
+	}
+	if err := validatePollInterval(options.PollInterval); err != nil {
+		return nil, err
+	}
+	if !options.Permanent && options.TTL <= 0 {
+		return nil, errors.New("A temporary watch needs a TTL")
+	}
+
+	var watch WatchedAddress
+	err := wl.db.Unscoped().Where("address = ?", address).First(&watch).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	watch.Address = address
+	watch.Tier = options.Tier
+	watch.Priority = options.Priority
+	watch.PollInterval = int64(options.PollInterval / time.Second)
+	watch.Permanent = options.Permanent
+	watch.ExpiresAt = nil
+	watch.DeletedAt = nil
+	if !options.Permanent {
+		expiresAt := time.Now().Add(options.TTL)
+		watch.ExpiresAt = &expiresAt
+	}
+	if err := wl.db.Unscoped().Save(&watch).Error; err != nil {
+		return nil, err
+	}
+	return &watch, nil
+}
+
+func (wl *WatchList) Get(address string) (*WatchedAddress, error) {
+	var watch WatchedAddress
+	err := wl.db.Where("address = ?", address).First(&watch).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errors.New("Address is not watched")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &watch, nil
+}
+
+// Unwatch stops watching address. It is not imported again from the
+// seen addresses afterwards.
+func (wl *WatchList) Unwatch(address string) error {
+	watch, err := wl.Get(address)
+	if err != nil {
+		return err
+	}
+	return wl.db.Delete(watch).Error
+}
+
+func (wl *WatchList) SetPriority(address string, priority int) (*WatchedAddress, error) {
+	watch, err := wl.Get(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := wl.db.Model(watch).Update("priority", priority).Error; err != nil {
+		return nil, err
+	}
+	return watch, nil
+}
+
+// SetPollInterval overrides how often address is refreshed, 0 goes back
+// to the tier's default.
+func (wl *WatchList) SetPollInterval(address string, interval time.Duration) (*WatchedAddress, error) {
+	if err := validatePollInterval(interval); err != nil {
+		return nil, err
+	}
+	watch, err := wl.Get(address)
+	if err != nil {
+		return nil, err
+	}
+	err = wl.db.Model(watch).Update("poll_interval", int64(interval/time.Second)).Error
+	if err != nil {
+		return nil, err
+	}
+	return watch, nil
+}
+
+// Active lists the watches that did not expire, highest priority first.
+func (wl *WatchList) Active(now time.Time) ([]*WatchedAddress, error) {
+	var watches []*WatchedAddress
+	err := wl.db.Where(
+		"permanent = ? OR expires_at > ?", true, now,
+	).Find(&watches).Error
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(watches, func(i, j int) bool {
+		if watches[i].Priority == watches[j].Priority {
+			return watches[i].Address < watches[j].Address
+		}
+		return watches[i].Priority > watches[j].Priority
+	})
+	return watches, nil
+}
+
+// ImportSeenAddresses permanently watches the addresses added to the
+// seen_addresses set since a given time, unless they were watched before.
+func (wl *WatchList) ImportSeenAddresses(client *redis.Client, since time.Time) (int, error) {
+	results, err := client.ZRangeByScore("seen_addresses", redis.ZRangeBy{
+		Min: strconv.FormatInt(since.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var imported int
+	for _, address := range results {
+		var count int
+		wl.db.Unscoped().Model(&WatchedAddress{}).Where("address = ?", address).Count(&count)
+		if count > 0 {
+			continue
+		}
+		err := wl.db.Create(&WatchedAddress{
+			Address:   address,
+			Tier:      WATCH_TIER_HOT,
+			Permanent: true,
+		}).Error
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// watchSchedule is how the monitor polls one address.
+type watchSchedule struct {
+	Interval time.Duration
+	Hot      bool
+}
+
+// SetWatchList makes the monitor poll the addresses of watchList instead
+// of the ones registered directly.
+func (utm *UnspentTransactionMonitor) SetWatchList(watchList *WatchList) {
+	utm.Lock()
+	defer utm.Unlock()
+	utm.watchList = watchList
+}
+
+// ReloadWatchList imports newly seen addresses and picks up changes to the
+// watch list.
+func (utm *UnspentTransactionMonitor) ReloadWatchList() error {
+	utm.RLock()
+	watchList, client, since := utm.watchList, utm.client, utm.lastImport
+	utm.RUnlock()
+	if watchList == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if client != nil {
+		imported, err := watchList.ImportSeenAddresses(client, since)
+		if err != nil {
+			return err
+		}
+		if imported > 0 {
+			Info.Printf("Imported %d seen addresses into the watch list\n", imported)
+		}
+	}
+	watches, err := watchList.Active(now)
+	if err != nil {
+		return err
+	}
+
+	addresses := make([]string, 0, len(watches))
+	schedules := make(map[string]watchSchedule)
+	for _, watch := range watches {
+		addresses = append(addresses, watch.Address)
+		schedules[watch.Address] = watchSchedule{
+			Interval: watch.Interval(),
+			Hot:      watch.Tier != WATCH_TIER_COLD,
+		}
+	}
+
+	utm.Lock()
+	defer utm.Unlock()
+	utm.addressList = addresses
+	utm.schedules = schedules
+	// Leave some overlap in case the clocks of Redis writers drift
+	utm.lastImport = now.Add(-time.Minute)
+	return nil
+}
+
+func (utm *UnspentTransactionMonitor) scheduleFor(address string) watchSchedule {
+	if schedule, ok := utm.schedules[address]; ok {
+		return schedule
+	}
+	return watchSchedule{Interval: HOT_POLL_INTERVAL, Hot: true}
+}
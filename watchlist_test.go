@@ -0,0 +1,108 @@
+package wallet
+
+import (
+	"gopkg.in/redis.v5"
+	"testing"
+	"time"
+)
+
+const WATCHED_ADDRESS = "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+
+func TestWatchList(t *testing.T) {
+	wl := NewWatchList(testDB)
+
+	if _, err := wl.Watch("notAnAddress", WatchOptions{Permanent: true}); err == nil {
+		t.Fail()
+	}
+	if _, err := wl.Watch(WATCHED_ADDRESS, WatchOptions{}); err == nil {
+		t.Fail()
+	}
+	if _, err := wl.Watch(WATCHED_ADDRESS, WatchOptions{Permanent: true, PollInterval: time.Second}); err == nil {
+		t.Fail()
+	}
+
+	watch, err := wl.Watch(WATCHED_ADDRESS, WatchOptions{Tier: WATCH_TIER_COLD, TTL: time.Hour})
+	if err != nil || watch.Interval() != COLD_POLL_INTERVAL {
+		t.FailNow()
+	}
+	if _, err := wl.SetPriority(WATCHED_ADDRESS, 5); err != nil {
+		t.Fail()
+	}
+	watch, err = wl.SetPollInterval(WATCHED_ADDRESS, time.Minute)
+	if err != nil || watch.Interval() != time.Minute {
+		t.Fail()
+	}
+
+	active, err := wl.Active(time.Now())
+	if err != nil || len(active) == 0 || active[0].Address != WATCHED_ADDRESS {
+		t.Fail()
+	}
+	// Temporary watches expire
+	active, _ = wl.Active(time.Now().Add(time.Hour * 2))
+	for _, watch := range active {
+		if watch.Address == WATCHED_ADDRESS {
+			t.Fail()
+		}
+	}
+
+	if err := wl.Unwatch(WATCHED_ADDRESS); err != nil {
+		t.Fail()
+	}
+	if _, err := wl.Get(WATCHED_ADDRESS); err == nil {
+		t.Fail()
+	}
+	// Watching again restores the address
+	if _, err := wl.Watch(WATCHED_ADDRESS, WatchOptions{Permanent: true}); err != nil {
+		t.Fail()
+	}
+	if _, err := wl.Get(WATCHED_ADDRESS); err != nil {
+		t.Fail()
+	}
+}
+
+func TestRedisAddressesSet(t *testing.T) {
+	Client.ZAdd("seen_addresses", redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: "hello",
+	})
+	Client.ZAdd("seen_addresses", redis.Z{
+		Score:  float64(time.Now().Unix()) - 3600,
+		Member: "world",
+	})
+	Client.ZAdd("seen_addresses", redis.Z{
+		Score:  float64(0),
+		Member: "old",
+	})
+
+	wl := NewWatchList(testDB)
+	imported, err := wl.ImportSeenAddresses(Client, time.Now().Add(-time.Hour*24))
+	if err != nil || imported != 2 {
+		t.Fail()
+	}
+
+	// Removed addresses are not imported again
+	wl.Unwatch("hello")
+	imported, err = wl.ImportSeenAddresses(Client, time.Now().Add(-time.Hour*24))
+	if err != nil || imported != 0 {
+		t.Fail()
+	}
+
+	tx := NewUnspentTransactionMonitor(Client)
+	tx.SetWatchList(wl)
+	if err := tx.ReloadWatchList(); err != nil {
+		t.Fail()
+	}
+	addresses := tx.GetAddresses()
+	found := false
+	for _, address := range addresses {
+		if address == "hello" {
+			t.Fail()
+		}
+		if address == "world" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fail()
+	}
+}
@@ -0,0 +1,258 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+
+	WEBHOOK_SIGNATURE_HEADER = "X-Wallet-Signature"
+	WEBHOOK_EVENT_HEADER     = "X-Wallet-Event"
+	WEBHOOK_DELIVERY_HEADER  = "X-Wallet-Delivery"
+
+	WEBHOOK_POLL_INTERVAL  = time.Second * 5
+	WEBHOOK_TIMEOUT        = time.Second * 10
+	WEBHOOK_MAX_ATTEMPTS   = 10
+	WEBHOOK_BACKOFF_BASE   = time.Second * 10
+	WEBHOOK_BACKOFF_MAX    = time.Hour
+	WEBHOOK_DELIVERY_BATCH = 50
+	WEBHOOK_SECRET_BYTES   = 32
+)
+
+// Webhook is an HTTP endpoint events are POSTed to. Kinds lists the event
+// types it wants, comma separated, or is empty for all of them.
+type Webhook struct {
+	gorm.Model
+	Uuid   string
+	URL    string
+	Secret string
+	Kinds  string
+	Active bool
+}
+
+func (w *Webhook) Accepts(kind string) bool {
+	if w.Kinds == "" {
+		return true
+	}
+	for _, accepted := range strings.Split(w.Kinds, ",") {
+		if accepted == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event waiting to be, or already, delivered to one
+// webhook.
+type WebhookDelivery struct {
+	gorm.Model
+	EventID       uint `gorm:"index"`
+	WebhookID     uint `gorm:"index"`
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// SignPayload is the value of the signature header for body: the hex HMAC
+// SHA-256 of the body keyed with the webhook secret.
+func SignPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookService struct {
+	db        *gorm.DB
+	netClient *http.Client
+}
+
+func NewWebhookService(localDb *gorm.DB) *WebhookService {
+	return &WebhookService{
+		db:        localDb,
+		netClient: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+	}
+}
+
+// Register adds a webhook. A secret is generated when none is given.
+func (ws *WebhookService) Register(endpoint, secret string, kinds []string) (*Webhook, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.New("Webhook URL is invalid")
+	}
+	for _, kind := range kinds {
+		if !IsEventKind(kind) {
+			return nil, errors.New("Unknown event type: " + kind)
+		}
+	}
+	if secret == "" {
+		random := make([]byte, WEBHOOK_SECRET_BYTES)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(random)
+	}
+
+	webhook := Webhook{
+		Uuid:   uuid.NewV4().String(),
+		URL:    endpoint,
+		Secret: secret,
+		Kinds:  strings.Join(kinds, ","),
+		Active: true,
+	}
+	if err := ws.db.Create(&webhook).Error; err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (ws *WebhookService) List() ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := ws.db.Where("active = ?", true).Find(&webhooks).Error
+	return webhooks, err
+}
+
+// Remove stops delivering to a webhook. Its pending deliveries are dropped.
+func (ws *WebhookService) Remove(webhookUuid string) error {
+	var webhook Webhook
+	err := ws.db.Where("uuid = ?", webhookUuid).First(&webhook).Error
+	if err == gorm.ErrRecordNotFound {
+		return errors.New("Webhook was not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	tx := ws.db.Begin()
+	if err := tx.Model(&webhook).Update("active", false).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Model(&WebhookDelivery{}).Where(
+		"webhook_id = ? AND status = ?", webhook.ID, DELIVERY_PENDING,
+	).Update("status", DELIVERY_FAILED).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	wait := WEBHOOK_BACKOFF_BASE
+	for i := 1; i < attempts && wait < WEBHOOK_BACKOFF_MAX; i++ {
+		wait *= 2
+	}
+	if wait > WEBHOOK_BACKOFF_MAX {
+		wait = WEBHOOK_BACKOFF_MAX
+	}
+	return wait
+}
+
+// DeliverDue attempts every delivery that is due, returning how many went
+// through.
+func (ws *WebhookService) DeliverDue(ctx context.Context, now time.Time) (int, error) {
+	var deliveries []*WebhookDelivery
+	err := ws.db.Where(
+		"status = ? AND next_attempt_at <= ?", DELIVERY_PENDING, now,
+	).Order("id").Limit(WEBHOOK_DELIVERY_BATCH).Find(&deliveries).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var delivered int
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			break
+		}
+		err := ws.attempt(ctx, delivery)
+		if err == nil {
+			delivered++
+			ws.db.Model(delivery).Updates(map[string]interface{}{
+				"status":   DELIVERY_DELIVERED,
+				"attempts": delivery.Attempts + 1,
+			})
+			continue
+		}
+
+		attempts := delivery.Attempts + 1
+		updates := map[string]interface{}{
+			"attempts":        attempts,
+			"last_error":      err.Error(),
+			"next_attempt_at": now.Add(webhookBackoff(attempts)),
+		}
+		if attempts >= WEBHOOK_MAX_ATTEMPTS {
+			updates["status"] = DELIVERY_FAILED
+		}
+		ws.db.Model(delivery).Updates(updates)
+	}
+	return delivered, nil
+}
+
+func (ws *WebhookService) attempt(ctx context.Context, delivery *WebhookDelivery) error {
+	var event WalletEvent
+	if err := ws.db.First(&event, delivery.EventID).Error; err != nil {
+		return err
+	}
+	var webhook Webhook
+	if err := ws.db.First(&webhook, delivery.WebhookID).Error; err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(event.Payload())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignPayload(webhook.Secret, body))
+	req.Header.Set(WEBHOOK_EVENT_HEADER, event.Kind)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, fmt.Sprintf("%s-%d", event.Uuid, delivery.ID))
+
+	res, err := ws.netClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Run delivers due events until ctx is done. Deliveries left pending when
+// the process stops are picked up by the next run.
+func (ws *WebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(WEBHOOK_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := ws.DeliverDue(ctx, time.Now()); err != nil {
+				Error.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package wallet
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	var failing int32 = 1
+	received := make(chan bool, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		received <- request.Header.Get(WEBHOOK_SIGNATURE_HEADER) == SignPayload("secret", body)
+		if atomic.LoadInt32(&failing) == 1 {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	webhooks := NewWebhookService(testDB)
+	if _, err := webhooks.Register("ftp://example.com", "", nil); err == nil {
+		t.Fail()
+	}
+	webhook, err := webhooks.Register(server.URL, "secret", nil)
+	if err != nil {
+		t.FailNow()
+	}
+	defer webhooks.Remove(webhook.Uuid)
+
+	recorder := NewEventRecorder(testDB)
+	err = recorder.Record(&WalletEvent{Kind: EVENT_DEPOSIT_SEEN, Address: "webhookAddress", Amount: 1000})
+	if err != nil {
+		t.FailNow()
+	}
+
+	now := time.Now()
+	delivered, err := webhooks.DeliverDue(context.Background(), now)
+	if err != nil || delivered != 0 || !<-received {
+		t.Fail()
+	}
+	// The failed delivery waits for its backoff
+	delivered, _ = webhooks.DeliverDue(context.Background(), now)
+	if delivered != 0 || len(received) != 0 {
+		t.Fail()
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	delivered, _ = webhooks.DeliverDue(context.Background(), now.Add(WEBHOOK_BACKOFF_BASE))
+	if delivered != 1 || !<-received {
+		t.Fail()
+	}
+}